@@ -0,0 +1,3 @@
+"""
+Timing scripts for DocuSearch performance changes
+"""
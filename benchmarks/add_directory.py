@@ -0,0 +1,50 @@
+#!/usr/bin/env python3
+"""
+Benchmark adding a generated directory with one worker and with a pool
+
+Run from the repository root with: uv run python -m benchmarks.add_directory
+"""
+
+import random
+import tempfile
+import time
+from pathlib import Path
+
+from benchmarks.common import make_text, make_vocabulary
+from docusearch import DocumentStorage
+
+FILE_COUNT = 2000
+WORDS_PER_FILE = 2000
+
+
+def generate_directory(dir_path: Path) -> None:
+    """Write FILE_COUNT text files of random words under dir_path"""
+    rng = random.Random(0)
+    vocabulary = make_vocabulary(5000)
+    for i in range(FILE_COUNT):
+        subdir = dir_path / f"group_{i % 20}"
+        subdir.mkdir(exist_ok=True)
+        (subdir / f"file_{i}.txt").write_text(
+            make_text(rng, vocabulary, WORDS_PER_FILE)
+        )
+
+
+def time_ingestion(dir_path: Path, max_workers: int) -> float:
+    """Time adding dir_path to a fresh storage"""
+    storage = DocumentStorage()
+    start = time.perf_counter()
+    storage.add_document_from_path(str(dir_path), max_workers=max_workers)
+    return time.perf_counter() - start
+
+
+def main() -> None:
+    with tempfile.TemporaryDirectory() as temp_dir:
+        dir_path = Path(temp_dir)
+        generate_directory(dir_path)
+        for max_workers in [1, 4, 8]:
+            elapsed = time_ingestion(dir_path, max_workers)
+            print(f"max_workers={max_workers}: {elapsed:.3f}s for {FILE_COUNT} files")
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,25 @@
+"""
+Generated text shared by the benchmarks
+"""
+
+import random
+import string
+from typing import List
+
+
+def make_vocabulary(size: int) -> List[str]:
+    """Make size distinct lowercase words that the default tokenizer keeps"""
+    words = []
+    for i in range(size):
+        letters = []
+        i += 26 * 27  # Start at three letters so every word is indexable
+        while i:
+            i, remainder = divmod(i, 26)
+            letters.append(string.ascii_lowercase[remainder])
+        words.append("".join(reversed(letters)))
+    return words
+
+
+def make_text(rng: random.Random, vocabulary: List[str], word_count: int) -> str:
+    """Make text of word_count words drawn at random from vocabulary"""
+    return " ".join(rng.choices(vocabulary, k=word_count))
@@ -0,0 +1,54 @@
+#!/usr/bin/env python3
+"""
+Benchmark loading a large-vocabulary storage file with and without the trie
+
+Files saved with include_trie restore the trie directly; other files
+rebuild it from the forward index.
+
+Run from the repository root with: uv run python -m benchmarks.load_trie
+"""
+
+import random
+import tempfile
+import time
+from pathlib import Path
+
+from benchmarks.common import make_text, make_vocabulary
+from docusearch import DocumentStorage
+
+DOCUMENT_COUNT = 2000
+WORDS_PER_DOCUMENT = 200
+VOCABULARY_SIZE = 100_000
+
+
+def build_storage() -> DocumentStorage:
+    """Index DOCUMENT_COUNT documents drawn from a large vocabulary"""
+    rng = random.Random(0)
+    vocabulary = make_vocabulary(VOCABULARY_SIZE)
+    storage = DocumentStorage()
+    for i in range(DOCUMENT_COUNT):
+        content = make_text(rng, vocabulary, WORDS_PER_DOCUMENT)
+        storage.add_document(content, f"doc{i}")
+    return storage
+
+
+def time_load(file_path: Path) -> float:
+    """Time loading a storage file"""
+    start = time.perf_counter()
+    DocumentStorage.load(file_path)
+    return time.perf_counter() - start
+
+
+def main() -> None:
+    storage = build_storage()
+    with tempfile.TemporaryDirectory() as temp_dir:
+        for include_trie in [False, True]:
+            file_path = Path(temp_dir) / f"storage_{include_trie}.json"
+            storage.save(file_path, include_trie=include_trie)
+            elapsed = time_load(file_path)
+            label = "with trie" if include_trie else "rebuilding trie"
+            print(f"load {label}: {elapsed:.3f}s")
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,59 @@
+#!/usr/bin/env python3
+"""
+Benchmark removing documents from a store with a large vocabulary
+
+Compares pruning only the words a removed document was the last to
+contain, as DocumentStorage.remove_document does, with trying to prune
+every one of the document's words from the trie.
+
+Run from the repository root with: uv run python -m benchmarks.remove_document
+"""
+
+import random
+import time
+
+from benchmarks.common import make_text, make_vocabulary
+from docusearch import DocumentStorage
+
+DOCUMENT_COUNT = 2000
+WORDS_PER_DOCUMENT = 500
+VOCABULARY_SIZE = 100_000
+
+
+def build_storage() -> DocumentStorage:
+    """Index DOCUMENT_COUNT documents drawn from a large vocabulary"""
+    rng = random.Random(0)
+    vocabulary = make_vocabulary(VOCABULARY_SIZE)
+    storage = DocumentStorage()
+    for i in range(DOCUMENT_COUNT):
+        content = make_text(rng, vocabulary, WORDS_PER_DOCUMENT)
+        storage.add_document(content, f"doc{i}")
+    return storage
+
+
+def time_removal(storage: DocumentStorage, prune_every_word: bool) -> float:
+    """Time removing every document's postings from the trie and pruning words
+
+    With prune_every_word, pruning is tried for each of a document's words,
+    as remove_document did before remove_document_from_word reported when a
+    word was left with no documents.
+    """
+    start = time.perf_counter()
+    for i in range(DOCUMENT_COUNT):
+        doc_id = f"doc{i}"
+        for word in storage._forward_index.get_document_words(doc_id):
+            emptied = storage.trie.remove_document_from_word(word, doc_id)
+            if emptied or prune_every_word:
+                storage.trie.remove(word)
+    return time.perf_counter() - start
+
+
+def main() -> None:
+    for prune_every_word in [True, False]:
+        elapsed = time_removal(build_storage(), prune_every_word)
+        label = "every word" if prune_every_word else "emptied words"
+        print(f"prune {label}: {elapsed:.3f}s for {DOCUMENT_COUNT} documents")
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,46 @@
+#!/usr/bin/env python3
+"""
+Benchmark search_ids against search on documents with large contents
+
+Run from the repository root with: uv run python -m benchmarks.search_ids
+"""
+
+import random
+import time
+
+from benchmarks.common import make_text, make_vocabulary
+from docusearch import DocumentStorage
+
+DOCUMENT_COUNT = 500
+WORDS_PER_DOCUMENT = 20_000
+TOP_K = 50
+REPEATS = 20
+
+
+def build_storage() -> DocumentStorage:
+    """Index DOCUMENT_COUNT large documents that mention "needle" near the end"""
+    rng = random.Random(0)
+    vocabulary = make_vocabulary(5000)
+    storage = DocumentStorage()
+    for i in range(DOCUMENT_COUNT):
+        content = make_text(rng, vocabulary, WORDS_PER_DOCUMENT)
+        storage.add_document(f"{content} needle", f"doc{i}")
+    return storage
+
+
+def main() -> None:
+    storage = build_storage()
+    assert [doc_id for doc_id, _, _ in storage.search("needle", TOP_K)] == [
+        doc_id for doc_id, _ in storage.search_ids("needle", TOP_K)
+    ]
+
+    for method in [storage.search, storage.search_ids]:
+        start = time.perf_counter()
+        for _ in range(REPEATS):
+            method("needle", TOP_K)
+        elapsed = (time.perf_counter() - start) / REPEATS
+        print(f"{method.__name__}: {elapsed * 1000:.2f}ms for top_k={TOP_K}")
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,61 @@
+#!/usr/bin/env python3
+"""
+Benchmark selecting the top results of a query matching many documents
+
+Compares the bounded heap search uses to pick the top_k results with
+sorting every matching document, then times search itself.
+
+Run from the repository root with: uv run python -m benchmarks.top_k
+"""
+
+import heapq
+import random
+import time
+
+from benchmarks.common import make_text, make_vocabulary
+from docusearch import DocumentStorage
+
+DOCUMENT_COUNT = 50_000
+WORDS_PER_DOCUMENT = 20
+TOP_K = 10
+REPEATS = 20
+
+
+def build_storage() -> DocumentStorage:
+    """Index DOCUMENT_COUNT documents that all contain the word common"""
+    rng = random.Random(0)
+    vocabulary = make_vocabulary(1000)
+    storage = DocumentStorage()
+    for i in range(DOCUMENT_COUNT):
+        content = make_text(rng, vocabulary, WORDS_PER_DOCUMENT)
+        storage.add_document(f"common {content}", f"doc{i}")
+    return storage
+
+
+def main() -> None:
+    storage = build_storage()
+    doc_scores = dict(storage.search_ids("common", top_k=0))
+
+    start = time.perf_counter()
+    for _ in range(REPEATS):
+        sorted(doc_scores.items(), key=lambda x: x[1], reverse=True)[:TOP_K]
+    sort_elapsed = (time.perf_counter() - start) / REPEATS
+
+    start = time.perf_counter()
+    for _ in range(REPEATS):
+        heapq.nlargest(TOP_K, doc_scores.items(), key=lambda x: x[1])
+    heap_elapsed = (time.perf_counter() - start) / REPEATS
+
+    start = time.perf_counter()
+    for _ in range(REPEATS):
+        storage.search("common", top_k=TOP_K)
+    search_elapsed = (time.perf_counter() - start) / REPEATS
+
+    print(f"{len(doc_scores)} matching documents, top_k={TOP_K}")
+    print(f"full sort:    {sort_elapsed * 1000:.2f}ms")
+    print(f"bounded heap: {heap_elapsed * 1000:.2f}ms")
+    print(f"search:       {search_elapsed * 1000:.2f}ms")
+
+
+if __name__ == "__main__":
+    main()
@@ -1,9 +1,47 @@
 from docusearch.cli import PROJECT_DESCRIPTION
 
 from .index import ForwardIndex, ReverseIndex
-from .storage import DocumentStorage
-from .trie import Trie
+from .metrics import MetricsObserver
+from .query import QuerySyntaxError, parse
+from .scoring import BM25Scorer, IndexStats, Scorer, TfIdfScorer
+from .storage import (
+    DocumentStorage,
+    FileError,
+    IngestionCancelled,
+    SearchOptions,
+)
+from .tokenizers import (
+    cjk_bigram_tokenize,
+    code_tokenize,
+    collapse_repeats,
+    fold_diacritics,
+    join_hyphenated,
+    normalize_width,
+)
+from .trie import RadixTrie, Trie
 
 __version__ = "0.1.0"
-__all__ = ["DocumentStorage", "Trie", "ForwardIndex", "ReverseIndex"]
+__all__ = [
+    "DocumentStorage",
+    "SearchOptions",
+    "Scorer",
+    "IndexStats",
+    "TfIdfScorer",
+    "BM25Scorer",
+    "FileError",
+    "IngestionCancelled",
+    "MetricsObserver",
+    "QuerySyntaxError",
+    "parse",
+    "Trie",
+    "RadixTrie",
+    "ForwardIndex",
+    "ReverseIndex",
+    "cjk_bigram_tokenize",
+    "code_tokenize",
+    "collapse_repeats",
+    "fold_diacritics",
+    "join_hyphenated",
+    "normalize_width",
+]
 __doc__ = PROJECT_DESCRIPTION
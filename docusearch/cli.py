@@ -11,6 +11,7 @@ from typing import Final, Optional, ParamSpec, TypeVar
 
 import click
 
+from .scoring import BM25Scorer
 from .storage import DocumentStorage
 
 HISTORY_FILE: Final = Path(".docusearch_history")
@@ -67,10 +68,26 @@ def main() -> None:
 @main.command()
 @click.argument("file_path", type=click.Path(exists=True, path_type=Path))
 @click.option("--doc-id", "-i", help="Custom document ID (only for single files)")
+@click.option(
+    "--extensions",
+    "-e",
+    help="Comma-separated file extensions to add from a directory (e.g. .md,.ipynb)",
+)
+@click.option(
+    "--recursive/--no-recursive",
+    default=True,
+    help="Whether to add files in subdirectories",
+)
 @click.option(
     "--storage-file", "-s", type=click.Path(), help="Storage file to load/save"
 )
-def add(file_path: Path, doc_id: Optional[str], storage_file: Optional[Path]) -> None:
+def add(
+    file_path: Path,
+    doc_id: Optional[str],
+    extensions: Optional[str],
+    recursive: bool,
+    storage_file: Optional[Path],
+) -> None:
     """Add a document from a file path or all files in a directory"""
     storage = load_storage(storage_file, raises=False)
 
@@ -79,12 +96,7 @@ def add(file_path: Path, doc_id: Optional[str], storage_file: Optional[Path]) ->
             if doc_id:
                 content = storage._doc_id_to_document.get(str(file_path), "")
                 if not content:
-                    try:
-                        with open(file_path, "r", encoding="utf-8") as f:
-                            content = f.read()
-                    except UnicodeDecodeError:
-                        with open(file_path, "r", encoding="latin-1") as f:
-                            content = f.read()
+                    content = storage.extract_content(file_path)
 
                 doc_id = storage.add_document(content, doc_id)
                 click.echo(f"Document added with ID: {doc_id}")
@@ -97,7 +109,11 @@ def add(file_path: Path, doc_id: Optional[str], storage_file: Optional[Path]) ->
                     "Warning: --doc-id option is ignored when adding a directory"
                 )
 
-            doc_ids = storage.add_document_from_path(str(file_path))
+            doc_ids = storage.add_document_from_path(
+                str(file_path),
+                extensions=extensions.split(",") if extensions else None,
+                recursive=recursive,
+            )
             click.echo(f"Added {len(doc_ids)} documents from directory")
             for doc_id in doc_ids:
                 click.echo(f"  - {doc_id}")
@@ -119,22 +135,36 @@ def add(file_path: Path, doc_id: Optional[str], storage_file: Optional[Path]) ->
 
 @main.command()
 @click.argument("query")
-@click.option("--top-k", "-k", default=5, help="Number of top results to return")
+@click.option(
+    "--top-k", "-k", default=5, help="Number of top results to return (0 for all)"
+)
 @click.option(
     "--storage-file", "-s", type=click.Path(), help="Storage file to load/save"
 )
-def search(query: str, top_k: int, storage_file: Optional[Path]) -> None:
+@click.option(
+    "--rank",
+    type=click.Choice(["tfidf", "bm25", "cosine"]),
+    default="tfidf",
+    show_default=True,
+    help="Ranking algorithm (cosine ignores wildcards and boosts but honours -term)",
+)
+def search(query: str, top_k: int, storage_file: Optional[Path], rank: str) -> None:
     """Search for documents using smart search (exact + wildcard prefix)
 
     Smart search rules:
     - Use exact word matching by default
-    - If query ends with *, use prefix search (e.g., "prog*")
+    - Terms ending with * use prefix search (e.g., "python prog*")
     - Use \\* to search for literal * (escape the wildcard)
     """
     storage = load_storage(storage_file, raises=False)
+    if rank == "bm25":
+        storage.scorer = BM25Scorer()
 
     with stopwatch() as now:
-        results = storage.smart_search(query, top_k)
+        if rank == "cosine":
+            results = storage.search_cosine(query, top_k)
+        else:
+            results = storage.smart_search(query, top_k)
 
         if not results:
             click.echo("No results found.")
@@ -172,7 +202,7 @@ def prefix(prefix: str, storage_file: Optional[str]):
             return
 
         click.echo(f"Words starting with '{prefix}' (found in {now():.4f} seconds):")
-        for word in sorted(words):
+        for word in words:
             click.echo(f"  {word}")
 
 
@@ -235,7 +265,8 @@ def add_and_search(file_path: Path, storage_file: Optional[Path]) -> None:
 
 @main.command()
 @click.option("--storage-file", "-s", type=click.Path(), help="Storage file to load")
-def stats(storage_file: Optional[str]):
+@click.option("--verbose", "-v", is_flag=True, help="Also show trie shape statistics")
+def stats(storage_file: Optional[str], verbose: bool):
     """Show storage statistics"""
     storage = load_storage(storage_file, raises=False)
 
@@ -245,6 +276,12 @@ def stats(storage_file: Optional[str]):
     click.echo(f"  Total documents: {stats['total_documents']}")
     click.echo(f"  Total unique words: {stats['total_words']}")
     click.echo(f"  Documents in index: {stats['total_documents_in_index']}")
+    click.echo(f"  Average document length: {stats['average_document_length']:.2f}")
+    click.echo(f"  Max document length: {stats['max_document_length']}")
+    click.echo(f"  Estimated memory usage: {storage.estimate_memory_usage()} bytes")
+    if verbose:
+        click.echo(f"  Trie nodes: {storage.trie.get_node_count()}")
+        click.echo(f"  Trie max depth: {storage.trie.get_max_depth()}")
 
 
 @main.command()
@@ -254,7 +291,8 @@ def repl():
 
     storage = DocumentStorage()
     click.echo(
-        "DocuSearch REPL - type 'help' for commands. All data is in-memory and will be lost on exit."
+        "DocuSearch REPL - type 'help' for commands. All data is in-memory and "
+        "will be lost on exit unless saved."
     )
 
     while True:
@@ -275,12 +313,14 @@ Commands:
   prefix <prefix>        List words starting with prefix
   stats                  Show storage statistics
   list                   List all document IDs
+  save <path>            Save all documents to a storage file
+  load <path>            Replace all documents with those in a storage file
   help                   Show this help message
   exit/quit/q            Exit the REPL
 
 Smart search rules:
   - Use exact word matching by default
-  - If query ends with *, use prefix search (e.g., "prog*")
+  - Terms ending with * use prefix search (e.g., "python prog*")
   - Use \\* to search for literal * (escape the wildcard)
 """)
             elif cmd.startswith("add "):
@@ -344,12 +384,36 @@ Smart search rules:
                         click.echo(f"Prefix search completed in {now():.4f} seconds")
                     else:
                         click.echo(
-                            f"Words (found in {now():.4f} seconds): {', '.join(sorted(words))}"
+                            f"Words (found in {now():.4f} seconds): {', '.join(words)}"
                         )
             elif cmd == "stats":
                 stats = storage.get_stats()
                 click.echo(f"Total documents: {stats['total_documents']}")
                 click.echo(f"Total unique words: {stats['total_words']}")
+                click.echo(
+                    f"Average document length: {stats['average_document_length']:.2f}"
+                )
+                click.echo(f"Max document length: {stats['max_document_length']}")
+                click.echo(
+                    f"Estimated memory usage: {storage.estimate_memory_usage()} bytes"
+                )
+            elif cmd.startswith("save "):
+                _, path = cmd.split(" ", 1)
+                try:
+                    storage.save(Path(path.strip()))
+                    click.echo(f"Saved storage to {path.strip()}")
+                except Exception as e:
+                    click.echo(f"Error: {e}")
+            elif cmd.startswith("load "):
+                _, path = cmd.split(" ", 1)
+                try:
+                    storage = DocumentStorage.load(Path(path.strip()))
+                    click.echo(
+                        f"Loaded {storage.get_stats()['total_documents']} documents "
+                        f"from {path.strip()}"
+                    )
+                except Exception as e:
+                    click.echo(f"Error: {e}")
             elif cmd == "list":
                 doc_ids = list(storage._doc_id_to_document.keys())
                 if not doc_ids:
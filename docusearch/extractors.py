@@ -0,0 +1,108 @@
+"""
+Content extractors for converting files into indexable text
+"""
+
+import codecs
+import zipfile
+from collections.abc import Callable, MutableMapping
+from pathlib import Path
+from xml.etree import ElementTree
+
+Extractor = Callable[[Path], str]
+
+TEXT_EXTENSIONS = {
+    ".txt",
+    ".md",
+    ".py",
+    ".js",
+    ".html",
+    ".css",
+    ".json",
+    ".xml",
+    ".csv",
+    ".tsv",
+    ".log",
+    ".rst",
+    ".tex",
+    ".adoc",
+    ".org",
+}
+
+# Byte order marks and the codecs that decode their files without the mark
+_BOM_ENCODINGS = (
+    (codecs.BOM_UTF8, "utf-8-sig"),
+    (codecs.BOM_UTF16_LE, "utf-16"),
+    (codecs.BOM_UTF16_BE, "utf-16"),
+)
+
+_WORD_NAMESPACE = "{http://schemas.openxmlformats.org/wordprocessingml/2006/main}"
+
+
+def extract_text(file_path: Path) -> str:
+    """Read a plain text file, falling back to latin-1 for non-UTF-8 content
+
+    Files starting with a UTF-8 or UTF-16 byte order mark are decoded with
+    the matching encoding and the mark is removed.
+    """
+    with open(file_path, "rb") as f:
+        head = f.read(len(codecs.BOM_UTF8))
+    for bom, encoding in _BOM_ENCODINGS:
+        if head.startswith(bom):
+            with open(file_path, "r", encoding=encoding) as f:
+                return f.read()
+
+    try:
+        with open(file_path, "r", encoding="utf-8") as f:
+            return f.read()
+    except UnicodeDecodeError:
+        with open(file_path, "r", encoding="latin-1") as f:
+            return f.read()
+
+
+def is_binary_file(file_path: Path, sample_size: int = 8192) -> bool:
+    """Guess whether a file is binary from NUL bytes near its start
+
+    Files starting with a byte order mark are treated as text, since UTF-16
+    text contains NUL bytes.
+    """
+    with open(file_path, "rb") as f:
+        sample = f.read(sample_size)
+    if any(sample.startswith(bom) for bom, _ in _BOM_ENCODINGS):
+        return False
+    return b"\0" in sample
+
+
+def extract_docx(file_path: Path) -> str:
+    """Extract paragraph text from a Word .docx file"""
+    with zipfile.ZipFile(file_path) as archive:
+        root = ElementTree.fromstring(archive.read("word/document.xml"))
+
+    paragraphs = []
+    for paragraph in root.iter(f"{_WORD_NAMESPACE}p"):
+        paragraphs.append(
+            "".join(node.text or "" for node in paragraph.iter(f"{_WORD_NAMESPACE}t"))
+        )
+    return "\n".join(paragraphs)
+
+
+def extract_pdf(file_path: Path) -> str:
+    """Extract page text from a PDF file using pypdf"""
+    try:
+        from pypdf import PdfReader
+    except ImportError as e:
+        raise ImportError(
+            "Reading PDF files requires pypdf; install it with 'docusearch[pdf]'"
+        ) from e
+
+    reader = PdfReader(file_path)
+    return "\n".join(page.extract_text() or "" for page in reader.pages)
+
+
+def default_extractors() -> MutableMapping[str, Extractor]:
+    """Get the built-in extractors keyed by lowercase file extension"""
+    extractors: MutableMapping[str, Extractor] = {
+        extension: extract_text for extension in TEXT_EXTENSIONS
+    }
+    extractors[".docx"] = extract_docx
+    extractors[".pdf"] = extract_pdf
+    return extractors
@@ -4,21 +4,86 @@ Indexing system for document storage
 
 import math
 from collections import defaultdict
-from collections.abc import Mapping, MutableMapping
+from collections.abc import Iterable, Mapping, MutableMapping
 from collections.abc import Set as AbstractSet
+from typing import List, Optional, Set
 
 
 class ForwardIndex:
     """Forward index mapping documents to word frequencies"""
 
-    def __init__(self):
-        self._doc_id_to_document: MutableMapping[str, MutableMapping[str, int]] = {}
-        self._doc_id_to_doc_length: MutableMapping[str, int] = {}
+    def __init__(
+        self,
+        documents: Optional[MutableMapping[str, MutableMapping[str, int]]] = None,
+        doc_lengths: Optional[MutableMapping[str, int]] = None,
+        positions: Optional[MutableMapping[str, MutableMapping[str, List[int]]]] = None,
+        store_positions: bool = False,
+        lead_words: Optional[Mapping[str, Iterable[str]]] = None,
+    ):
+        self._doc_id_to_document: MutableMapping[str, MutableMapping[str, int]] = (
+            documents if documents is not None else {}
+        )
+        self._doc_id_to_doc_length: MutableMapping[str, int] = (
+            doc_lengths if doc_lengths is not None else {}
+        )
+        # Token offsets of each word per document, only kept when
+        # store_positions is True since they cost memory per token
+        self.store_positions = store_positions
+        self._doc_id_to_positions: MutableMapping[
+            str, MutableMapping[str, List[int]]
+        ] = (positions if positions is not None else {})
+        # Words in the lead of each document, its opening text, so that lead
+        # matches can be scored without the document's content
+        self._doc_id_to_lead_words: MutableMapping[str, Set[str]] = {
+            doc_id: set(words) for doc_id, words in (lead_words or {}).items()
+        }
+        # Sum of every document length, kept up to date by each change so the
+        # average length is available without a full scan
+        self._total_length = 0
+        self.recompute_aggregates()
+
+    def recompute_aggregates(self) -> None:
+        """Recompute the total document length from the stored lengths"""
+        self._total_length = sum(self._doc_id_to_doc_length.values())
+
+    def add_document(
+        self,
+        doc_id: str,
+        word_counts: MutableMapping[str, int],
+        doc_length: Optional[int] = None,
+        positions: Optional[Mapping[str, List[int]]] = None,
+        lead_words: Iterable[str] = (),
+    ) -> None:
+        """Add a document with its word frequencies
 
-    def add_document(self, doc_id: str, word_counts: MutableMapping[str, int]) -> None:
-        """Add a document with its word frequencies"""
+        The document length defaults to the total of the word counts.
+        Positions are ignored unless store_positions is True.
+        """
+        self._total_length -= self._doc_id_to_doc_length.get(doc_id, 0)
         self._doc_id_to_document[doc_id] = word_counts.copy()
-        self._doc_id_to_doc_length[doc_id] = sum(word_counts.values())
+        self._doc_id_to_doc_length[doc_id] = (
+            sum(word_counts.values()) if doc_length is None else doc_length
+        )
+        self._total_length += self._doc_id_to_doc_length[doc_id]
+        if self.store_positions and positions is not None:
+            self._doc_id_to_positions[doc_id] = {
+                word: list(offsets) for word, offsets in positions.items()
+            }
+        self._doc_id_to_lead_words[doc_id] = set(lead_words)
+        if not self._doc_id_to_lead_words[doc_id]:
+            del self._doc_id_to_lead_words[doc_id]
+
+    def get_lead_words(self, doc_id: str) -> AbstractSet[str]:
+        """Get the words in a document's lead"""
+        return set(self._doc_id_to_lead_words.get(doc_id, ()))
+
+    def is_lead_word(self, doc_id: str, word: str) -> bool:
+        """Check whether a word occurs in a document's lead"""
+        return word.lower() in self._doc_id_to_lead_words.get(doc_id, ())
+
+    def get_positions(self, doc_id: str, word: str) -> List[int]:
+        """Get the token offsets of a word in a document, in document order"""
+        return list(self._doc_id_to_positions.get(doc_id, {}).get(word.lower(), []))
 
     def get_word_count(self, doc_id: str, word: str) -> int:
         """Get the count of a word in a document"""
@@ -28,18 +93,70 @@ class ForwardIndex:
         """Get all words and their counts for a document"""
         return self._doc_id_to_document.get(doc_id, {}).copy()
 
+    def get_document_positions(self, doc_id: str) -> Optional[Mapping[str, List[int]]]:
+        """Get the token offsets of every word in a document, if stored"""
+        positions = self._doc_id_to_positions.get(doc_id)
+        if positions is None:
+            return None
+        return {word: list(offsets) for word, offsets in positions.items()}
+
     def get_document_length(self, doc_id: str) -> int:
         """Get the total number of words in a document"""
         return self._doc_id_to_doc_length.get(doc_id, 0)
 
+    def get_document_lengths(self) -> Mapping[str, int]:
+        """Get the total number of words in every document"""
+        return dict(self._doc_id_to_doc_length)
+
     def remove_document(self, doc_id: str) -> bool:
         """Remove a document from the index"""
         if doc_id in self._doc_id_to_document:
             del self._doc_id_to_document[doc_id]
-            del self._doc_id_to_doc_length[doc_id]
+            self._total_length -= self._doc_id_to_doc_length.pop(doc_id)
+            self._doc_id_to_positions.pop(doc_id, None)
+            self._doc_id_to_lead_words.pop(doc_id, None)
+            return True
+        return False
+
+    def remove_word(self, doc_id: str, word: str, reduce_length: bool = True) -> int:
+        """Remove a word from a document, returning how many times it occurred
+
+        When reduce_length is True the document length drops by that count.
+        """
+        count = self._doc_id_to_document.get(doc_id, {}).pop(word.lower(), 0)
+        self._doc_id_to_positions.get(doc_id, {}).pop(word.lower(), None)
+        self._doc_id_to_lead_words.get(doc_id, set()).discard(word.lower())
+        if reduce_length and count:
+            self._doc_id_to_doc_length[doc_id] -= count
+            self._total_length -= count
+        return count
+
+    def rename_document(self, old_doc_id: str, new_doc_id: str) -> bool:
+        """Move a document's word frequencies to a new ID"""
+        if old_doc_id in self._doc_id_to_document:
+            self._doc_id_to_document[new_doc_id] = self._doc_id_to_document.pop(
+                old_doc_id
+            )
+            self._doc_id_to_doc_length[new_doc_id] = self._doc_id_to_doc_length.pop(
+                old_doc_id
+            )
+            if old_doc_id in self._doc_id_to_positions:
+                self._doc_id_to_positions[new_doc_id] = self._doc_id_to_positions.pop(
+                    old_doc_id
+                )
+            if old_doc_id in self._doc_id_to_lead_words:
+                self._doc_id_to_lead_words[new_doc_id] = (
+                    self._doc_id_to_lead_words.pop(old_doc_id)
+                )
             return True
         return False
 
+    def get_average_document_length(self) -> float:
+        """Get the mean document length from the running total"""
+        if not self._doc_id_to_doc_length:
+            return 0
+        return self._total_length / len(self._doc_id_to_doc_length)
+
     def get_all_document_ids(self) -> AbstractSet[str]:
         """Get all document IDs"""
         return set(self._doc_id_to_document.keys())
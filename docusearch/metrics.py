@@ -0,0 +1,20 @@
+"""
+Hooks for reporting storage activity to a metrics system
+"""
+
+
+class MetricsObserver:
+    """Receives storage events; every method does nothing by default
+
+    Subclass and override the events of interest to forward them to a
+    metrics library.
+    """
+
+    def observe_search(self, duration: float, num_results: int) -> None:
+        """Called after a search with its duration in seconds"""
+
+    def observe_add(self, doc_id: str) -> None:
+        """Called after a document is added"""
+
+    def observe_remove(self, doc_id: str) -> None:
+        """Called after a document is removed"""
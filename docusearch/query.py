@@ -0,0 +1,270 @@
+"""
+Parser for structured search queries
+"""
+
+import re
+from dataclasses import dataclass
+from typing import List, Optional, Tuple, Union
+
+# Operators are only recognized in upper case so that "and", "or" and "not"
+# are still searchable as ordinary words
+_OPERATORS = {"AND", "OR", "NOT"}
+
+# A word with an optional trailing * for prefix matching and ^weight boost
+_WORD = re.compile(
+    r"(?P<text>(?:[^\s()\"^*\\]|\\.)+)(?P<star>\*)?(?:\^(?P<boost>[^\s()]*))?"
+)
+_BOOST = re.compile(r"\^(?P<boost>[^\s()]*)")
+
+
+@dataclass(frozen=True)
+class Term:
+    """A word matched exactly"""
+
+    text: str
+    boost: float = 1.0
+
+
+@dataclass(frozen=True)
+class Prefix:
+    """Words starting with text, written as text*"""
+
+    text: str
+    boost: float = 1.0
+
+
+@dataclass(frozen=True)
+class Phrase:
+    """Words that must occur consecutively, written in double quotes"""
+
+    words: Tuple[str, ...]
+    boost: float = 1.0
+
+
+@dataclass(frozen=True)
+class Not:
+    """Excludes documents matching operand, written as NOT x or -x"""
+
+    operand: "Node"
+
+
+@dataclass(frozen=True)
+class And:
+    """Documents matching every operand, written as x AND y or just x y"""
+
+    operands: Tuple["Node", ...]
+
+
+@dataclass(frozen=True)
+class Or:
+    """Documents matching any operand, written as x OR y"""
+
+    operands: Tuple["Node", ...]
+
+
+Node = Union[Term, Prefix, Phrase, Not, And, Or]
+
+
+class QuerySyntaxError(ValueError):
+    """Raised for a malformed query, with the offset where parsing failed"""
+
+    def __init__(self, reason: str, position: int):
+        super().__init__(f"{reason} at position {position}")
+        self.reason = reason
+        self.position = position
+
+
+@dataclass(frozen=True)
+class _Token:
+    """An operator, parenthesis or parsed term and where it starts"""
+
+    kind: str
+    position: int
+    value: Optional[Node] = None
+
+
+def parse(query: str) -> Node:
+    """Parse a query into a tree of terms and boolean operators
+
+    Adjacent terms are combined with AND, which binds tighter than OR.
+    Parentheses group, NOT or a leading - excludes, "..." matches a phrase,
+    a trailing * matches a prefix and ^weight boosts a term or phrase.
+
+    Raises:
+        QuerySyntaxError: If the query is empty or malformed
+    """
+    parser = _Parser(_tokenize(query), len(query))
+    if parser.at_end():
+        raise QuerySyntaxError("Query is empty", 0)
+
+    node = parser.parse_or()
+    if not parser.at_end():
+        token = parser.peek()
+        raise QuerySyntaxError("Unmatched closing parenthesis", token.position)
+    return node
+
+
+def _tokenize(query: str) -> List[_Token]:
+    """Split a query into operators, parentheses, terms and phrases"""
+    tokens = []
+    position = 0
+    while position < len(query):
+        char = query[position]
+        if char.isspace():
+            position += 1
+        elif char in "()":
+            tokens.append(_Token(char, position))
+            position += 1
+        elif char == "-" and position + 1 < len(query) and not (
+            query[position + 1].isspace() or query[position + 1] in "()"
+        ):
+            tokens.append(_Token("NOT", position))
+            position += 1
+        elif char == '"':
+            position = _read_phrase(query, position, tokens)
+        else:
+            match = _WORD.match(query, position)
+            if match is None:
+                raise QuerySyntaxError(f"Unexpected character {char!r}", position)
+            text = re.sub(r"\\(.)", r"\1", match.group("text"))
+            if match.group("star") is None and match.group("boost") is None:
+                if text in _OPERATORS and text == match.group("text"):
+                    tokens.append(_Token(text, position))
+                    position = match.end()
+                    continue
+            boost = _parse_boost(match.group("boost"), match.start("boost") - 1)
+            node_type = Prefix if match.group("star") else Term
+            tokens.append(_Token("TERM", position, node_type(text, boost)))
+            position = match.end()
+    return tokens
+
+
+def _read_phrase(query: str, start: int, tokens: List[_Token]) -> int:
+    """Read a quoted phrase starting at start, returning the offset after it"""
+    end = query.find('"', start + 1)
+    if end == -1:
+        raise QuerySyntaxError("Unterminated quote", start)
+
+    words = tuple(query[start + 1 : end].split())
+    if not words:
+        raise QuerySyntaxError("Empty phrase", start)
+
+    position = end + 1
+    boost = 1.0
+    match = _BOOST.match(query, position)
+    if match is not None:
+        boost = _parse_boost(match.group("boost"), position)
+        position = match.end()
+    tokens.append(_Token("TERM", start, Phrase(words, boost)))
+    return position
+
+
+def _parse_boost(text: Optional[str], position: int) -> float:
+    """Parse the weight after a ^, which must be a non-negative number"""
+    if text is None:
+        return 1.0
+    try:
+        boost = float(text)
+    except ValueError:
+        raise QuerySyntaxError(f"Invalid boost {text!r}", position) from None
+    if not boost >= 0 or boost == float("inf"):
+        raise QuerySyntaxError(f"Invalid boost {text!r}", position)
+    return boost
+
+
+def _is_exclusion(node: Node) -> bool:
+    """Check whether a node only excludes documents"""
+    if isinstance(node, Not):
+        return True
+    return isinstance(node, And) and all(
+        isinstance(operand, Not) for operand in node.operands
+    )
+
+
+class _Parser:
+    """Recursive descent parser over query tokens"""
+
+    def __init__(self, tokens: List[_Token], length: int):
+        self.tokens = tokens
+        self.length = length
+        self.index = 0
+
+    def at_end(self) -> bool:
+        """Check whether every token has been consumed"""
+        return self.index >= len(self.tokens)
+
+    def peek(self) -> _Token:
+        """Get the next token without consuming it"""
+        return self.tokens[self.index]
+
+    def next(self) -> _Token:
+        """Consume and return the next token"""
+        token = self.tokens[self.index]
+        self.index += 1
+        return token
+
+    def parse_or(self) -> Node:
+        """Parse terms joined by OR, the loosest binding operator
+
+        An operand made only of exclusions is rejected, since it would
+        match every document without the excluded terms.
+        """
+        start = self.peek().position if not self.at_end() else self.length
+        starts = [start]
+        operands = [self.parse_and()]
+        while not self.at_end() and self.peek().kind == "OR":
+            operator = self.next()
+            self.expect_operand(operator)
+            starts.append(self.peek().position)
+            operands.append(self.parse_and())
+        if len(operands) == 1:
+            return operands[0]
+
+        for position, operand in zip(starts, operands):
+            if _is_exclusion(operand):
+                raise QuerySyntaxError("Exclusion cannot be an OR operand", position)
+        return Or(tuple(operands))
+
+    def parse_and(self) -> Node:
+        """Parse terms joined by AND or simply written next to each other"""
+        operands = [self.parse_unary()]
+        while not self.at_end() and self.peek().kind not in {"OR", ")"}:
+            if self.peek().kind == "AND":
+                self.expect_operand(self.next())
+            operands.append(self.parse_unary())
+        return operands[0] if len(operands) == 1 else And(tuple(operands))
+
+    def parse_unary(self) -> Node:
+        """Parse a term, group or phrase with any NOT in front of it"""
+        if self.at_end():
+            raise QuerySyntaxError("Expected a term", self.length)
+        token = self.peek()
+        if token.kind == "NOT":
+            self.expect_operand(self.next())
+            return Not(self.parse_unary())
+        return self.parse_primary()
+
+    def parse_primary(self) -> Node:
+        """Parse a term, phrase or parenthesized group"""
+        token = self.next()
+        if token.kind == "TERM":
+            assert token.value is not None
+            return token.value
+        if token.kind == "(":
+            if not self.at_end() and self.peek().kind == ")":
+                raise QuerySyntaxError("Empty parentheses", token.position)
+            node = self.parse_or()
+            if self.at_end():
+                raise QuerySyntaxError("Unclosed parenthesis", token.position)
+            self.next()
+            return node
+        if token.kind == ")":
+            raise QuerySyntaxError("Unmatched closing parenthesis", token.position)
+        raise QuerySyntaxError(f"Expected a term before {token.kind}", token.position)
+
+    def expect_operand(self, operator: _Token) -> None:
+        """Fail if an operator is not followed by something to apply it to"""
+        if self.at_end() or self.peek().kind in {"OR", "AND", ")"}:
+            raise QuerySyntaxError(
+                f"Dangling {operator.kind} operator", operator.position
+            )
@@ -0,0 +1,68 @@
+"""
+Scorers for ranking documents against query terms
+"""
+
+import math
+from dataclasses import dataclass
+from typing import Protocol
+
+
+@dataclass(frozen=True)
+class IndexStats:
+    """Statistics about a term, a document and the index used for scoring"""
+
+    total_documents: int
+    # Number of documents containing the term
+    doc_freq: int
+    # Occurrences of the term in the document
+    term_count: int
+    doc_length: int
+    average_doc_length: float
+    # Term frequency computed according to the storage's tf_mode
+    tf: float
+    # IDF of the term from the storage's idf_function
+    idf: float
+
+
+class Scorer(Protocol):
+    """Scores one query term's match in a document
+
+    A document's search score is the weighted sum of its term scores.
+    """
+
+    def score(self, doc_id: str, term: str, stats: IndexStats) -> float: ...
+
+
+class TfIdfScorer:
+    """Term frequency times IDF"""
+
+    def score(self, doc_id: str, term: str, stats: IndexStats) -> float:
+        return stats.tf * stats.idf
+
+
+class BM25Scorer:
+    """Okapi BM25 with saturating term frequency and length normalization"""
+
+    def __init__(self, k1: float = 1.2, b: float = 0.75):
+        # Controls how quickly repeated occurrences stop adding to the score
+        self.k1 = k1
+        # How strongly scores are normalized by document length, from 0 to 1
+        self.b = b
+
+    def score(self, doc_id: str, term: str, stats: IndexStats) -> float:
+        if stats.term_count <= 0:
+            return 0
+        idf = math.log(
+            1 + (stats.total_documents - stats.doc_freq + 0.5) / (stats.doc_freq + 0.5)
+        )
+        length_ratio = (
+            stats.doc_length / stats.average_doc_length
+            if stats.average_doc_length > 0
+            else 1
+        )
+        return (
+            idf
+            * stats.term_count
+            * (self.k1 + 1)
+            / (stats.term_count + self.k1 * (1 - self.b + self.b * length_ratio))
+        )
@@ -5,16 +5,94 @@ Main document storage class.
 from __future__ import annotations
 
 
+import copy
+import csv
+import functools
+import hashlib
+import heapq
+import html
 import json
 import math
+import os
 import re
+import sys
+import threading
+import time
+import unicodedata
 import uuid
-from collections import Counter
+from collections import Counter, OrderedDict, deque
+from collections.abc import (
+    Callable,
+    Iterable,
+    Iterator,
+    Mapping,
+    MutableMapping,
+    Sequence,
+)
+from collections.abc import Set as AbstractSet
+from concurrent.futures import Future, ThreadPoolExecutor
+from dataclasses import dataclass
 from pathlib import Path
-from collections.abc import MutableMapping, Optional, Sequence, Tuple
+from typing import Any, Deque, List, Literal, Optional, TextIO, Tuple
 
+from .extractors import Extractor, default_extractors, extract_text, is_binary_file
 from .index import ForwardIndex
-from .trie import Trie
+from .metrics import MetricsObserver
+from .query import And, Node, Not, Or, Phrase, Prefix, Term, parse
+from .scoring import IndexStats, Scorer, TfIdfScorer
+from .tokenizers import (
+    Tokenizer,
+    code_tokenize,
+    collapse_repeats,
+    fold_diacritics,
+    join_hyphenated,
+    normalize_width,
+)
+from .trie import RadixTrie, Trie
+
+
+# Rough per-object sizes used by estimate_memory_usage
+ESTIMATED_TRIE_NODE_BYTES = 450
+ESTIMATED_MAPPING_ENTRY_BYTES = 100
+
+
+IDFFunction = Callable[[int, int], float]
+EmptyDocumentPolicy = Literal["allow", "warn", "reject"]
+PreviewFormat = Literal["plain", "markdown", "html"]
+TFMode = Literal["linear", "log", "boolean"]
+InvertedIndexFormat = Literal["jsonl", "csv"]
+HyphenMode = Literal["split", "join", "both"]
+WordPositions = MutableMapping[str, List[int]]
+
+# Words for the default tokenizer; letters outside ASCII are admitted when
+# folding diacritics so that letters without a folded form are kept whole
+LATIN_WORD_PATTERN = re.compile(r"\b[a-zA-Z]+\b")
+LETTER_WORD_PATTERN = re.compile(r"\b[^\W\d_]+\b")
+
+# Namespace for file path components indexed alongside content words
+PATH_TERM_PREFIX = "path:"
+
+# Constructor arguments load builds from a storage file's data
+LOADED_DATA_OPTIONS = frozenset(
+    {
+        "documents",
+        "total_documents",
+        "forward_index",
+        "trie",
+        "content_hashes",
+        "metadata",
+        "document_boosts",
+    }
+)
+
+# Worker count ThreadPoolExecutor picks by default, to size read-ahead
+DEFAULT_MAX_WORKERS = min(32, (os.cpu_count() or 1) + 4)
+
+# Metadata field holding the modification time of file-sourced documents
+MTIME_FIELD = "mtime"
+
+# Written to storage files by save; files without a version are version 0
+STORAGE_FORMAT_VERSION = 1
 
 
 def generate_doc_id() -> str:
@@ -22,188 +100,2128 @@ def generate_doc_id() -> str:
     return f"doc_{uuid.uuid4()}"
 
 
+def smoothed_idf(total_documents: int, doc_freq: int) -> float:
+    """Smoothed IDF used by default: log2((N + 1) / (df + 1)) + 1"""
+    return math.log2((total_documents + 1) / (doc_freq + 1)) + 1
+
+
+def _document_length(word_counts: Mapping[str, int]) -> int:
+    """Total the word counts of a document, excluding path terms"""
+    return sum(
+        count
+        for word, count in word_counts.items()
+        if not word.startswith(PATH_TERM_PREFIX)
+    )
+
+
+def _check_consistency(
+    documents: Mapping[str, str],
+    forward_index_data: Mapping[str, Mapping],
+    total_documents: int,
+    trie_data: Optional[Mapping[str, Any]] = None,
+) -> None:
+    """Check that saved index data agrees with the saved documents
+
+    Every document must have a forward index entry and the reverse, and
+    every posting in a saved trie must match the forward index.
+
+    Raises:
+        ValueError: Describing the first inconsistency found
+    """
+    for doc_id in documents:
+        if doc_id not in forward_index_data["documents"]:
+            raise ValueError(f"Document '{doc_id}' is missing from the forward index")
+
+    doc_lengths = forward_index_data["doc_lengths"]
+    for doc_id, word_counts in forward_index_data["documents"].items():
+        if doc_id not in documents:
+            raise ValueError(f"Forward index has unknown document '{doc_id}'")
+        length = _document_length(word_counts)
+        if doc_lengths.get(doc_id) != length:
+            raise ValueError(
+                f"Length of document '{doc_id}' is {doc_lengths.get(doc_id)} "
+                f"but its word counts sum to {length}"
+            )
+
+    for doc_id in doc_lengths:
+        if doc_id not in forward_index_data["documents"]:
+            raise ValueError(f"Document lengths have unknown document '{doc_id}'")
+
+    if total_documents != len(documents):
+        raise ValueError(
+            f"Total documents is {total_documents} but there are "
+            f"{len(documents)} documents"
+        )
+
+    # Trie children are keyed by the character or edge label leading to them
+    stack = [("", trie_data)] if trie_data is not None else []
+    while stack:
+        word, node_data = stack.pop()
+        for doc_id, count in node_data.get("documents", {}).items():
+            word_counts = forward_index_data["documents"].get(doc_id, {})
+            if word_counts.get(word) != count:
+                raise ValueError(
+                    f"Trie posting of '{word}' for document '{doc_id}' does not "
+                    "match the forward index"
+                )
+        stack.extend(
+            (word + key, child) for key, child in node_data["children"].items()
+        )
+
+
+# IDs of the storages running a search in each thread, so that searches made
+# by other search methods are not reported twice
+_searching = threading.local()
+
+
+def _read_csv_rows(f: TextIO) -> Iterator[Tuple[int, List[str]]]:
+    """Yield the line number and fields of each CSV row
+
+    Rows the reader rejects are skipped with a warning.
+    """
+    rows = csv.reader(f)
+    while True:
+        try:
+            row = next(rows)
+        except StopIteration:
+            return
+        except csv.Error as e:
+            print(f"Warning: Skipping CSV line {rows.line_num}: {e}")
+            continue
+        yield rows.line_num, row
+
+
+def _observed_search(method: Callable) -> Callable:
+    """Report a search method's duration and number of results to metrics
+
+    Only the outermost search method is reported when one calls another.
+    """
+
+    @functools.wraps(method)
+    def observed(self: DocumentStorage, *args, **kwargs):
+        active = _searching.__dict__.setdefault("storage_ids", set())
+        if id(self) in active:
+            return method(self, *args, **kwargs)
+
+        active.add(id(self))
+        start = time.perf_counter()
+        try:
+            results = method(self, *args, **kwargs)
+        finally:
+            active.discard(id(self))
+        # Searches returning extra information give the results first
+        ranked = results[0] if isinstance(results, tuple) else results
+        self.metrics.observe_search(time.perf_counter() - start, len(ranked))
+        return results
+
+    return observed
+
+
+@dataclass(frozen=True)
+class StorageSnapshot:
+    """Deep copy of a DocumentStorage's documents and indexes"""
+
+    documents: MutableMapping[str, str]
+    forward_index: ForwardIndex
+    trie: Trie
+    total_documents: int
+    content_hashes: MutableMapping[str, str]
+    metadata: MutableMapping[str, MutableMapping[str, str]]
+    document_boosts: MutableMapping[str, float]
+
+
+@dataclass(frozen=True)
+class FileError:
+    """A file that could not be added to the storage"""
+
+    path: str
+    reason: str
+
+
+class IngestionCancelled(Exception):
+    """Raised when adding documents is cancelled or times out
+
+    Holds the document IDs added and the files skipped before stopping.
+    """
+
+    def __init__(self, reason: str, doc_ids: List[str], errors: List[FileError]):
+        super().__init__(reason)
+        self.doc_ids = doc_ids
+        self.errors = errors
+
+
+@dataclass(frozen=True)
+class SearchOptions:
+    """Options for search_with_options, defaulting to the behavior of search"""
+
+    # Zero or less returns every matching document
+    top_k: int = 5
+    # Number of top-ranked results to skip, for paging through results
+    offset: int = 0
+    min_score: float = 0
+    # When True, query words also match indexed words within max_edit_distance
+    # edits, with each match's weight divided by (1 + distance)
+    fuzzy: bool = False
+    max_edit_distance: int = 1
+    # When False, previews are left empty to avoid the cost of building them
+    include_previews: bool = True
+    # When True, previews hold each document's complete content however long
+    # it is; ignored when include_previews is False
+    full_content: bool = False
+    # When True, scores are rescaled so the first returned result scores 100;
+    # min_score still applies to the raw scores
+    normalize_scores: bool = False
+
+    def __post_init__(self) -> None:
+        if self.offset < 0:
+            raise ValueError(f"Offset must be non-negative, got {self.offset}")
+
+
 class DocumentStorage:
     """Searchable document storage"""
 
-    def __init__(self):
-        self.trie = Trie()
-        self._forward_index = ForwardIndex()
-        self._doc_id_to_document: MutableMapping[str, str] = {}
-        self._total_documents = 0
+    def __init__(
+        self,
+        min_token_length: int = 2,
+        max_token_length: Optional[int] = None,
+        store_contents: bool = True,
+        tokenizer: Optional[Tokenizer] = None,
+        idf_function: IDFFunction = smoothed_idf,
+        empty_documents: EmptyDocumentPolicy = "warn",
+        deduplicate_by_content: bool = False,
+        index_paths: bool = False,
+        compress_trie: bool = False,
+        fold_diacritics: bool = False,
+        collapse_repeats: bool = False,
+        normalize_width: bool = False,
+        hyphen_mode: HyphenMode = "split",
+        skip_binary_files: bool = False,
+        follow_symlinks: bool = False,
+        max_depth: Optional[int] = None,
+        cache_dir: Optional[Path] = None,
+        max_postings_per_word: Optional[int] = None,
+        store_positions: bool = False,
+        scorer: Optional[Scorer] = None,
+        tf_mode: TFMode = "linear",
+        query_cache_size: int = 0,
+        max_doc_freq_ratio: Optional[float] = None,
+        lead_boost: float = 1.0,
+        lead_length: int = 100,
+        metrics: Optional[MetricsObserver] = None,
+        code_extensions: Optional[Iterable[str]] = None,
+        preview_length: int = 200,
+        preview_context_before: int = 50,
+        preview_format: PreviewFormat = "plain",
+        documents: Optional[MutableMapping[str, str]] = None,
+        total_documents: int = 0,
+        forward_index: Optional[ForwardIndex] = None,
+        trie: Optional[Trie] = None,
+        content_hashes: Optional[MutableMapping[str, str]] = None,
+        metadata: Optional[MutableMapping[str, MutableMapping[str, str]]] = None,
+        document_boosts: Optional[MutableMapping[str, float]] = None,
+        id_generator: Callable[[], str] = generate_doc_id,
+    ):
+        # A compressed trie stores fewer nodes but gives the same results
+        if trie is None:
+            trie = RadixTrie() if compress_trie else Trie()
+        self.trie = trie
+        self.min_token_length = min_token_length
+        # Longer tokens are dropped rather than truncated; None means no limit
+        self.max_token_length = max_token_length
+        # Replaces the default Latin word tokenizer for indexing and queries
+        self.tokenizer = tokenizer
+        # Called with the total document count and a word's document frequency
+        self._idf_function = idf_function
+        # Scores each query term's match in a document for search; may be
+        # replaced at any time to change ranking
+        self.scorer = scorer if scorer is not None else TfIdfScorer()
+        # How term frequency is computed for scoring: "linear" divides the
+        # count by the document length, "log" uses 1 + log(count) so repeated
+        # words stop dominating, and "boolean" counts any occurrence as 1
+        self.tf_mode = tf_mode
+        # When set, query words found in more than this fraction of documents
+        # are ignored as automatic stop words, e.g. 0.9 for 90%
+        self.max_doc_freq_ratio = max_doc_freq_ratio
+        # Multiplier for the score of words in a document's lead, its first
+        # line up to lead_length characters, since titles and opening lines
+        # tend to say what a document is about. Leads are recorded when each
+        # document is indexed, so changing lead_length affects only new ones.
+        self.lead_boost = lead_boost
+        self.lead_length = lead_length
+        # Notified of searches, additions and removals
+        self.metrics = metrics if metrics is not None else MetricsObserver()
+        # Files with these extensions are tokenized as source code, indexing
+        # identifiers like getUserName both whole and as get, user and name.
+        # Queries are then tokenized the same way. Ignored with a tokenizer.
+        self.code_extensions = {
+            f".{extension.strip().lower().lstrip('.')}"
+            for extension in code_extensions or ()
+        }
+        # When False, only the index is kept and previews and content are empty
+        self.store_contents = store_contents
+        # How to treat documents with no indexable words
+        self.empty_documents = empty_documents
+        # When True, adding content identical to an existing document returns
+        # the existing document's ID instead
+        self.deduplicate_by_content = deduplicate_by_content
+        # When set, each word only tracks this many documents in the trie,
+        # keeping those where it occurs most often. Dropped documents are no
+        # longer found by searches for the word and its IDF counts at most
+        # this many documents, trading recall for memory.
+        if max_postings_per_word is not None and max_postings_per_word < 1:
+            raise ValueError(
+                f"max_postings_per_word must be at least 1, got {max_postings_per_word}"
+            )
+        self.max_postings_per_word = max_postings_per_word
+        # When True, files added from paths are also searchable by their path
+        # components using "path:<component>" query terms
+        self.index_paths = index_paths
+        # When True, files read as plain text are rejected if they look binary
+        self.skip_binary_files = skip_binary_files
+        # When True, symbolic links to directories are followed when adding
+        # directories; each directory is still only walked once
+        self.follow_symlinks = follow_symlinks
+        # How many levels of subdirectories to descend into when adding
+        # directories recursively; None for no limit
+        self.max_depth = max_depth
+        # Directory where text from extractors other than plain text reading
+        # is cached by file path and modification time; None disables caching
+        self.cache_dir = Path(cache_dir) if cache_dir is not None else None
+        # Called for the ID of documents added without one
+        self.id_generator = id_generator
+        # When True, accents are removed before tokenizing so that "café" and
+        # "cafe" are the same word
+        self.fold_diacritics = fold_diacritics
+        # When True, elongated words like "coooool" are indexed and searched
+        # as "cool"
+        self.collapse_repeats = collapse_repeats
+        # When True, text is NFKC normalized before tokenizing so that
+        # full-width letters like "ｐｙｔｈｏｎ" and ligatures like "ﬁ" match
+        # their plain forms
+        self.normalize_width = normalize_width
+        # How hyphenated words like "co-operate" are tokenized: "split" into
+        # their parts, "join" into "cooperate", or "both" the joined word and
+        # its parts
+        self.hyphen_mode = hyphen_mode
+        # Maximum preview length in characters, excluding ellipses, and how
+        # much of it comes before the first match
+        self.preview_length = preview_length
+        self.preview_context_before = preview_context_before
+        # How previews highlight query words: "markdown" wraps them in ** and
+        # "html" wraps them in <mark> tags and escapes the rest of the text
+        self.preview_format = preview_format
+        self._forward_index = (
+            forward_index
+            if forward_index is not None
+            else ForwardIndex(store_positions=store_positions)
+        )
+        self._doc_id_to_document: MutableMapping[str, str] = (
+            documents if documents is not None else {}
+        )
+        self._total_documents = total_documents
+        self._content_hash_to_doc_id: MutableMapping[str, str] = (
+            content_hashes if content_hashes is not None else {}
+        )
+        # Reverse of _content_hash_to_doc_id, so removals find their hash
+        self._doc_id_to_content_hash: MutableMapping[str, str] = {
+            doc_id: content_hash
+            for content_hash, doc_id in self._content_hash_to_doc_id.items()
+        }
+        self._doc_id_to_metadata: MutableMapping[str, MutableMapping[str, str]] = (
+            metadata if metadata is not None else {}
+        )
+        # Score multipliers for documents, which default to 1.0 when absent
+        self._doc_id_to_boost: MutableMapping[str, float] = (
+            document_boosts if document_boosts is not None else {}
+        )
+        # Caches for scoring, cleared whenever documents change. Norms are
+        # also cleared when the settings they were computed with change.
+        self._doc_id_to_norm: MutableMapping[str, float] = {}
+        self._norm_settings = self._get_norm_settings()
+        self._word_to_idf: MutableMapping[str, float] = {}
+        # Most recently used search results by query, top_k and the settings
+        # they were scored with; 0 disables caching. Cleared whenever
+        # documents or boosts change.
+        self.query_cache_size = query_cache_size
+        self._query_to_results: OrderedDict[
+            Tuple[str, int, Tuple], List[Tuple[str, float, str]]
+        ] = OrderedDict()
+        self._extension_to_extractor = default_extractors()
+
+    def add_document_from_path(
+        self,
+        file_path: str,
+        max_workers: Optional[int] = None,
+        extensions: Optional[Iterable[str]] = None,
+        recursive: bool = True,
+    ) -> Sequence[str]:
+        """Add a document from a file path or all files in a directory
+
+        Args:
+            file_path: Path to a file or directory
+            max_workers: Number of threads reading and tokenizing files when
+                adding a directory (defaults to the executor's default).
+                Threads overlap file reads and extraction, but tokenization
+                holds the GIL, so plain text ingestion does not speed up
+            extensions: File extensions to add from a directory (defaults to
+                every extension with a registered extractor)
+            recursive: Whether to add files in subdirectories
+
+        Returns:
+            List of document IDs that were added, which are the resolved
+            file paths
+        """
+        added_docs, errors = self.add_document_from_path_with_errors(
+            file_path, max_workers, extensions, recursive
+        )
+        for error in errors:
+            print(f"Warning: Could not add {error.path}: {error.reason}")
+        return added_docs
+
+    def add_document_from_path_with_errors(
+        self,
+        file_path: str,
+        max_workers: Optional[int] = None,
+        extensions: Optional[Iterable[str]] = None,
+        recursive: bool = True,
+        on_progress: Optional[Callable[[int, int], None]] = None,
+        cancel: Optional[threading.Event] = None,
+        timeout: Optional[float] = None,
+    ) -> Tuple[List[str], List[FileError]]:
+        """Add documents like add_document_from_path, reporting failures
+
+        Files in a directory that cannot be added are skipped and returned
+        instead of printed. A single file that cannot be added still raises.
+
+        Args:
+            on_progress: Called with the number of files processed and the
+                total after each file
+            cancel: Event that stops ingestion before the next file when set
+            timeout: Seconds after which ingestion stops before the next file
+
+        Returns:
+            Tuple of the document IDs that were added and the skipped files
+
+        Raises:
+            IngestionCancelled: If cancel was set or the timeout passed. The
+                documents added before stopping remain in the storage.
+        """
+        # Resolve so a file gets the same document ID however it is reached
+        path = Path(file_path).resolve()
+        if not path.exists():
+            raise FileNotFoundError(f"Path not found: {file_path}")
+
+        deadline = None if timeout is None else time.monotonic() + timeout
+
+        def stop_reason() -> Optional[str]:
+            if cancel is not None and cancel.is_set():
+                return "Ingestion cancelled"
+            if deadline is not None and time.monotonic() >= deadline:
+                return f"Ingestion timed out after {timeout} seconds"
+            return None
+
+        if path.is_file():
+            reason = stop_reason()
+            if reason is not None:
+                raise IngestionCancelled(reason, [], [])
+            doc_id = self._add_single_file(path)
+            if on_progress is not None:
+                on_progress(1, 1)
+            return [doc_id], []
+        elif path.is_dir():
+            return self._add_directory(
+                path, max_workers, extensions, recursive, on_progress, stop_reason
+            )
+        else:
+            raise ValueError(f"Path is neither a file nor directory: {file_path}")
+
+    def register_extractor(self, extension: str, extractor: Extractor) -> None:
+        """Register a function converting files with an extension into text
+
+        Args:
+            extension: File extension including the dot, e.g. ".rtf"
+            extractor: Callable taking the file path and returning its text
+        """
+        self._extension_to_extractor[extension.lower()] = extractor
+
+    def extract_content(self, file_path: Path) -> str:
+        """Extract the text of a file using the extractor for its extension
+
+        Files with no registered extractor are read as plain text.
+
+        Raises:
+            ValueError: If skip_binary_files is set and a file to be read as
+                plain text appears to be binary
+        """
+        extractor = self._extension_to_extractor.get(
+            file_path.suffix.lower(), extract_text
+        )
+        if (
+            self.skip_binary_files
+            and extractor is extract_text
+            and is_binary_file(file_path)
+        ):
+            raise ValueError(f"{file_path} appears to be a binary file")
+        if self.cache_dir is None or extractor is extract_text:
+            return extractor(file_path)
+
+        cache_path = self._get_cache_path(file_path)
+        if cache_path.exists():
+            return cache_path.read_text(encoding="utf-8")
+
+        content = extractor(file_path)
+        try:
+            cache_path.parent.mkdir(parents=True, exist_ok=True)
+            cache_path.write_text(content, encoding="utf-8")
+        except OSError as e:
+            print(f"Warning: Could not cache text of {file_path}: {e}")
+        return content
+
+    def _get_cache_path(self, file_path: Path) -> Path:
+        """Get where the extracted text of a file's current version is cached"""
+        assert self.cache_dir is not None
+        mtime = self._file_metadata(file_path)[MTIME_FIELD]
+        key = hashlib.sha256(f"{file_path.resolve()}:{mtime}".encode("utf-8"))
+        return self.cache_dir / f"{key.hexdigest()}.txt"
+
+    def _add_single_file(self, file_path: Path) -> str:
+        """Add a single file to the storage"""
+        content, word_counts, positions = self._read_and_tokenize(file_path)
+        return self._index_document(
+            str(file_path),
+            content,
+            word_counts,
+            self._file_metadata(file_path),
+            positions=positions,
+        )
+
+    def _file_metadata(self, file_path: Path) -> MutableMapping[str, str]:
+        """Get the metadata recorded for a document added from a file"""
+        return {MTIME_FIELD: str(file_path.stat().st_mtime_ns)}
+
+    def _list_directory_files(
+        self,
+        dir_path: Path,
+        extensions: Optional[Iterable[str]] = None,
+        recursive: bool = True,
+    ) -> List[Path]:
+        """List the files in a directory with extensions that can be added
+
+        Symbolic links to directories are only descended into when
+        follow_symlinks is set, and never twice into the same directory, so
+        link cycles terminate. Subdirectories deeper than max_depth below
+        dir_path are skipped.
+        """
+        if extensions is None:
+            allowed_extensions = set(self._extension_to_extractor)
+        else:
+            allowed_extensions = {
+                f".{extension.strip().lower().lstrip('.')}" for extension in extensions
+            }
+
+        max_depth = self.max_depth if recursive else 0
+        visited = {dir_path.resolve()}
+        file_paths = []
+        for root, dir_names, file_names in os.walk(
+            dir_path, followlinks=self.follow_symlinks
+        ):
+            root_path = Path(root)
+            depth = len(root_path.relative_to(dir_path).parts)
+            if max_depth is not None and depth >= max_depth:
+                dir_names.clear()
+            for dir_name in sorted(dir_names):
+                sub_path = root_path / dir_name
+                if sub_path.is_symlink() and not self.follow_symlinks:
+                    dir_names.remove(dir_name)
+                    continue
+                # Prune links into directories that were already walked
+                real_path = sub_path.resolve()
+                if real_path in visited:
+                    dir_names.remove(dir_name)
+                else:
+                    visited.add(real_path)
+            dir_names.sort()
+
+            file_paths.extend(
+                root_path / file_name
+                for file_name in sorted(file_names)
+                if (root_path / file_name).is_file()
+                and Path(file_name).suffix.lower() in allowed_extensions
+            )
+        return file_paths
+
+    def reindex_directory(
+        self,
+        dir_path: str,
+        extensions: Optional[Iterable[str]] = None,
+        recursive: bool = True,
+    ) -> Tuple[int, int, int, int]:
+        """Bring the documents for a directory's files up to date
+
+        New files are added and files whose modification time differs from
+        the one recorded when they were indexed are reindexed, keeping their
+        boost. Unchanged files are skipped without being read. Files that
+        cannot be read, or whose new content would be rejected or duplicates
+        another document, are reported and left as they were. Documents added
+        from files in the directory that no longer exist are removed; only
+        the top level is checked when recursive is False. Document IDs are
+        the resolved file paths, as for add_document_from_path.
+
+        Returns:
+            Tuple of the numbers of files added, updated and skipped, and of
+            documents removed
+        """
+        added = updated = skipped = removed = 0
+        root_path = Path(dir_path).resolve()
+
+        for file_path in self._list_directory_files(root_path, extensions, recursive):
+            doc_id = str(file_path)
+            stored_mtime = self.get_metadata(doc_id).get(MTIME_FIELD)
+            try:
+                metadata = self._file_metadata(file_path)
+                if doc_id not in self._doc_id_to_document:
+                    # A duplicate of another document is not added under its path
+                    if self._add_single_file(file_path) == doc_id:
+                        added += 1
+                    else:
+                        skipped += 1
+                elif stored_mtime == metadata[MTIME_FIELD]:
+                    skipped += 1
+                else:
+                    content, word_counts, positions = self._read_and_tokenize(file_path)
+                    self._replace_document(
+                        doc_id, content, word_counts, metadata, positions
+                    )
+                    updated += 1
+            except Exception as e:
+                print(f"Warning: Could not reindex {file_path}: {e}")
+
+        for doc_id, metadata in list(self._doc_id_to_metadata.items()):
+            file_path = Path(doc_id)
+            if MTIME_FIELD not in metadata or file_path.exists():
+                continue
+            if file_path.parent == root_path or (
+                recursive and root_path in file_path.parents
+            ):
+                self.remove_document(doc_id)
+                removed += 1
+
+        return added, updated, skipped, removed
+
+    def _replace_document(
+        self,
+        doc_id: str,
+        content: str,
+        word_counts: Counter[str],
+        metadata: Mapping[str, str],
+        positions: Optional[WordPositions],
+    ) -> None:
+        """Reindex an existing document with new content, keeping its boost
+
+        The new content is checked before the old document is removed, and
+        the old document is put back if indexing the new one still fails.
+
+        Raises:
+            ValueError: If the new content has no indexable words while empty
+                documents are rejected, or duplicates another document
+        """
+        if not word_counts and self.empty_documents == "reject":
+            raise ValueError(f"Document {doc_id} has no indexable words")
+        if self.deduplicate_by_content:
+            duplicate_id = self._content_hash_to_doc_id.get(
+                self._hash_content(content)
+            )
+            if duplicate_id is not None and duplicate_id != doc_id:
+                raise ValueError(f"Content duplicates document {duplicate_id}")
+
+        boost = self.get_document_boost(doc_id)
+        old_content = self._doc_id_to_document[doc_id]
+        old_word_counts = Counter(self._forward_index.get_document_words(doc_id))
+        old_positions = self._forward_index._doc_id_to_positions.get(doc_id)
+        old_lead_words = self._forward_index.get_lead_words(doc_id)
+        old_metadata = self.get_metadata(doc_id)
+        old_content_hash = self._doc_id_to_content_hash.get(doc_id)
+
+        self.remove_document(doc_id)
+        try:
+            self._index_document(
+                doc_id, content, word_counts, metadata, positions=positions
+            )
+        except Exception:
+            self._index_document(
+                doc_id,
+                old_content,
+                old_word_counts,
+                old_metadata,
+                content_hash=old_content_hash,
+                positions=old_positions,
+                lead_words=old_lead_words,
+                deduplicate=old_content_hash is not None,
+            )
+            raise
+        finally:
+            if boost != 1.0:
+                self.set_document_boost(doc_id, boost)
+
+    def _add_directory(
+        self,
+        dir_path: Path,
+        max_workers: Optional[int] = None,
+        extensions: Optional[Iterable[str]] = None,
+        recursive: bool = True,
+        on_progress: Optional[Callable[[int, int], None]] = None,
+        stop_reason: Optional[Callable[[], Optional[str]]] = None,
+    ) -> Tuple[List[str], List[FileError]]:
+        """Add all files with matching extensions in a directory to the storage
+
+        Files are read and tokenized in a thread pool; index updates happen
+        on the calling thread. At most twice as many files as there are
+        workers are read ahead of indexing, so memory use does not grow with
+        the size of the directory. Files that fail are skipped and returned.
+        Before each file, stop_reason is checked and a non-None result raises
+        IngestionCancelled.
+        """
+        added_docs = []
+        errors = []
+
+        file_paths = self._list_directory_files(dir_path, extensions, recursive)
+        window = 2 * (max_workers or DEFAULT_MAX_WORKERS)
+
+        with ThreadPoolExecutor(max_workers=max_workers) as executor:
+            in_flight: Deque[Tuple[Path, Future]] = deque()
+            submitted = 0
+            for done in range(1, len(file_paths) + 1):
+                while submitted < len(file_paths) and len(in_flight) < window:
+                    file_path = file_paths[submitted]
+                    in_flight.append(
+                        (file_path, executor.submit(self._read_and_tokenize, file_path))
+                    )
+                    submitted += 1
+
+                reason = stop_reason() if stop_reason is not None else None
+                if reason is not None:
+                    for _, pending in in_flight:
+                        pending.cancel()
+                    raise IngestionCancelled(reason, added_docs, errors)
+
+                file_path, future = in_flight.popleft()
+                try:
+                    content, word_counts, positions = future.result()
+                    doc_id = self._index_document(
+                        str(file_path),
+                        content,
+                        word_counts,
+                        self._file_metadata(file_path),
+                        positions=positions,
+                    )
+                    added_docs.append(doc_id)
+                except Exception as e:
+                    errors.append(FileError(str(file_path), str(e)))
+
+                if on_progress is not None:
+                    on_progress(done, len(file_paths))
+
+        return added_docs, errors
+
+    def _read_and_tokenize(
+        self, file_path: Path
+    ) -> Tuple[str, Counter[str], Optional[WordPositions]]:
+        """Extract the content of a file and count its words and path terms"""
+        content = self.extract_content(file_path)
+        word_counts, positions = self._count_words(
+            content, code=file_path.suffix.lower() in self.code_extensions
+        )
+        if self.index_paths:
+            word_counts.update(
+                f"{PATH_TERM_PREFIX}{component.lower()}"
+                for component in {*file_path.parts, file_path.stem}
+                if component != file_path.anchor
+            )
+        return content, word_counts, positions
+
+    def _count_words(
+        self, text: str, offset: int = 0, code: bool = False
+    ) -> Tuple[Counter[str], Optional[WordPositions]]:
+        """Count the words in text, with their token offsets if positions are stored
+
+        Offsets start from offset, for text continuing an earlier part of a
+        document. When code is True the text is tokenized as source code.
+        """
+        if not self._forward_index.store_positions:
+            return Counter(self._tokenize(text, code)), None
+
+        positions: WordPositions = {}
+        for position, word in enumerate(self._tokenize(text, code), offset):
+            positions.setdefault(word, []).append(position)
+        word_counts = Counter(
+            {word: len(offsets) for word, offsets in positions.items()}
+        )
+        return word_counts, positions
+
+    def add_document(
+        self,
+        content: str,
+        doc_id: Optional[str] = None,
+        metadata: Optional[Mapping[str, str]] = None,
+    ) -> str:
+        """Add a document with given content and optional metadata fields"""
+        doc_id = self.id_generator() if doc_id is None else doc_id
+
+        word_counts, positions = self._count_words(content)
+        return self._index_document(
+            doc_id, content, word_counts, metadata, positions=positions
+        )
+
+    def add_document_with_explicit_id(
+        self,
+        content: str,
+        doc_id: str,
+        metadata: Optional[Mapping[str, str]] = None,
+    ) -> str:
+        """Add a document under exactly the given ID, which is never generated
+
+        Any string is used as is, including an empty one, as long as it has
+        no control characters or unpaired surrogates, which would corrupt
+        storage files and line-based output.
+
+        Raises:
+            ValueError: If the ID is invalid, already exists, or the content
+                duplicates an existing document when deduplicating by content
+        """
+        invalid = [
+            char for char in doc_id if unicodedata.category(char) in ("Cc", "Cs")
+        ]
+        if invalid:
+            raise ValueError(
+                f"Document ID {doc_id!r} contains invalid characters: {invalid!r}"
+            )
+
+        added_id = self.add_document(content, doc_id, metadata)
+        if added_id != doc_id:
+            raise ValueError(
+                f"Document {doc_id!r} duplicates existing document {added_id!r}"
+            )
+        return added_id
+
+    def add_document_from_stream(
+        self,
+        file: TextIO,
+        doc_id: Optional[str] = None,
+        max_stored_length: int = 10000,
+        chunk_size: int = 65536,
+    ) -> str:
+        """Add a document by reading and tokenizing a text stream in chunks
+
+        Only the first max_stored_length characters are kept as the
+        document's content, so previews, proximity and regex searches only
+        see that prefix, while every word in the stream is indexed.
+        """
+        doc_id = self.id_generator() if doc_id is None else doc_id
+
+        word_counts: Counter[str] = Counter()
+        positions: Optional[WordPositions] = None
+        stored_parts: List[str] = []
+        stored_length = 0
+        hasher = hashlib.sha256()
+        hashed_words = False
+        pending = ""
+        # Kept separately since max_stored_length may cut the lead short
+        lead = ""
+
+        while True:
+            chunk = file.read(chunk_size)
+            text = pending + chunk
+            if chunk:
+                # Hold back a possibly partial word until the next chunk
+                pending = re.search(r"\S*\Z", text).group()
+                text = text[: len(text) - len(pending)]
+            else:
+                pending = ""
+
+            chunk_counts, chunk_positions = self._count_words(
+                text, offset=sum(word_counts.values())
+            )
+            word_counts.update(chunk_counts)
+            if chunk_positions is not None:
+                positions = positions if positions is not None else {}
+                for word, offsets in chunk_positions.items():
+                    positions.setdefault(word, []).extend(offsets)
+            if len(lead) < self.lead_length:
+                lead += text[: self.lead_length - len(lead)]
+            if stored_length < max_stored_length:
+                stored_parts.append(text[: max_stored_length - stored_length])
+                stored_length += len(stored_parts[-1])
+            # Matches _hash_content since chunks are split between words
+            normalized = " ".join(text.split())
+            if normalized:
+                if hashed_words:
+                    hasher.update(b" ")
+                hasher.update(normalized.encode("utf-8"))
+                hashed_words = True
+
+            if not chunk:
+                break
+
+        return self._index_document(
+            doc_id,
+            "".join(stored_parts),
+            word_counts,
+            content_hash=hasher.hexdigest(),
+            positions=positions,
+            lead_words=self._get_lead_words(lead),
+        )
+
+    def _index_document(
+        self,
+        doc_id: str,
+        content: str,
+        word_counts: Counter[str],
+        metadata: Optional[Mapping[str, str]] = None,
+        content_hash: Optional[str] = None,
+        positions: Optional[WordPositions] = None,
+        lead_words: Optional[Iterable[str]] = None,
+        deduplicate: bool = True,
+    ) -> str:
+        """Index a document's pre-tokenized word counts
+
+        content_hash and lead_words are computed from content when not given.
+        With deduplicate False the document is never treated as a duplicate.
+        """
+        if not (self.deduplicate_by_content and deduplicate):
+            content_hash = None
+        elif content_hash is None:
+            content_hash = self._hash_content(content)
+        if content_hash is not None:
+            if content_hash in self._content_hash_to_doc_id:
+                return self._content_hash_to_doc_id[content_hash]
+
+        if doc_id in self._doc_id_to_document:
+            raise ValueError(f"Document with ID {doc_id} already exists")
+
+        if not word_counts:
+            if self.empty_documents == "reject":
+                raise ValueError(f"Document {doc_id} has no indexable words")
+            if self.empty_documents == "warn":
+                print(f"Warning: Document {doc_id} has no indexable words")
+
+        self._doc_id_to_document[doc_id] = content if self.store_contents else ""
+        if content_hash is not None:
+            self._record_content_hash(content_hash, doc_id)
+        if metadata:
+            self._doc_id_to_metadata[doc_id] = dict(metadata)
+
+        # Path terms are excluded from the length so content TF is unaffected
+        self._forward_index.add_document(
+            doc_id,
+            word_counts,
+            doc_length=_document_length(word_counts),
+            positions=positions,
+            lead_words=(
+                lead_words if lead_words is not None else self._get_lead_words(content)
+            ),
+        )
+
+        self._add_postings(doc_id, word_counts)
+
+        self._total_documents += 1
+        self._invalidate_score_caches()
+        self.metrics.observe_add(doc_id)
+        return doc_id
+
+    def _record_content_hash(self, content_hash: str, doc_id: str) -> None:
+        """Record the hash of a document's content for deduplication"""
+        self._content_hash_to_doc_id[content_hash] = doc_id
+        self._doc_id_to_content_hash[doc_id] = content_hash
+
+    def _add_postings(self, doc_id: str, word_counts: Mapping[str, int]) -> None:
+        """Record a document's word counts in the trie, applying any cap"""
+        for word, count in word_counts.items():
+            if not self.trie.search(word):
+                self.trie.insert(word)
+            self.trie.add_document_to_word(word, doc_id, count)
+            if (
+                self.max_postings_per_word is not None
+                and self.trie.get_document_frequency(word) > self.max_postings_per_word
+            ):
+                self._drop_lowest_posting(word, doc_id)
+
+    def _drop_lowest_posting(self, word: str, new_doc_id: str) -> None:
+        """Stop tracking the document with the fewest occurrences of a word
+
+        Ties drop the newly added document so existing postings are stable.
+        """
+        postings = self.trie.get_documents_for_word(word)
+        doc_id = min(
+            postings, key=lambda doc_id: (postings[doc_id], doc_id != new_doc_id)
+        )
+        self.trie.remove_document_from_word(word, doc_id)
+
+    def merge(self, other: DocumentStorage) -> None:
+        """Merge all documents from another storage into this one
+
+        With deduplicate_by_content, documents whose content is already
+        stored here are skipped without an error. Documents whose content
+        other did not keep are only deduplicated if other recorded their
+        content hash.
+
+        Raises:
+            ValueError: If the storages tokenize text differently, any
+                document ID exists in both storages, or a document has no
+                indexable words and empty_documents is "reject". This storage
+                is left unchanged in that case.
+        """
+        settings = self._get_tokenizer_settings()
+        other_settings = other._get_tokenizer_settings()
+        differing = [
+            name for name in settings if settings[name] != other_settings[name]
+        ]
+        if differing:
+            raise ValueError(
+                f"Cannot merge a storage with different {', '.join(differing)}"
+            )
+
+        collisions = self._doc_id_to_document.keys() & other._doc_id_to_document.keys()
+        if collisions:
+            raise ValueError(
+                f"Documents with IDs {', '.join(sorted(collisions))} already exist"
+            )
+
+        # Checked up front so that no documents are added before the error
+        if self.empty_documents == "reject":
+            for doc_id, content in other._doc_id_to_document.items():
+                if other._forward_index.get_document_words(doc_id):
+                    continue
+                content_hash = other._get_merge_content_hash(doc_id)
+                if (
+                    self.deduplicate_by_content
+                    and content_hash in self._content_hash_to_doc_id
+                ):
+                    continue
+                raise ValueError(f"Document {doc_id} has no indexable words")
+
+        for doc_id, content in other._doc_id_to_document.items():
+            word_counts = Counter(other._forward_index.get_document_words(doc_id))
+            content_hash = other._get_merge_content_hash(doc_id)
+            indexed_doc_id = self._index_document(
+                doc_id,
+                content,
+                word_counts,
+                other._doc_id_to_metadata.get(doc_id),
+                content_hash=content_hash,
+                positions=other._forward_index.get_document_positions(doc_id),
+                lead_words=other._forward_index.get_lead_words(doc_id),
+                deduplicate=content_hash is not None,
+            )
+            if indexed_doc_id == doc_id and doc_id in other._doc_id_to_boost:
+                self._doc_id_to_boost[doc_id] = other._doc_id_to_boost[doc_id]
+
+    def _get_merge_content_hash(self, doc_id: str) -> Optional[str]:
+        """Get the content hash of a document being merged into another storage
+
+        Returns None when the hash was not recorded and the content was not
+        kept, since the empty stored content would match every such document.
+        """
+        if doc_id in self._doc_id_to_content_hash:
+            return self._doc_id_to_content_hash[doc_id]
+        content = self._doc_id_to_document[doc_id]
+        kept_content = self.store_contents and (
+            content or not self._forward_index.get_document_words(doc_id)
+        )
+        return self._hash_content(content) if kept_content else None
+
+    def remove_document(self, doc_id: str) -> bool:
+        """Remove a document from storage"""
+        if doc_id not in self._doc_id_to_document:
+            return False
+
+        word_counts = self._forward_index.get_document_words(doc_id)
+
+        self._forward_index.remove_document(doc_id)
+
+        for word in word_counts:
+            # Only words no other document contains are pruned
+            if self.trie.remove_document_from_word(word, doc_id):
+                self.trie.remove(word)
+
+        del self._doc_id_to_document[doc_id]
+        self._doc_id_to_metadata.pop(doc_id, None)
+        self._doc_id_to_boost.pop(doc_id, None)
+        content_hash = self._doc_id_to_content_hash.pop(doc_id, None)
+        if content_hash is not None:
+            del self._content_hash_to_doc_id[content_hash]
+
+        self._total_documents = max(0, self._total_documents - 1)
+        self._invalidate_score_caches()
+        self.metrics.observe_remove(doc_id)
+        return True
+
+    def purge_term(self, word: str) -> int:
+        """Remove a word from the index of every document containing it
+
+        Document contents are left unchanged, so previews, proximity and
+        regex searches still see the word. Document lengths drop by the
+        number of occurrences removed.
+
+        Returns:
+            Number of documents the word was removed from
+        """
+        word = word.lower()
+        doc_ids = list(self.trie.get_documents_for_word(word))
+
+        for doc_id in doc_ids:
+            self._forward_index.remove_word(
+                doc_id, word, reduce_length=not word.startswith(PATH_TERM_PREFIX)
+            )
+            self.trie.remove_document_from_word(word, doc_id)
+        self.trie.remove(word)
+
+        if doc_ids:
+            self._invalidate_score_caches()
+        return len(doc_ids)
+
+    def prune_rare_terms(self, min_doc_freq: int) -> int:
+        """Purge every word found in fewer than min_doc_freq documents
+
+        Intended as a maintenance step after bulk loading; see purge_term.
+
+        Returns:
+            Number of words pruned
+        """
+        rare_words = [
+            word
+            for word, doc_freq in self.trie.get_all_words_with_frequency().items()
+            if doc_freq < min_doc_freq
+        ]
+        for word in rare_words:
+            self.purge_term(word)
+        return len(rare_words)
+
+    def rename_document(self, old_doc_id: str, new_doc_id: str) -> None:
+        """Change a document's ID without re-tokenizing its content
+
+        Raises:
+            ValueError: If old_doc_id does not exist or new_doc_id already exists
+        """
+        if old_doc_id not in self._doc_id_to_document:
+            raise ValueError(f"Document with ID {old_doc_id} does not exist")
+        if new_doc_id in self._doc_id_to_document:
+            raise ValueError(f"Document with ID {new_doc_id} already exists")
+
+        for word in self._forward_index.get_document_words(old_doc_id):
+            self.trie.rename_document_in_word(word, old_doc_id, new_doc_id)
+
+        self._forward_index.rename_document(old_doc_id, new_doc_id)
+        self._doc_id_to_document[new_doc_id] = self._doc_id_to_document.pop(old_doc_id)
+        if old_doc_id in self._doc_id_to_metadata:
+            self._doc_id_to_metadata[new_doc_id] = self._doc_id_to_metadata.pop(
+                old_doc_id
+            )
+        if old_doc_id in self._doc_id_to_boost:
+            self._doc_id_to_boost[new_doc_id] = self._doc_id_to_boost.pop(old_doc_id)
+        content_hash = self._doc_id_to_content_hash.pop(old_doc_id, None)
+        if content_hash is not None:
+            self._record_content_hash(content_hash, new_doc_id)
+        self._invalidate_score_caches()
+
+    @_observed_search
+    def search(self, query: str, top_k: int = 5) -> Sequence[Tuple[str, float, str]]:
+        """
+        Search for documents using the configured scorer, TF-IDF by default
+
+        At most top_k results are returned, or every match when top_k is
+        zero or less. Results are served from the query cache when
+        query_cache_size is set.
+
+        Returns:
+            List of tuples (doc_id, score, content_preview)
+        """
+        if self.query_cache_size <= 0:
+            return self.search_with_min_score(query, top_k, min_score=0)
+
+        key = (query, top_k, self._get_search_settings())
+        if key in self._query_to_results:
+            self._query_to_results.move_to_end(key)
+            return list(self._query_to_results[key])
+
+        results = list(self.search_with_min_score(query, top_k, min_score=0))
+        self._query_to_results[key] = results
+        if len(self._query_to_results) > self.query_cache_size:
+            self._query_to_results.popitem(last=False)
+        return list(results)
+
+    def _get_search_settings(self) -> Tuple:
+        """Get the settings that affect search results, to key cached results
+
+        Settings changed inside a scorer, rather than by assigning a new one,
+        are not detected.
+        """
+        return (
+            self.scorer,
+            self.tf_mode,
+            self.max_doc_freq_ratio,
+            self.lead_boost,
+            *self._get_tokenizer_settings().values(),
+            self.preview_length,
+            self.preview_context_before,
+            self.preview_format,
+        )
+
+    def _get_tokenizer_settings(self) -> Mapping[str, object]:
+        """Get the settings that decide which words text is indexed under"""
+        return {
+            "tokenizer": self.tokenizer,
+            "code_extensions": tuple(sorted(self.code_extensions)),
+            "min_token_length": self.min_token_length,
+            "max_token_length": self.max_token_length,
+            "fold_diacritics": self.fold_diacritics,
+            "collapse_repeats": self.collapse_repeats,
+            "normalize_width": self.normalize_width,
+            "hyphen_mode": self.hyphen_mode,
+        }
+
+    @_observed_search
+    def search_with_min_score(
+        self, query: str, top_k: int = 5, min_score: float = 0
+    ) -> Sequence[Tuple[str, float, str]]:
+        """
+        Search for documents using TF-IDF scoring, dropping any document
+        scoring below min_score before the top-k limit is applied
+
+        Query terms may be boosted with a "term^weight" suffix, which
+        multiplies the term's score by the weight.
+
+        Returns:
+            List of tuples (doc_id, score, content_preview)
+        """
+        results, _ = self.search_with_options(
+            query, SearchOptions(top_k=top_k, min_score=min_score)
+        )
+        return results
+
+    @_observed_search
+    def search_with_options(
+        self, query: str, options: Optional[SearchOptions] = None
+    ) -> Tuple[List[Tuple[str, float, str]], int]:
+        """
+        Search for documents using TF-IDF scoring controlled by options
+
+        Returns:
+            Tuple of the selected results, as tuples (doc_id, score,
+            content_preview), and the total number of matching documents
+            before offset and top_k are applied
+        """
+        options = options if options is not None else SearchOptions()
+
+        word_weights = self._parse_weighted_query(query)
+        if options.fuzzy:
+            word_weights = self._expand_fuzzy(word_weights, options.max_edit_distance)
+        if not word_weights:
+            return [], 0
+
+        query_words = list(word_weights)
+        doc_scores = self._score_weighted_words(word_weights)
+        self._drop_excluded(doc_scores, query)
+
+        doc_scores = {
+            doc_id: score
+            for doc_id, score in doc_scores.items()
+            if score >= options.min_score
+        }
+        results = self._build_results(
+            doc_scores,
+            options.top_k,
+            query_words,
+            offset=options.offset,
+            include_previews=options.include_previews,
+            full_content=options.full_content,
+        )
+        if options.normalize_scores:
+            results = self._normalize_scores(results)
+        return results, len(doc_scores)
+
+    @_observed_search
+    def search_ids(self, query: str, top_k: int = 5) -> List[Tuple[str, float]]:
+        """
+        Search like search but return only document IDs and scores
+
+        No previews are built, which saves scanning document contents when
+        only the ranking is needed.
+
+        Returns:
+            List of tuples (doc_id, score)
+        """
+        results, _ = self.search_with_options(
+            query, SearchOptions(top_k=top_k, include_previews=False)
+        )
+        return [(doc_id, score) for doc_id, score, _ in results]
+
+    def _normalize_scores(
+        self, results: List[Tuple[str, float, str]]
+    ) -> List[Tuple[str, float, str]]:
+        """Rescale ranked results so that the first scores 100
+
+        Results are left unchanged when the top score is zero.
+        """
+        if not results or results[0][1] <= 0:
+            return results
+
+        top_score = results[0][1]
+        return [
+            (doc_id, score / top_score * 100, preview)
+            for doc_id, score, preview in results
+        ]
+
+    @_observed_search
+    def search_with_fallback(
+        self, query: str, top_k: int = 5, max_edit_distance: int = 1
+    ) -> List[Tuple[str, float, str]]:
+        """
+        Search for documents using TF-IDF scoring, filling any shortfall
+        with fuzzy matches
+
+        When the exact search finds fewer than top_k documents, query words
+        missing from the index are replaced by indexed words within
+        max_edit_distance edits and the remaining places are filled from
+        that search. Fuzzy results always follow the exact ones, whatever
+        their scores. When top_k is zero or less every exact match is
+        returned followed by every fuzzy one.
+
+        Returns:
+            List of tuples (doc_id, score, content_preview)
+        """
+        results = list(self.search(query, top_k))
+        if top_k > 0 and len(results) >= top_k:
+            return results
+
+        word_weights = self._parse_weighted_query(query)
+        unmatched = {
+            word: weight
+            for word, weight in word_weights.items()
+            if not self.trie.search(word)
+        }
+        if not unmatched:
+            return results
+
+        fuzzy_weights = {
+            word: weight
+            for word, weight in word_weights.items()
+            if word not in unmatched
+        }
+        for word, weight in self._expand_fuzzy(unmatched, max_edit_distance).items():
+            fuzzy_weights[word] = fuzzy_weights.get(word, 0) + weight
+
+        found = {doc_id for doc_id, _, _ in results}
+        doc_scores = {
+            doc_id: score
+            for doc_id, score in self._score_weighted_words(fuzzy_weights).items()
+            if doc_id not in found
+        }
+        self._drop_excluded(doc_scores, query)
+        remaining = top_k - len(results) if top_k > 0 else 0
+        results.extend(
+            self._build_results(doc_scores, remaining, list(fuzzy_weights))
+        )
+        return self._deduplicate_results(results)
+
+    def _deduplicate_results(
+        self, results: Sequence[Tuple[str, float, str]]
+    ) -> List[Tuple[str, float, str]]:
+        """Keep only the highest-scoring result for each document
+
+        Results combined from several searches could otherwise list a document
+        twice. The kept results stay in their original order.
+        """
+        best: MutableMapping[str, int] = {}
+        for index, (doc_id, score, _) in enumerate(results):
+            if doc_id not in best or score > results[best[doc_id]][1]:
+                best[doc_id] = index
+        return [results[index] for index in sorted(best.values())]
+
+    def _expand_fuzzy(
+        self, word_weights: Mapping[str, float], max_edit_distance: int
+    ) -> MutableMapping[str, float]:
+        """Replace each query word with indexed words within max_edit_distance
+
+        Each match takes the query word's weight divided by (1 + distance).
+        """
+        expanded: MutableMapping[str, float] = {}
+        for word, weight in word_weights.items():
+            matches = self.trie.fuzzy_search(word, max_edit_distance)
+            for match, distance in matches.items():
+                expanded[match] = expanded.get(match, 0) + weight / (1 + distance)
+        return expanded
+
+    def search_iter(self, query: str) -> Iterator[Tuple[str, float, str]]:
+        """
+        Iterate over every matching document in ranked order
+
+        Scores are computed up front, but each content preview is only built
+        when its result is reached. The search is reported to metrics once
+        its scores are computed.
+
+        Yields:
+            Tuples (doc_id, score, content_preview)
+        """
+        start = time.perf_counter()
+        word_weights = self._parse_weighted_query(query)
+        query_words = list(word_weights)
+        doc_scores = self._score_weighted_words(word_weights)
+        self._drop_excluded(doc_scores, query)
+        ranked = sorted(doc_scores.items(), key=lambda x: x[1], reverse=True)
+        self.metrics.observe_search(time.perf_counter() - start, len(ranked))
+
+        for doc_id, score in ranked:
+            content = self._doc_id_to_document.get(doc_id, "")
+            yield doc_id, score, self._get_content_preview(content, query_words)
+
+    @_observed_search
+    def search_group_by(
+        self, query: str, field: str, top_k: int = 5
+    ) -> Sequence[Tuple[str, float, str]]:
+        """
+        Search for documents using TF-IDF scoring, keeping only the
+        highest-scoring document for each distinct value of a metadata field
+
+        Documents without the field each form their own group. The top-k
+        limit applies to groups rather than to individual documents.
+
+        Returns:
+            List of tuples (doc_id, score, content_preview)
+        """
+        word_weights = self._parse_weighted_query(query)
+        if not word_weights:
+            return []
+
+        doc_scores = self._score_weighted_words(word_weights)
+        self._drop_excluded(doc_scores, query)
+
+        group_to_best: MutableMapping[Tuple[bool, str], Tuple[str, float]] = {}
+        for doc_id, score in doc_scores.items():
+            value = self._doc_id_to_metadata.get(doc_id, {}).get(field)
+            group = (True, value) if value is not None else (False, doc_id)
+            best = group_to_best.get(group)
+            if best is None or score > best[1]:
+                group_to_best[group] = (doc_id, score)
+
+        return self._build_results(
+            dict(group_to_best.values()), top_k, list(word_weights)
+        )
+
+    @_observed_search
+    def search_where(
+        self, query: str, top_k: int, predicate: Callable[[str, str], bool]
+    ) -> Sequence[Tuple[str, float, str]]:
+        """
+        Search for documents using TF-IDF scoring, keeping only documents
+        for which predicate(doc_id, content) is true
+
+        Documents are filtered before top_k is applied, so the results are
+        filled from the documents that pass.
+
+        Returns:
+            List of tuples (doc_id, score, content_preview)
+        """
+        word_weights = self._parse_weighted_query(query)
+        if not word_weights:
+            return []
+
+        doc_scores = self._score_weighted_words(word_weights)
+        self._drop_excluded(doc_scores, query)
+
+        doc_scores = {
+            doc_id: score
+            for doc_id, score in doc_scores.items()
+            if predicate(doc_id, self._doc_id_to_document.get(doc_id, ""))
+        }
+        return self._build_results(doc_scores, top_k, list(word_weights))
+
+    @_observed_search
+    def search_with_facets(
+        self, query: str, top_k: int = 5, facet_fields: Sequence[str] = ()
+    ) -> Tuple[
+        Sequence[Tuple[str, float, str]], MutableMapping[str, MutableMapping[str, int]]
+    ]:
+        """
+        Search for documents using TF-IDF scoring and count the matching
+        documents for each value of the given metadata fields
+
+        Counts cover every matching document, not just the top-k results.
+        Documents without a field are not counted for it.
+
+        Returns:
+            Tuple of the results, as tuples (doc_id, score, content_preview),
+            and a mapping from each facet field to its value counts
+        """
+        facets: MutableMapping[str, MutableMapping[str, int]] = {
+            field: {} for field in facet_fields
+        }
+        word_weights = self._parse_weighted_query(query)
+        if not word_weights:
+            return [], facets
+
+        doc_scores = self._score_weighted_words(word_weights)
+        self._drop_excluded(doc_scores, query)
+
+        for doc_id in doc_scores:
+            metadata = self._doc_id_to_metadata.get(doc_id, {})
+            for field, counts in facets.items():
+                value = metadata.get(field)
+                if value is not None:
+                    counts[value] = counts.get(value, 0) + 1
+
+        return self._build_results(doc_scores, top_k, list(word_weights)), facets
+
+    def related_terms(self, word: str, top_n: int = 10) -> List[str]:
+        """Get the words that co-occur with word in the most documents
+
+        Ties are broken alphabetically, and word itself and path terms are
+        never returned.
+        """
+        word = word.lower()
+        co_occurrences: Counter[str] = Counter()
+        for doc_id in self.trie.get_documents_for_word(word):
+            co_occurrences.update(
+                other
+                for other in self._forward_index.get_document_words(doc_id)
+                if other != word and not other.startswith(PATH_TERM_PREFIX)
+            )
+
+        ranked = sorted(co_occurrences.items(), key=lambda x: (-x[1], x[0]))
+        return [other for other, _ in ranked[:top_n]]
+
+    @_observed_search
+    def more_like_this(
+        self, doc_id: str, top_k: int = 5, max_terms: int = 10
+    ) -> Sequence[Tuple[str, float, str]]:
+        """
+        Find documents similar to an existing document
+
+        The document's max_terms highest TF-IDF content words are searched
+        for, and the document itself is excluded from the results.
+
+        Returns:
+            List of tuples (doc_id, score, content_preview)
+        """
+        vector = self.get_document_vector(doc_id)
+        if not vector:
+            return []
+
+        query_words = heapq.nlargest(max_terms, vector, key=lambda word: vector[word])
+        doc_scores = self._score_weighted_words(dict.fromkeys(query_words, 1.0))
+        doc_scores.pop(doc_id, None)
+
+        return self._build_results(doc_scores, top_k, query_words)
+
+    def _score_weighted_words(
+        self, word_weights: Mapping[str, float]
+    ) -> MutableMapping[str, float]:
+        """Sum the weighted term scores of each word for every document containing it"""
+        doc_scores: MutableMapping[str, float] = {}
+
+        for word, weight in word_weights.items():
+            # Get documents containing this word
+            docs_with_word = self.trie.get_documents_for_word(word)
+
+            for doc_id in docs_with_word:
+                score = self._score_term(doc_id, word)
+
+                doc_scores[doc_id] = doc_scores.get(doc_id, 0) + score * weight
+
+        self._apply_document_boosts(doc_scores)
+        return doc_scores
+
+    def set_document_boost(self, doc_id: str, boost: float) -> None:
+        """Multiply a document's search scores by boost
+
+        A boost of 0 excludes the document from search results.
 
-    def add_document_from_path(self, file_path: str) -> Sequence[str]:
-        """Add a document from a file path or all files in a directory
+        Raises:
+            ValueError: If the document does not exist or boost is negative
+                or not finite
+        """
+        if doc_id not in self._doc_id_to_document:
+            raise ValueError(f"Document with ID {doc_id} does not exist")
+        if not math.isfinite(boost) or boost < 0:
+            raise ValueError(f"Boost must be a non-negative number, got {boost}")
 
-        Args:
-            file_path: Path to a file or directory
+        if boost == 1.0:
+            self._doc_id_to_boost.pop(doc_id, None)
+        else:
+            self._doc_id_to_boost[doc_id] = boost
+        self._query_to_results.clear()
+
+    def get_document_boost(self, doc_id: str) -> float:
+        """Get a document's score multiplier"""
+        return self._doc_id_to_boost.get(doc_id, 1.0)
+
+    def _apply_document_boosts(self, doc_scores: MutableMapping[str, float]) -> None:
+        """Multiply scores by document boosts, dropping zero-boosted documents"""
+        for doc_id, boost in self._doc_id_to_boost.items():
+            if doc_id not in doc_scores:
+                continue
+            if boost == 0:
+                del doc_scores[doc_id]
+            else:
+                doc_scores[doc_id] *= boost
+
+    def explain_search(self, query: str, doc_id: str) -> Sequence[MutableMapping]:
+        """
+        Break down the score search would assign a document
 
         Returns:
-            List of document IDs that were added
+            List of dicts with the term, tf, idf and contribution for each
+            query term found in the document. Contributions come from the
+            configured scorer, include the document's boost and sum to the
+            document's search score. Empty when a boost of 0 or a "-term"
+            exclusion in the query removes the document from search results.
         """
-        path = Path(file_path)
-        if not path.exists():
-            raise FileNotFoundError(f"Path not found: {file_path}")
+        boost = self.get_document_boost(doc_id)
+        if boost == 0 or any(
+            doc_id in self.trie.get_documents_for_word(word)
+            for word in self._parse_excluded_words(query)
+        ):
+            return []
 
-        if path.is_file():
-            return [self._add_single_file(path)]
-        elif path.is_dir():
-            return self._add_directory(path)
-        else:
-            raise ValueError(f"Path is neither a file nor directory: {file_path}")
+        word_weights = self._parse_weighted_query(query)
 
-    def _add_single_file(self, file_path: Path) -> str:
-        """Add a single file to the storage"""
-        try:
-            with open(file_path, "r", encoding="utf-8") as f:
-                content = f.read()
-        except UnicodeDecodeError:
-            with open(file_path, "r", encoding="latin-1") as f:
-                content = f.read()
+        explanation = []
+        for word, weight in word_weights.items():
+            if doc_id not in self.trie.get_documents_for_word(word):
+                continue
+            tf = self._get_tf(doc_id, word)
+            idf = self.get_idf(word)
+            score = self._score_term(doc_id, word)
+            explanation.append(
+                {
+                    "term": word,
+                    "tf": tf,
+                    "idf": idf,
+                    "contribution": score * weight * boost,
+                }
+            )
 
-        return self.add_document(content, str(file_path))
+        return explanation
 
-    def _add_directory(self, dir_path: Path) -> Sequence[str]:
-        """Add all files in a directory to the storage"""
-        added_docs = []
+    def get_match_count(self, query: str, doc_id: str) -> int:
+        """Count the occurrences of the query's terms in a document"""
+        return sum(
+            self._forward_index.get_word_count(doc_id, word)
+            for word in self._parse_weighted_query(query)
+        )
 
-        text_extensions = {
-            ".txt",
-            ".md",
-            ".py",
-            ".js",
-            ".html",
-            ".css",
-            ".json",
-            ".xml",
-            ".csv",
-            ".tsv",
-            ".log",
-            ".rst",
-            ".tex",
-            ".adoc",
-            ".org",
-        }
+    @_observed_search
+    def search_cosine(
+        self, query: str, top_k: int = 5
+    ) -> Sequence[Tuple[str, float, str]]:
+        """
+        Search for documents using cosine-normalized TF-IDF scoring
 
-        for file_path in dir_path.rglob("*"):
-            if file_path.is_file() and file_path.suffix.lower() in text_extensions:
-                try:
-                    doc_id = self._add_single_file(file_path)
-                    added_docs.append(doc_id)
-                except Exception as e:
-                    print(f"Warning: Could not add {file_path}: {e}")
+        Each document's TF-IDF vector is normalized by its L2 norm and the
+        query is treated as a unit vector, so scores fall between 0 and 1.
+        Documents containing a "-term" exclusion are left out; "^weight"
+        boosts are ignored.
 
-        return added_docs
+        Returns:
+            List of tuples (doc_id, score, content_preview)
+        """
+        query_words = list(self._parse_weighted_query(query))
+        if not query_words:
+            return []
 
-    def add_document(self, content: str, doc_id: Optional[str] = None) -> str:
-        """Add a document with given content"""
-        if doc_id is not None and doc_id in self._doc_id_to_document:
-            raise ValueError(f"Document with ID {doc_id} already exists")
+        query_weight = 1 / math.sqrt(len(query_words))
+        doc_scores: MutableMapping[str, float] = {}
+
+        for word in query_words:
+            for doc_id in self.trie.get_documents_for_word(word):
+                norm = self._get_document_norm(doc_id)
+                if norm == 0:
+                    continue
+                tf_idf = self._calculate_tf_idf(doc_id, word)
+                doc_scores[doc_id] = (
+                    doc_scores.get(doc_id, 0) + tf_idf / norm * query_weight
+                )
+        self._drop_excluded(doc_scores, query)
+
+        return self._build_results(doc_scores, top_k, query_words)
 
-        doc_id = generate_doc_id() if doc_id is None else doc_id
+    @_observed_search
+    def search_by_similarity(
+        self, content: str, top_k: int = 5
+    ) -> Sequence[Tuple[str, float, str]]:
+        """
+        Find the stored documents most similar to a piece of text
 
+        The text is turned into a TF-IDF vector using this storage's IDF
+        statistics and documents are ranked by cosine similarity to it, so
+        scores fall between 0 and 1.
+
+        Returns:
+            List of tuples (doc_id, score, content_preview)
+        """
         word_counts = Counter(self._tokenize(content))
+        content_length = sum(word_counts.values())
 
-        self._doc_id_to_document[doc_id] = content
+        content_vector = {
+            word: count / content_length * self.get_idf(word)
+            for word, count in word_counts.items()
+            if self.get_idf(word) > 0
+        }
+        content_norm = math.sqrt(sum(w**2 for w in content_vector.values()))
+        if content_norm == 0:
+            return []
 
-        self._forward_index.add_document(doc_id, word_counts)
+        doc_scores: MutableMapping[str, float] = {}
+        for word, weight in content_vector.items():
+            for doc_id in self.trie.get_documents_for_word(word):
+                norm = self._get_document_norm(doc_id)
+                if norm == 0:
+                    continue
+                tf_idf = self._calculate_tf_idf(doc_id, word)
+                doc_scores[doc_id] = doc_scores.get(doc_id, 0) + (
+                    tf_idf * weight / (norm * content_norm)
+                )
 
-        for word, count in word_counts.items():
-            if not self.trie.search(word):
-                self.trie.insert(word)
-            self.trie.add_document_to_word(word, doc_id, count)
+        query_words = sorted(
+            content_vector, key=lambda word: content_vector[word], reverse=True
+        )
+        return self._build_results(doc_scores, top_k, query_words)
 
-        self._total_documents += 1
-        return doc_id
+    @_observed_search
+    def search_query(
+        self, query: str, top_k: int = 5
+    ) -> Sequence[Tuple[str, float, str]]:
+        """
+        Search with boolean query syntax, reporting malformed queries
+
+        Terms written next to each other must all match, OR matches either
+        side, NOT or a leading - excludes, parentheses group, "..." matches
+        consecutive words, a trailing * matches a prefix and ^weight boosts a
+        term. Matching documents are scored by the sum of their matched terms'
+        scores. Terms without indexable words are ignored, and a query of
+        only exclusions matches nothing. Exclusions cannot be OR operands on
+        their own, as in "python OR -java".
+
+        search keeps its own parsing rather than going through this parser:
+        it matches documents containing any query word, where adjacent terms
+        here must all match, and it accepts any text instead of raising on
+        unbalanced quotes or parentheses. Routing it through here would
+        change the results of existing queries.
 
-    def remove_document(self, doc_id: str) -> bool:
-        """Remove a document from storage"""
-        if doc_id not in self._doc_id_to_document:
-            return False
+        Returns:
+            List of tuples (doc_id, score, content_preview)
 
-        word_counts = self._forward_index.get_document_words(doc_id)
+        Raises:
+            QuerySyntaxError: If the query is empty or malformed
+        """
+        node = parse(query)
+        doc_scores = self._evaluate_query(node) or {}
+        query_words: List[str] = []
+        self._collect_query_words(node, query_words)
+        return self._build_results(doc_scores, top_k, query_words)
 
-        self._forward_index.remove_document(doc_id)
+    def _evaluate_query(self, node: Node) -> Optional[MutableMapping[str, float]]:
+        """Score the documents matching a parsed query node
 
-        for word in word_counts:
-            self.trie.remove_document_from_word(word, doc_id)
+        Returns None for nodes that place no constraint, such as terms with
+        no indexable words.
+        """
+        if isinstance(node, Term):
+            word_weights = self._parse_weighted_query(node.text)
+            if not word_weights:
+                return None
+            return self._score_all_words(
+                {word: weight * node.boost for word, weight in word_weights.items()}
+            )
 
-        del self._doc_id_to_document[doc_id]
+        if isinstance(node, Prefix):
+            return {
+                doc_id: score * node.boost
+                for doc_id, score in self._score_prefix(node.text.lower()).items()
+            }
+
+        if isinstance(node, Phrase):
+            words = list(self._tokenize(" ".join(node.words)))
+            if not words:
+                return None
+            doc_scores = self._score_all_words(dict.fromkeys(words, node.boost))
+            return {
+                doc_id: score
+                for doc_id, score in doc_scores.items()
+                if self._contains_phrase(doc_id, words)
+            }
+
+        if isinstance(node, Or):
+            matches = [self._evaluate_query(operand) for operand in node.operands]
+            if all(match is None for match in matches):
+                return None
+            doc_scores = {}
+            for match in matches:
+                for doc_id, score in (match or {}).items():
+                    doc_scores[doc_id] = doc_scores.get(doc_id, 0) + score
+            return doc_scores
+
+        if isinstance(node, And):
+            return self._evaluate_and(node)
+
+        # An exclusion on its own has nothing to narrow down
+        return {}
+
+    def _evaluate_and(self, node: And) -> Optional[MutableMapping[str, float]]:
+        """Score the documents matching every operand and no exclusion"""
+        doc_scores: Optional[MutableMapping[str, float]] = None
+        excluded = set()
+        for operand in node.operands:
+            if isinstance(operand, Not):
+                excluded.update(self._evaluate_query(operand.operand) or {})
+                continue
+
+            match = self._evaluate_query(operand)
+            if match is None:
+                continue
+            if doc_scores is None:
+                doc_scores = dict(match)
+            else:
+                doc_scores = {
+                    doc_id: doc_scores[doc_id] + score
+                    for doc_id, score in match.items()
+                    if doc_id in doc_scores
+                }
+
+        if doc_scores is None:
+            has_exclusion = any(isinstance(operand, Not) for operand in node.operands)
+            return {} if has_exclusion else None
+        return {
+            doc_id: score
+            for doc_id, score in doc_scores.items()
+            if doc_id not in excluded
+        }
 
-        self.trie.cleanup_empty_words()
+    def _score_all_words(
+        self, word_weights: Mapping[str, float]
+    ) -> MutableMapping[str, float]:
+        """Score only the documents that contain every word"""
+        doc_scores = self._score_weighted_words(word_weights)
+        for word in word_weights:
+            docs_with_word = self.trie.get_documents_for_word(word)
+            doc_scores = {
+                doc_id: score
+                for doc_id, score in doc_scores.items()
+                if doc_id in docs_with_word
+            }
+        return doc_scores
+
+    def _contains_phrase(self, doc_id: str, words: Sequence[str]) -> bool:
+        """Check whether words occur consecutively in a document"""
+        positions = self._get_document_positions(doc_id)
+        offsets = [set(positions.get(word, ())) for word in words]
+        return any(
+            all(start + i in offsets[i] for i in range(1, len(words)))
+            for start in offsets[0]
+        )
 
-        self._total_documents = max(0, self._total_documents - 1)
-        return True
+    def _get_document_positions(self, doc_id: str) -> Mapping[str, List[int]]:
+        """Get the token offsets of every word in a document
 
-    def search(self, query: str, top_k: int = 5) -> Sequence[Tuple[str, float, str]]:
+        Stored positions are used when available, otherwise the content is
+        tokenized again.
         """
-        Search for documents using TF-IDF scoring
+        positions = self._forward_index.get_document_positions(doc_id)
+        if positions is None:
+            positions = {}
+            content = self._doc_id_to_document.get(doc_id, "")
+            for position, token in enumerate(self._tokenize(content)):
+                positions.setdefault(token, []).append(position)
+        return positions
+
+    def _collect_query_words(self, node: Node, query_words: List[str]) -> None:
+        """Collect the words a query searches for, skipping exclusions"""
+        if isinstance(node, Term):
+            query_words.extend(self._parse_weighted_query(node.text))
+        elif isinstance(node, Prefix):
+            query_words.append(node.text.lower())
+        elif isinstance(node, Phrase):
+            query_words.extend(self._tokenize(" ".join(node.words)))
+        elif isinstance(node, (And, Or)):
+            for operand in node.operands:
+                self._collect_query_words(operand, query_words)
+
+    @_observed_search
+    def search_proximity(
+        self, term1: str, term2: str, max_distance: int, top_k: int = 5
+    ) -> Sequence[Tuple[str, float, str]]:
+        """
+        Search for documents where two terms occur within max_distance tokens
+        of each other
+
+        The summed TF-IDF of both terms is divided by the closest distance
+        between them, so adjacent terms score highest. Each term is
+        normalized like document text and, when it tokenizes to several
+        words, matched by the first.
 
         Returns:
             List of tuples (doc_id, score, content_preview)
         """
-        query_words = self._tokenize(query.lower())
-        if not query_words:
+        term1 = next(iter(self._tokenize(term1)), "")
+        term2 = next(iter(self._tokenize(term2)), "")
+        if not term1 or not term2:
             return []
+        docs_with_term1 = self.trie.get_documents_for_word(term1)
+        docs_with_term2 = self.trie.get_documents_for_word(term2)
 
         doc_scores: MutableMapping[str, float] = {}
 
-        for word in query_words:
-            # Get documents containing this word
-            docs_with_word = self.trie.get_documents_for_word(word)
+        for doc_id in docs_with_term1.keys() & docs_with_term2.keys():
+            positions = self._get_document_positions(doc_id)
+            positions1 = positions.get(term1, [])
+            positions2 = positions.get(term2, [])
+            distance = min(
+                (abs(i - j) for i in positions1 for j in positions2 if i != j),
+                default=None,
+            )
+            if distance is None or distance > max_distance:
+                continue
 
-            for doc_id in docs_with_word:
-                tf_idf = self._calculate_tf_idf(doc_id, word)
+            tf_idf = self._calculate_tf_idf(doc_id, term1) + self._calculate_tf_idf(
+                doc_id, term2
+            )
+            doc_scores[doc_id] = tf_idf / distance
+
+        return self._build_results(doc_scores, top_k, [term1, term2])
+
+    @_observed_search
+    def regex_search(
+        self, pattern: str, top_k: int = 5
+    ) -> Sequence[Tuple[str, float, str]]:
+        """
+        Search raw document content for a regular expression, scoring each
+        document by its number of matches
 
-                doc_scores[doc_id] = doc_scores.get(doc_id, 0) + tf_idf
+        This bypasses the index and scans every document, so its cost grows
+        with the total size of the corpus.
 
-        sorted_docs = sorted(doc_scores.items(), key=lambda x: x[1], reverse=True)
+        Returns:
+            List of tuples (doc_id, score, content_preview)
+
+        Raises:
+            re.error: If the pattern is not a valid regular expression
+        """
+        regex = re.compile(pattern)
+
+        doc_scores: MutableMapping[str, float] = {}
+        doc_first_match: MutableMapping[str, int] = {}
+
+        for doc_id, content in self._doc_id_to_document.items():
+            matches = list(regex.finditer(content))
+            if matches:
+                doc_scores[doc_id] = float(len(matches))
+                doc_first_match[doc_id] = matches[0].start()
+
+        limit = top_k if top_k > 0 else len(doc_scores)
+        top_docs = heapq.nlargest(limit, doc_scores.items(), key=lambda x: x[1])
 
         results = []
-        for doc_id, score in sorted_docs[:top_k]:
-            content = self._doc_id_to_document.get(doc_id, "")
-            preview = self._get_content_preview(content, query_words)
+        for doc_id, score in top_docs:
+            content = self._doc_id_to_document[doc_id]
+            preview = self._get_preview_around(content, doc_first_match[doc_id])
             results.append((doc_id, score, preview))
 
         return results
 
+    @_observed_search
     def search_by_prefix(
         self, prefix: str, top_k: int = 5
     ) -> Sequence[Tuple[str, float, str]]:
         """
         Search for documents using prefix matching on query terms
 
+        At most top_k results are returned, or every match when top_k is
+        zero or less.
+
         Returns:
             List of tuples (doc_id, score, content_preview)
         """
         if not prefix.strip():
             return []
 
-        docs_with_prefix = self.trie.get_documents_for_prefix(prefix.lower())
+        doc_scores = self._score_prefix(prefix)
 
-        if not docs_with_prefix:
-            return []
+        return self._build_results(doc_scores, top_k, [prefix])
 
-        doc_scores: MutableMapping[str, float] = {}
+    def _score_prefix(self, prefix: str) -> MutableMapping[str, float]:
+        """Score documents by the fraction of their words starting with prefix
 
-        for doc_id, total_count in docs_with_prefix.items():
-            doc_length = self._forward_index.get_document_length(doc_id)
-            if doc_length > 0:
-                doc_scores[doc_id] = total_count / doc_length
+        Each matching word's count is weighted by its IDF so that rarer
+        completions count for more.
+        """
+        doc_scores: MutableMapping[str, float] = {}
 
-        # Sort by score and return top-k results
-        sorted_docs = sorted(doc_scores.items(), key=lambda x: x[1], reverse=True)
+        for word in self.prefix_search(prefix):
+            idf = self.get_idf(word)
+            for doc_id, count in self.trie.get_documents_for_word(word).items():
+                doc_length = self._forward_index.get_document_length(doc_id)
+                if doc_length > 0:
+                    doc_scores[doc_id] = (
+                        doc_scores.get(doc_id, 0) + count * idf / doc_length
+                    )
+
+        self._apply_document_boosts(doc_scores)
+        return doc_scores
+
+    def _build_results(
+        self,
+        doc_scores: Mapping[str, float],
+        top_k: int,
+        query_words: Sequence[str],
+        offset: int = 0,
+        include_previews: bool = True,
+        full_content: bool = False,
+    ) -> List[Tuple[str, float, str]]:
+        """Select the top-k scored documents after offset and attach previews
+
+        A top_k of zero or less selects every document after offset. With
+        full_content, the whole document is attached instead of a preview.
+        """
+        limit = offset + top_k if top_k > 0 else len(doc_scores)
+        top_docs = heapq.nlargest(limit, doc_scores.items(), key=lambda x: x[1])[
+            offset:
+        ]
 
         results = []
-        for doc_id, score in sorted_docs[:top_k]:
-            content = self._doc_id_to_document.get(doc_id, "")
-            preview = self._get_content_preview(content, [prefix])
+        for doc_id, score in top_docs:
+            preview = ""
+            if include_previews:
+                content = self._doc_id_to_document.get(doc_id, "")
+                preview = (
+                    content
+                    if full_content
+                    else self._get_content_preview(content, query_words)
+                )
             results.append((doc_id, score, preview))
 
         return results
 
     def prefix_search(self, prefix: str) -> List[str]:
-        """Search for words that start with the given prefix"""
-        return self.trie.starts_with(prefix)
+        """Search for words that start with the given prefix
+
+        Path terms are only included when the prefix starts with "path:".
+        """
+        return self._without_path_terms(self.trie.starts_with(prefix), prefix)
+
+    def _without_path_terms(self, words: List[str], prefix: str = "") -> List[str]:
+        """Leave out path terms unless prefix explicitly asks for them
+
+        Path terms are searchable but are not words of any document's
+        content, so vocabulary listings and completions hide them.
+        """
+        if prefix.lower().startswith(PATH_TERM_PREFIX):
+            return words
+        return [word for word in words if not word.startswith(PATH_TERM_PREFIX)]
+
+    def autocomplete(self, prefix: str, limit: int = 10) -> List[str]:
+        """Suggest words starting with the prefix, most common first"""
+        return heapq.nsmallest(
+            limit,
+            self.prefix_search(prefix),
+            key=lambda word: (-self.trie.get_document_frequency(word), word),
+        )
+
+    def complete_query(self, partial: str, limit: int = 10) -> List[str]:
+        """Suggest full queries completing the last word of a partial query
+
+        Earlier words are kept as typed and restrict completions to words
+        found in documents containing all of them, ranked by how many of
+        those documents they occur in. Nothing is suggested when the query
+        ends in a space.
+        """
+        context, _, last = partial.rpartition(" ")
+        if not last:
+            return []
+
+        context_doc_ids: Optional[AbstractSet[str]] = None
+        for word in self._tokenize(context):
+            doc_ids = self.trie.get_documents_for_word(word).keys()
+            context_doc_ids = (
+                set(doc_ids) if context_doc_ids is None else context_doc_ids & doc_ids
+            )
+
+        def frequency(word: str) -> int:
+            doc_ids = self.trie.get_documents_for_word(word)
+            if context_doc_ids is None:
+                return len(doc_ids)
+            return len(context_doc_ids & doc_ids.keys())
+
+        word_frequencies = {
+            word: frequency(word) for word in self.prefix_search(last.lower())
+        }
+        ranked = heapq.nsmallest(
+            limit,
+            (word for word, count in word_frequencies.items() if count > 0),
+            key=lambda word: (-word_frequencies[word], word),
+        )
+        prefix = partial[: len(partial) - len(last)]
+        return [prefix + word for word in ranked]
+
+    def has_word(self, word: str) -> bool:
+        """Check whether a word is in the index"""
+        return self.trie.search(word)
+
+    def vocabulary(self) -> List[str]:
+        """Get every indexed content word, sorted, leaving out path terms"""
+        return self._without_path_terms(self.trie.get_all_words())
+
+    def words_in_range(self, low: str, high: str) -> List[str]:
+        """Get every indexed word with low <= word < high, sorted
+
+        Path terms are only included when low starts with "path:".
+        """
+        return self._without_path_terms(self.trie.words_in_range(low, high), low)
+
+    def snapshot(self) -> StorageSnapshot:
+        """Capture a deep copy of the current state for a later restore"""
+        return StorageSnapshot(
+            documents=copy.deepcopy(self._doc_id_to_document),
+            forward_index=copy.deepcopy(self._forward_index),
+            trie=copy.deepcopy(self.trie),
+            total_documents=self._total_documents,
+            content_hashes=dict(self._content_hash_to_doc_id),
+            metadata=copy.deepcopy(self._doc_id_to_metadata),
+            document_boosts=dict(self._doc_id_to_boost),
+        )
+
+    def restore(self, snapshot: StorageSnapshot) -> None:
+        """Restore the state captured by snapshot, which can be reused"""
+        self._doc_id_to_document = copy.deepcopy(snapshot.documents)
+        self._forward_index = copy.deepcopy(snapshot.forward_index)
+        self.trie = copy.deepcopy(snapshot.trie)
+        self._total_documents = snapshot.total_documents
+        self._content_hash_to_doc_id = dict(snapshot.content_hashes)
+        self._doc_id_to_content_hash = {
+            doc_id: content_hash
+            for content_hash, doc_id in snapshot.content_hashes.items()
+        }
+        self._doc_id_to_metadata = copy.deepcopy(snapshot.metadata)
+        self._doc_id_to_boost = dict(snapshot.document_boosts)
+        self._invalidate_score_caches()
+
+    def drop_contents(self) -> None:
+        """Discard the content of every document, keeping only the index
+
+        Search still ranks documents but previews and document info content
+        become empty, and content-based searches (proximity and regex) no
+        longer match.
+        """
+        for doc_id in self._doc_id_to_document:
+            self._doc_id_to_document[doc_id] = ""
+        self._query_to_results.clear()
+
+    def for_each_document(self, callback: Callable[[str, str], None]) -> None:
+        """Call callback with the ID and content of every document
+
+        Iteration stops at, and propagates, the first exception raised by
+        callback.
+        """
+        for doc_id, content in self._doc_id_to_document.items():
+            callback(doc_id, content)
 
     def get_document_info(self, doc_id: str) -> Optional[MutableMapping]:
         """Get information about a specific document"""
@@ -219,39 +2237,308 @@ class DocumentStorage:
             "word_counts": word_counts,
             "total_words": doc_length,
             "unique_words": len(word_counts),
+            "metadata": self.get_metadata(doc_id),
+        }
+
+    def get_metadata(self, doc_id: str) -> MutableMapping[str, str]:
+        """Get a copy of a document's metadata fields"""
+        return dict(self._doc_id_to_metadata.get(doc_id, {}))
+
+    def get_preview(
+        self, doc_id: str, terms: Sequence[str], max_length: Optional[int] = None
+    ) -> str:
+        """Generate the preview search would show for a document and terms
+
+        max_length defaults to the storage's preview_length. Returns an empty
+        string for unknown documents.
+        """
+        content = self._doc_id_to_document.get(doc_id, "")
+        return self._get_content_preview(
+            content, [term.lower() for term in terms], max_length
+        )
+
+    def get_word_count(self, doc_id: str, word: str) -> int:
+        """Get the count of a word in a document"""
+        return self._forward_index.get_word_count(doc_id, word)
+
+    def get_word_positions(self, doc_id: str, word: str) -> List[int]:
+        """Get the token offsets of a word in a document, if positions are stored"""
+        return self._forward_index.get_positions(doc_id, word)
+
+    def get_document_vector(self, doc_id: str) -> Optional[MutableMapping[str, float]]:
+        """Get the TF-IDF weight of every content word in a document
+
+        Path terms are left out, so documents with the same content in
+        different directories have the same vector.
+
+        Returns:
+            Mapping from word to TF-IDF, or None if the document is not found
+        """
+        if doc_id not in self._doc_id_to_document:
+            return None
+        return {
+            word: self._calculate_tf_idf(doc_id, word)
+            for word in self._forward_index.get_document_words(doc_id)
+            if not word.startswith(PATH_TERM_PREFIX)
         }
 
     def get_stats(self) -> MutableMapping:
         """Get statistics about the document storage"""
+        doc_lengths = self._forward_index.get_document_lengths().values()
         return {
             "total_documents": len(self._doc_id_to_document),
-            "total_words": len(self.trie.get_all_words()),
+            # Path terms are not content words
+            "total_words": (
+                self.trie.get_unique_word_count()
+                - len(self.trie.starts_with(PATH_TERM_PREFIX))
+            ),
             "total_documents_in_index": self._total_documents,
+            "average_document_length": (
+                self._forward_index.get_average_document_length()
+            ),
+            "max_document_length": max(doc_lengths, default=0),
         }
 
+    def estimate_memory_usage(self) -> int:
+        """Roughly estimate the bytes used by documents and their indexes
+
+        Sums document content and ID sizes, an estimate per word count held
+        in the forward index and trie, and an estimate per trie node.
+        """
+        content_bytes = sum(
+            sys.getsizeof(doc_id) + sys.getsizeof(content)
+            for doc_id, content in self._doc_id_to_document.items()
+        )
+        word_count_entries = sum(
+            len(self._forward_index.get_document_words(doc_id))
+            for doc_id in self._doc_id_to_document
+        )
+        return (
+            content_bytes
+            # Each word count is held in both the forward index and the trie
+            + 2 * word_count_entries * ESTIMATED_MAPPING_ENTRY_BYTES
+            + self.trie.get_node_count() * ESTIMATED_TRIE_NODE_BYTES
+        )
+
+    def get_document_frequency(self, word: str) -> int:
+        """Get the number of documents containing a word"""
+        return self.trie.get_document_frequency(word)
+
+    def get_idf(self, word: str) -> float:
+        """Calculate Inverse Document Frequency for a word, caching the result"""
+        word = word.lower()
+        if word not in self._word_to_idf:
+            doc_freq = self.get_document_frequency(word)
+            self._word_to_idf[word] = (
+                self._idf_function(self._total_documents, doc_freq)
+                if doc_freq > 0
+                else 0
+            )
+        return self._word_to_idf[word]
+
     def _calculate_tf_idf(self, doc_id: str, word: str) -> float:
         """Calculate TF-IDF score for a word in a document"""
-        tf = self._forward_index.get_tf(doc_id, word)
-        doc_freq = self.trie.get_document_frequency(word)
-        if doc_freq == 0:
+        tf = self._get_tf(doc_id, word)
+        return tf * self.get_idf(word) * self._get_lead_boost(doc_id, word)
+
+    def _get_lead_boost(self, doc_id: str, word: str) -> float:
+        """Get lead_boost if a word occurs in a document's lead, otherwise 1"""
+        if self.lead_boost == 1.0:
+            return 1.0
+        if self._forward_index.is_lead_word(doc_id, word):
+            return self.lead_boost
+        return 1.0
+
+    def _get_lead_words(self, content: str) -> AbstractSet[str]:
+        """Get the words in the lead of a document's content"""
+        lead = content[: self.lead_length].partition("\n")[0]
+        return set(self._tokenize(lead))
+
+    def _get_tf(self, doc_id: str, word: str) -> float:
+        """Calculate the term frequency of a word in a document for tf_mode"""
+        if self.tf_mode == "linear":
+            return self._forward_index.get_tf(doc_id, word)
+
+        count = self._forward_index.get_word_count(doc_id, word)
+        if count <= 0:
             return 0
-        idf = math.log2((self._total_documents + 1) / (doc_freq + 1)) + 1
+        return 1 + math.log(count) if self.tf_mode == "log" else 1
+
+    def _score_term(self, doc_id: str, word: str) -> float:
+        """Score a word's match in a document with the configured scorer"""
+        stats = IndexStats(
+            total_documents=self._total_documents,
+            doc_freq=self.get_document_frequency(word),
+            term_count=self._forward_index.get_word_count(doc_id, word),
+            doc_length=self._forward_index.get_document_length(doc_id),
+            average_doc_length=self._forward_index.get_average_document_length(),
+            tf=self._get_tf(doc_id, word),
+            idf=self.get_idf(word),
+        )
+        return self.scorer.score(doc_id, word, stats) * self._get_lead_boost(
+            doc_id, word
+        )
 
-        return tf * idf
+    def warmup(self) -> None:
+        """Precompute the IDF of every word and the norm of every document
 
-    def _tokenize(self, text: str) -> Iterable[str]:
-        """Tokenize text into words"""
-        return (
-            word for word in re.findall(r"\b[a-zA-Z]+\b", text.lower()) if len(word) > 1
-        )
+        Call after bulk loading so the first searches do not pay for filling
+        the caches. Adding or removing documents clears them again.
+        """
+        for word in self.trie.get_all_words():
+            self.get_idf(word)
+        for doc_id in self._doc_id_to_document:
+            self._get_document_norm(doc_id)
+
+    def recompute_aggregates(self) -> None:
+        """Recompute running totals and clear cached scores from scratch
+
+        The total document length is otherwise updated incrementally as
+        documents change; this recovers it if the index was modified
+        directly.
+        """
+        self._forward_index.recompute_aggregates()
+        self._invalidate_score_caches()
+
+    def _invalidate_score_caches(self) -> None:
+        """Clear cached values that depend on the set of documents
+
+        Norms depend on every word's IDF, which shifts whenever the document
+        count changes, so they are recomputed lazily rather than updated.
+        """
+        self._doc_id_to_norm.clear()
+        self._word_to_idf.clear()
+        self._query_to_results.clear()
+
+    def _get_norm_settings(self) -> Tuple:
+        """Get the settings that affect document vectors, to key cached norms"""
+        return (self.tf_mode, self.lead_boost)
+
+    def _get_document_norm(self, doc_id: str) -> float:
+        """Get the L2 norm of a document's TF-IDF vector, computing it if needed"""
+        settings = self._get_norm_settings()
+        if settings != self._norm_settings:
+            self._doc_id_to_norm.clear()
+            self._norm_settings = settings
+        if doc_id not in self._doc_id_to_norm:
+            vector = self.get_document_vector(doc_id) or {}
+            self._doc_id_to_norm[doc_id] = math.sqrt(
+                sum(weight**2 for weight in vector.values())
+            )
+        return self._doc_id_to_norm[doc_id]
+
+    def _tokenize(self, text: str, code: Optional[bool] = None) -> Iterable[str]:
+        """Tokenize text into words, dropping any longer than max_token_length
+
+        Text is tokenized as source code when code is True, or by default
+        when code_extensions is set so that queries match code identifiers.
+        """
+        if code is None:
+            code = bool(self.code_extensions)
+        if self.normalize_width:
+            text = normalize_width(text)
+        if self.fold_diacritics:
+            text = fold_diacritics(text)
+        if self.collapse_repeats:
+            text = collapse_repeats(text)
+        if self.hyphen_mode != "split":
+            text = join_hyphenated(text, keep_parts=self.hyphen_mode == "both")
+
+        if self.tokenizer is not None:
+            tokens = (token.lower() for token in self.tokenizer(text))
+        elif code:
+            tokens = (
+                word
+                for word in code_tokenize(text)
+                if len(word) >= self.min_token_length
+            )
+        else:
+            pattern = (
+                LETTER_WORD_PATTERN if self.fold_diacritics else LATIN_WORD_PATTERN
+            )
+            tokens = (
+                word
+                for word in pattern.findall(text.lower())
+                if len(word) >= self.min_token_length
+            )
+
+        if self.max_token_length is None:
+            return tokens
+        return (token for token in tokens if len(token) <= self.max_token_length)
+
+    def _parse_weighted_query(self, query: str) -> MutableMapping[str, float]:
+        """Map each query word to its weight, summing weights of repeated words
+
+        Words take the weight of a "^weight" suffix on their whitespace
+        separated term, defaulting to 1.0 when absent, malformed or negative. Words
+        too common under max_doc_freq_ratio and excluded "-term" words are
+        left out.
+        """
+        word_weights: MutableMapping[str, float] = {}
+
+        for term in query.split():
+            if self._is_excluded_term(term):
+                continue
+            text, _, weight_text = term.partition("^")
+            try:
+                weight = float(weight_text) if weight_text else 1.0
+            except ValueError:
+                weight = 1.0
+            if not math.isfinite(weight) or weight < 0:
+                weight = 1.0
+
+            if text.lower().startswith(PATH_TERM_PREFIX):
+                words: Iterable[str] = [text.lower()]
+            else:
+                words = self._tokenize(text)
+
+            for word in words:
+                if self._is_too_common(word):
+                    continue
+                word_weights[word] = word_weights.get(word, 0) + weight
+
+        return word_weights
+
+    def _is_excluded_term(self, term: str) -> bool:
+        """Check whether a query term is a "-term" exclusion"""
+        return len(term) > 1 and term.startswith("-")
+
+    def _parse_excluded_words(self, query: str) -> AbstractSet[str]:
+        """Get the words of every "-term" exclusion in a query"""
+        excluded = set()
+        for term in query.split():
+            if self._is_excluded_term(term):
+                text = term[1:].partition("^")[0]
+                if text.lower().startswith(PATH_TERM_PREFIX):
+                    excluded.add(text.lower())
+                else:
+                    excluded.update(self._tokenize(text))
+        return excluded
+
+    def _drop_excluded(
+        self, doc_scores: MutableMapping[str, float], query: str
+    ) -> None:
+        """Remove documents containing any word excluded by the query"""
+        for word in self._parse_excluded_words(query):
+            for doc_id in self.trie.get_documents_for_word(word):
+                doc_scores.pop(doc_id, None)
+
+    def _is_too_common(self, word: str) -> bool:
+        """Check whether a word's document frequency exceeds max_doc_freq_ratio"""
+        if self.max_doc_freq_ratio is None or self._total_documents == 0:
+            return False
+        doc_freq = self.get_document_frequency(word)
+        return doc_freq / self._total_documents > self.max_doc_freq_ratio
+
+    def _hash_content(self, content: str) -> str:
+        """Hash content with runs of whitespace collapsed"""
+        normalized = " ".join(content.split())
+        return hashlib.sha256(normalized.encode("utf-8")).hexdigest()
 
     def _get_content_preview(
-        self, content: str, query_words: List[str], max_length: int = 200
+        self, content: str, query_words: List[str], max_length: Optional[int] = None
     ) -> str:
         """Generate a preview of the content highlighting query words"""
-        if len(content) <= max_length:
-            return content
-
         content_lower = content.lower()
         first_pos = len(content)
 
@@ -260,10 +2547,25 @@ class DocumentStorage:
             if pos != -1 and pos < first_pos:
                 first_pos = pos
 
-        start = max(0, first_pos - 50)
+        return self._get_preview_around(content, first_pos, max_length, query_words)
+
+    def _get_preview_around(
+        self,
+        content: str,
+        position: int,
+        max_length: Optional[int] = None,
+        query_words: Sequence[str] = (),
+    ) -> str:
+        """Generate a preview of the content starting shortly before a position"""
+        if max_length is None:
+            max_length = self.preview_length
+        if len(content) <= max_length:
+            return self._format_preview(content, query_words)
+
+        start = max(0, position - self.preview_context_before)
         end = min(len(content), start + max_length)
 
-        preview = content[start:end]
+        preview = self._format_preview(content[start:end], query_words)
 
         if start > 0:
             preview = "..." + preview
@@ -272,69 +2574,371 @@ class DocumentStorage:
 
         return preview
 
+    def _format_preview(self, text: str, query_words: Sequence[str]) -> str:
+        """Highlight query words in preview text and escape it for preview_format"""
+        if self.preview_format == "plain":
+            return text
+
+        if self.preview_format == "html":
+            escape, highlight = html.escape, "<mark>{}</mark>"
+        else:
+            escape, highlight = (lambda part: part), "**{}**"
+
+        if not query_words:
+            return escape(text)
+
+        parts = []
+        last_end = 0
+        for match in self._query_word_pattern(query_words).finditer(text):
+            parts.append(escape(text[last_end : match.start()]))
+            parts.append(highlight.format(escape(match.group())))
+            last_end = match.end()
+        parts.append(escape(text[last_end:]))
+        return "".join(parts)
+
+    def _query_word_pattern(self, query_words: Sequence[str]) -> re.Pattern[str]:
+        """Compile a case-insensitive pattern matching any query word whole"""
+        # Longest first so that a word is not cut short by one of its prefixes
+        alternatives = sorted(query_words, key=len, reverse=True)
+        return re.compile(
+            r"\b(?:" + "|".join(map(re.escape, alternatives)) + r")\b", re.IGNORECASE
+        )
+
+    def get_highlights(self, query: str, preview: str) -> List[Tuple[int, int]]:
+        """Get the (start, end) offsets of query words in a result's preview
+
+        Offsets index into the preview string as returned, including any
+        leading "...", so preview[start:end] is the matched word. They are
+        meant for "plain" previews that callers highlight themselves.
+        """
+        query_words = list(self._parse_weighted_query(query))
+        if not query_words:
+            return []
+        return [
+            match.span()
+            for match in self._query_word_pattern(query_words).finditer(preview)
+        ]
+
+    @_observed_search
     def smart_search(self, query: str, top_k: int = 5) -> List[Tuple[str, float, str]]:
         r"""
-        Smart search that automatically chooses between exact and prefix search
+        Smart search that combines exact and prefix matching per term
 
         Rules:
-        - If query ends with *, use prefix search (removing the *)
-        - Otherwise use exact word matching
+        - Terms ending with * are prefix matched (removing the *)
+        - Other terms use exact word matching
+        - If query is "term1 NEAR/n term2", use proximity search
         - Interpret \* as literal * (escape the wildcard)
 
+        Documents are scored by the TF-IDF of their exact terms plus, for each
+        prefix term, the fraction of their words starting with the prefix.
+        At most top_k results are returned, or every match when top_k is zero
+        or less.
+
         Returns:
             List of tuples (doc_id, score, content_preview)
         """
         if not query.strip():
             return []
 
-        query = query.replace("\\*", "___ESCAPED_ASTERISK___")
+        near_match = re.fullmatch(r"\s*(\S+)\s+NEAR/(\d+)\s+(\S+)\s*", query)
+        if near_match:
+            term1, max_distance, term2 = near_match.groups()
+            return self.search_proximity(term1, term2, int(max_distance), top_k)
+
+        exact_terms = []
+        prefixes = []
+        for term in query.split():
+            if term.endswith("*") and not term.endswith("\\*"):
+                if term[:-1]:
+                    prefixes.append(term[:-1].lower())
+            else:
+                exact_terms.append(term.replace("\\*", "*"))
+
+        if not prefixes:
+            return self.search(" ".join(exact_terms), top_k)
+
+        word_weights = self._parse_weighted_query(" ".join(exact_terms))
+        doc_scores = self._score_weighted_words(word_weights)
+        for prefix in prefixes:
+            for doc_id, score in self._score_prefix(prefix).items():
+                doc_scores[doc_id] = doc_scores.get(doc_id, 0) + score
+        self._drop_excluded(doc_scores, " ".join(exact_terms))
+
+        return self._build_results(doc_scores, top_k, [*word_weights, *prefixes])
+
+    def export_jsonl(self, file: TextIO) -> None:
+        """Write each document as a {"doc_id", "content"} JSON object per line"""
+        for doc_id, content in self._doc_id_to_document.items():
+            file.write(json.dumps({"doc_id": doc_id, "content": content}) + "\n")
+
+    def export_inverted_index(
+        self, file: TextIO, format: InvertedIndexFormat = "jsonl"
+    ) -> None:
+        """Write the term to postings mapping in a portable format, sorted by term
+
+        "jsonl" writes a {"term", "postings"} JSON object per line, with
+        postings mapping document IDs to occurrence counts. "csv" writes a
+        term,doc_id,count header and a row per posting.
+
+        Raises:
+            ValueError: If the format is not supported
+        """
+        if format == "jsonl":
 
-        if query.endswith("*"):
-            prefix = query[:-1].strip()  # Remove the *
-            if prefix:  # Only search if there's a prefix
-                return self.search_by_prefix(prefix, top_k)
-            return []
+            def write_term(word: str, _doc_freq: int) -> bool:
+                postings = self.trie.get_documents_for_word(word)
+                file.write(json.dumps({"term": word, "postings": postings}) + "\n")
+                return True
 
-        query = query.replace("___ESCAPED_ASTERISK___", "*")
+        elif format == "csv":
+            writer = csv.writer(file)
+            writer.writerow(["term", "doc_id", "count"])
 
-        return self.search(query, top_k)
+            def write_term(word: str, _doc_freq: int) -> bool:
+                for doc_id, count in self.trie.get_documents_for_word(word).items():
+                    writer.writerow([word, doc_id, count])
+                return True
 
-    def save(self, file_path: Path) -> None:
-        with open(file_path, "w") as f:
-            json.dump(
-                {
-                    "documents": self._doc_id_to_document,
-                    "doc_counter": self._doc_counter,
-                    "total_documents": self._total_documents,
-                    "forward_index": {
-                        "documents": self._forward_index._doc_id_to_document,
-                        "doc_lengths": self._forward_index._doc_id_to_doc_length,
-                    },
+        else:
+            raise ValueError(f"Unsupported inverted index format: {format}")
+
+        self.trie.for_each_word(write_term)
+
+    def import_jsonl(self, file: TextIO) -> Sequence[str]:
+        """Add a document for each {"doc_id", "content"} JSON object line
+
+        Returns:
+            List of document IDs that were added
+        """
+        added_docs = []
+        for line_number, line in enumerate(file, 1):
+            if not line.strip():
+                continue
+            record = json.loads(line)
+            if "content" not in record:
+                raise ValueError(f"Line {line_number} has no content")
+            doc_id = self.add_document(record["content"], record.get("doc_id"))
+            added_docs.append(doc_id)
+
+        return added_docs
+
+    def add_documents_from_csv(
+        self,
+        file_path: str,
+        content_column: int,
+        id_column: Optional[int] = None,
+        has_header: bool = False,
+    ) -> Sequence[str]:
+        """Add a document for each row of a CSV file
+
+        Args:
+            file_path: Path of the CSV file
+            content_column: Index of the column holding each row's content
+            id_column: Index of the column holding each row's document ID;
+                IDs are generated when absent or empty
+            has_header: Whether to skip the first row
+
+        Rows the CSV reader rejects, such as ones with a field over the
+        csv.field_size_limit, rows missing a column and rows whose document
+        cannot be added are skipped with a warning. A leading UTF-8 byte
+        order mark, as written by Excel, is removed.
+
+        Returns:
+            List of document IDs that were added
+        """
+        added_docs = []
+        with open(file_path, "r", encoding="utf-8-sig", newline="") as f:
+            rows = _read_csv_rows(f)
+            if has_header:
+                next(rows, None)
+
+            for line_num, row in rows:
+                try:
+                    content = row[content_column]
+                    doc_id = row[id_column] if id_column is not None else None
+                    added_docs.append(self.add_document(content, doc_id or None))
+                except (IndexError, ValueError) as e:
+                    print(f"Warning: Skipping CSV line {line_num}: {e}")
+
+        return added_docs
+
+    def save(
+        self, file_path: Path, include_trie: bool = False, compact: bool = False
+    ) -> None:
+        """Save storage to a JSON file
+
+        Args:
+            file_path: Path of the JSON file to write
+            include_trie: Whether to also serialize the trie so that loading
+                does not need to rebuild it from the forward index
+            compact: Whether to leave out document lengths, which are
+                recomputed on loading, and write without indentation
+
+        Raises:
+            ValueError: If both include_trie and compact are set
+        """
+        if include_trie and compact:
+            raise ValueError("Compact storage files cannot include the trie")
+
+        data = {
+            "version": STORAGE_FORMAT_VERSION,
+            "documents": self._doc_id_to_document,
+            "total_documents": self._total_documents,
+            "forward_index": {
+                "documents": self._forward_index._doc_id_to_document,
+                "doc_lengths": self._forward_index._doc_id_to_doc_length,
+                "store_positions": self._forward_index.store_positions,
+                "positions": self._forward_index._doc_id_to_positions,
+                "lead_words": {
+                    doc_id: sorted(words)
+                    for doc_id, words in (
+                        self._forward_index._doc_id_to_lead_words.items()
+                    )
                 },
-                f,
-                indent=2,
-            )
+            },
+            "deduplicate_by_content": self.deduplicate_by_content,
+            "index_paths": self.index_paths,
+            "compress_trie": isinstance(self.trie, RadixTrie),
+            "fold_diacritics": self.fold_diacritics,
+            "collapse_repeats": self.collapse_repeats,
+            "normalize_width": self.normalize_width,
+            "hyphen_mode": self.hyphen_mode,
+            "min_token_length": self.min_token_length,
+            "max_token_length": self.max_token_length,
+            "store_contents": self.store_contents,
+            "empty_documents": self.empty_documents,
+            "max_postings_per_word": self.max_postings_per_word,
+            "tf_mode": self.tf_mode,
+            "max_doc_freq_ratio": self.max_doc_freq_ratio,
+            "lead_boost": self.lead_boost,
+            "lead_length": self.lead_length,
+            "code_extensions": sorted(self.code_extensions),
+            "content_hashes": self._content_hash_to_doc_id,
+            "metadata": self._doc_id_to_metadata,
+            "document_boosts": self._doc_id_to_boost,
+        }
+        if include_trie:
+            data["trie"] = self.trie.to_dict()
+        if compact:
+            data["compact"] = True
+            del data["forward_index"]["doc_lengths"]
+
+        with open(file_path, "w") as f:
+            if compact:
+                json.dump(data, f, separators=(",", ":"))
+            else:
+                json.dump(data, f, indent=2)
 
     @classmethod
-    def load(cls, file_path: Path) -> "DocumentStorage":
+    def load(
+        cls, file_path: Path, strict: bool = False, **options: Any
+    ) -> "DocumentStorage":
+        """Load storage from a JSON file, rebuilding the trie if it was not saved
+
+        Files from older versions load with defaults for anything they lack.
+        Version 0 files without a forward index are reindexed from their
+        documents. With strict, the forward index and document count are
+        checked against the documents before anything is built from them.
+
+        Callables such as tokenizer, idf_function and scorer are not saved,
+        so a storage built with them loads with the defaults unless they are
+        passed again in options, which go to the constructor along with the
+        saved settings.
+
+        Raises:
+            ValueError: If the file is from a newer, unsupported version, is
+                inconsistent when strict, or options include a saved setting
+        """
         with open(file_path, "r") as f:
             data = json.load(f)
 
+        version = data.get("version", 0)
+        if version > STORAGE_FORMAT_VERSION:
+            raise ValueError(
+                f"Storage file version {version} is newer than the supported "
+                f"version {STORAGE_FORMAT_VERSION}"
+            )
+
+        settings = {
+            "deduplicate_by_content": data.get("deduplicate_by_content", False),
+            "index_paths": data.get("index_paths", False),
+            "compress_trie": data.get("compress_trie", False),
+            "fold_diacritics": data.get("fold_diacritics", False),
+            "collapse_repeats": data.get("collapse_repeats", False),
+            "normalize_width": data.get("normalize_width", False),
+            "hyphen_mode": data.get("hyphen_mode", "split"),
+            "min_token_length": data.get("min_token_length", 2),
+            "max_token_length": data.get("max_token_length"),
+            "store_contents": data.get("store_contents", True),
+            "empty_documents": data.get("empty_documents", "warn"),
+            "max_postings_per_word": data.get("max_postings_per_word"),
+            "tf_mode": data.get("tf_mode", "linear"),
+            "max_doc_freq_ratio": data.get("max_doc_freq_ratio"),
+            "lead_boost": data.get("lead_boost", 1.0),
+            "lead_length": data.get("lead_length", 100),
+            "code_extensions": data.get("code_extensions"),
+        }
+        saved_options = sorted(options.keys() & {*settings, *LOADED_DATA_OPTIONS})
+        if saved_options:
+            raise ValueError(
+                f"Options {saved_options} are restored from the storage file"
+            )
+        settings.update(options)
+        documents = data.get("documents", {})
+
+        if version == 0 and "forward_index" not in data:
+            storage = cls(**settings)
+            for doc_id, content in documents.items():
+                storage.add_document(content, doc_id)
+            return storage
+
+        forward_index_data = data["forward_index"]
+        if version == 0 and "doc_lengths" not in forward_index_data:
+            forward_index_data["doc_lengths"] = {
+                doc_id: sum(word_counts.values())
+                for doc_id, word_counts in forward_index_data["documents"].items()
+            }
+        if data.get("compact"):
+            forward_index_data["doc_lengths"] = {
+                doc_id: _document_length(word_counts)
+                for doc_id, word_counts in forward_index_data["documents"].items()
+            }
+        total_documents = data.get("total_documents", len(documents))
+        if strict:
+            _check_consistency(
+                documents, forward_index_data, total_documents, data.get("trie")
+            )
+
+        trie_class = RadixTrie if settings["compress_trie"] else Trie
         storage = cls(
-            documents=data["documents"],
-            doc_counter=data["doc_counter"],
-            total_documents=data["total_documents"],
+            documents=documents,
+            total_documents=total_documents,
             forward_index=ForwardIndex(
-                documents=data["forward_index"]["documents"],
-                doc_lengths=data["forward_index"]["doc_lengths"],
+                documents=forward_index_data["documents"],
+                doc_lengths=forward_index_data["doc_lengths"],
+                positions=forward_index_data.get("positions"),
+                store_positions=forward_index_data.get("store_positions", False),
+                lead_words=forward_index_data.get("lead_words"),
             ),
+            trie=trie_class.from_dict(data["trie"]) if "trie" in data else None,
+            content_hashes=data.get("content_hashes"),
+            metadata=data.get("metadata"),
+            document_boosts=data.get("document_boosts"),
+            **settings,
         )
-
+        if "lead_words" not in forward_index_data:
+            # Files saved before leads were recorded take them from content
+            for doc_id in storage._forward_index.get_all_document_ids():
+                storage._forward_index._doc_id_to_lead_words[doc_id] = set(
+                    storage._get_lead_words(documents.get(doc_id, ""))
+                )
+        if "trie" in data:
+            return storage
+
+        # Replaying documents in the order they were added drops the same
+        # postings as max_postings_per_word did when they were indexed
         for doc_id, word_counts in storage._forward_index._doc_id_to_document.items():
-            for word, count in word_counts.items():
-                if not storage.trie.search(word):
-                    # TODO: Use a bloom filter?
-                    storage.trie.insert(word)
-                storage.trie.add_document_to_word(word, doc_id, count)
+            storage._add_postings(doc_id, word_counts)
 
         return storage
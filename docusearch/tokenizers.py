@@ -0,0 +1,104 @@
+"""
+Tokenizers for splitting text into indexable words
+"""
+
+import re
+import unicodedata
+from collections.abc import Callable, Iterable
+from typing import List
+
+Tokenizer = Callable[[str], Iterable[str]]
+
+# A letter followed by two or more copies of itself
+_REPEATED_LETTER_RUN = re.compile(r"([^\W\d_])\1{2,}")
+
+# Identifiers in source code, and the words within them: acronyms before a
+# capitalized word (the HTTP in HTTPServer), capitalized or lowercase words,
+# and trailing acronyms
+_IDENTIFIER = re.compile(r"[A-Za-z_][A-Za-z0-9_]*")
+_IDENTIFIER_PART = re.compile(r"[A-Z]+(?=[A-Z][a-z])|[A-Z]?[a-z]+|[A-Z]+")
+
+# Words joined by single hyphens, like state-of-the-art
+_HYPHENATED = re.compile(r"\b[^\W\d_]+(?:-[^\W\d_]+)+\b")
+
+# Kana, CJK ideographs (including extension A and compatibility) and Hangul
+_CJK_OR_LATIN_RUN = re.compile(
+    r"([\u3040-\u30ff\u3400-\u4dbf\u4e00-\u9fff\uac00-\ud7af\uf900-\ufaff]+)"
+    r"|([a-zA-Z]+)"
+)
+
+
+def cjk_bigram_tokenize(text: str) -> List[str]:
+    """Split CJK text into overlapping character bigrams
+
+    Runs of Chinese, Japanese or Korean characters become overlapping
+    bigrams (or a single character for one-character runs), while Latin
+    words longer than one character are kept whole.
+    """
+    tokens = []
+    for cjk_run, latin_word in _CJK_OR_LATIN_RUN.findall(text.lower()):
+        if latin_word:
+            if len(latin_word) > 1:
+                tokens.append(latin_word)
+        elif len(cjk_run) == 1:
+            tokens.append(cjk_run)
+        else:
+            tokens.extend(cjk_run[i : i + 2] for i in range(len(cjk_run) - 1))
+    return tokens
+
+
+def code_tokenize(text: str) -> List[str]:
+    """Split source code into identifiers and the words they are made of
+
+    Each identifier is kept whole, lowercased, and followed by its parts
+    when it has more than one, so getUserName and get_user_name both also
+    give get, user and name. Digits only appear inside whole identifiers.
+    """
+    tokens = []
+    for identifier in _IDENTIFIER.findall(text):
+        identifier = identifier.strip("_")
+        parts = _IDENTIFIER_PART.findall(identifier)
+        if parts:
+            tokens.append(identifier.lower())
+        if len(parts) > 1:
+            tokens.extend(part.lower() for part in parts)
+    return tokens
+
+
+def fold_diacritics(text: str) -> str:
+    """Remove accents and other combining marks, so that café becomes cafe"""
+    return "".join(
+        char
+        for char in unicodedata.normalize("NFD", text)
+        if not unicodedata.combining(char)
+    )
+
+
+def normalize_width(text: str) -> str:
+    """Apply NFKC normalization, so that ｐｙｔｈｏｎ becomes python and ﬁ fi"""
+    return unicodedata.normalize("NFKC", text)
+
+
+def collapse_repeats(text: str) -> str:
+    """Shorten runs of three or more of the same letter to two letters
+
+    Elongations like "coooool" become "cool" while genuine double letters,
+    as in "book", are left alone.
+    """
+    return _REPEATED_LETTER_RUN.sub(r"\1\1", text)
+
+
+def join_hyphenated(text: str, keep_parts: bool = False) -> str:
+    """Join hyphenated words into one, so that co-operate becomes cooperate
+
+    With keep_parts, the joined word is followed by its parts separated by
+    spaces, so that both cooperate and operate can be found.
+    """
+
+    def join(match: re.Match) -> str:
+        joined = match.group().replace("-", "")
+        if keep_parts:
+            return f"{joined} {match.group().replace('-', ' ')}"
+        return joined
+
+    return _HYPHENATED.sub(join, text)
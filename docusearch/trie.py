@@ -2,8 +2,9 @@
 Trie data structure for efficient prefix searching
 """
 
-from collections.abc import MutableMapping
-from typing import Dict, List, Optional, Set
+import bisect
+from collections.abc import Callable, Iterable, Mapping, MutableMapping
+from typing import Any, Dict, List, Optional, Set
 
 
 class TrieNode:
@@ -22,6 +23,47 @@ class Trie:
 
     def __init__(self):
         self.root = TrieNode()
+        # Number of words, kept up to date so it can be read without a walk
+        self._word_count = 0
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Serialize the trie's nodes and document counts to nested dicts
+
+        Each node is {"children": {char: node}}, with a "documents" mapping of
+        document ID to word count on nodes that end a word.
+        """
+        return self._node_to_dict(self.root)
+
+    def _node_to_dict(self, node: TrieNode) -> Dict[str, Any]:
+        """Serialize a node and its descendants"""
+        data: Dict[str, Any] = {
+            "children": {
+                char: self._node_to_dict(child)
+                for char, child in node._children.items()
+            }
+        }
+        if node._is_end_of_word:
+            data["documents"] = dict(node._doc_to_word_count)
+        return data
+
+    @classmethod
+    def from_dict(cls, data: Mapping[str, Any]) -> "Trie":
+        """Build a trie from the output of to_dict without re-inserting words"""
+        trie = cls()
+        stack = [(trie.root, data, "")]
+        while stack:
+            node, node_data, word = stack.pop()
+            if "documents" in node_data:
+                node._is_end_of_word = True
+                node._word = word
+                trie._word_count += 1
+                node._doc_to_word_count = dict(node_data["documents"])
+                node._containing_documents = set(node._doc_to_word_count)
+            for char, child_data in node_data["children"].items():
+                child = TrieNode()
+                node._children[char] = child
+                stack.append((child, child_data, word + char))
+        return trie
 
     def insert(self, word: str) -> None:
         """Insert a word into the trie"""
@@ -30,6 +72,8 @@ class Trie:
             if char not in node._children:
                 node._children[char] = TrieNode()
             node = node._children[char]
+        if not node._is_end_of_word:
+            self._word_count += 1
         node._is_end_of_word = True
         node._word = word.lower()
 
@@ -41,14 +85,33 @@ class Trie:
             node._doc_to_word_count[doc_id] = count
 
     def remove_document_from_word(self, word: str, doc_id: str) -> bool:
-        """Remove a document from a word's document set"""
+        """Remove a document from a word's document set
+
+        Returns:
+            True if the document was removed and no documents contain the
+            word any more, so the word can be pruned with remove
+        """
         node = self._find_node(word.lower())
         if node and node._is_end_of_word:
             if doc_id in node._containing_documents:
                 node._containing_documents.remove(doc_id)
                 if doc_id in node._doc_to_word_count:
                     del node._doc_to_word_count[doc_id]
-                return True
+                return not node._containing_documents
+        return False
+
+    def rename_document_in_word(
+        self, word: str, old_doc_id: str, new_doc_id: str
+    ) -> bool:
+        """Move a word's count for a document to a new document ID"""
+        node = self._find_node(word.lower())
+        if node and node._is_end_of_word and old_doc_id in node._containing_documents:
+            node._containing_documents.remove(old_doc_id)
+            node._containing_documents.add(new_doc_id)
+            node._doc_to_word_count[new_doc_id] = node._doc_to_word_count.pop(
+                old_doc_id
+            )
+            return True
         return False
 
     def get_documents_for_word(self, word: str) -> Dict[str, int]:
@@ -71,7 +134,7 @@ class Trie:
         return node is not None and node._is_end_of_word
 
     def starts_with(self, prefix: str) -> List[str]:
-        """Find all words that start with the given prefix"""
+        """Find all words that start with the given prefix, sorted"""
         node = self._find_node(prefix.lower())
         if node is None:
             return []
@@ -80,6 +143,29 @@ class Trie:
         self._collect_words(node, words)
         return words
 
+    def starts_with_batch(self, prefixes: Iterable[str]) -> Dict[str, List[str]]:
+        """Find the words starting with each prefix, as starts_with would
+
+        The trie is only walked for prefixes not extending another of the
+        prefixes; the words for longer prefixes are sliced from the sorted
+        words of the shortest prefix they extend.
+        """
+        prefixes = list(prefixes)
+        prefix_to_words: Dict[str, List[str]] = {}
+        covering: Optional[str] = None
+        for prefix in sorted({prefix.lower() for prefix in prefixes}):
+            if covering is None or not prefix.startswith(covering):
+                covering = prefix
+                prefix_to_words[prefix] = self.starts_with(prefix)
+                continue
+            words = prefix_to_words[covering]
+            start = bisect.bisect_left(words, prefix)
+            end = start
+            while end < len(words) and words[end].startswith(prefix):
+                end += 1
+            prefix_to_words[prefix] = words[start:end]
+        return {prefix: list(prefix_to_words[prefix.lower()]) for prefix in prefixes}
+
     def get_documents_for_prefix(self, prefix: str) -> Dict[str, int]:
         """Get all documents containing words that start with the given prefix"""
         node = self._find_node(prefix.lower())
@@ -99,13 +185,76 @@ class Trie:
             node = node._children[char]
         return node
 
+    def words_in_range(self, low: str, high: str) -> List[str]:
+        """Find all words with low <= word < high, sorted"""
+        words: List[str] = []
+        self._collect_words_in_range(self.root, "", low.lower(), high.lower(), words)
+        return words
+
+    def _collect_words_in_range(
+        self, node: TrieNode, prefix: str, low: str, high: str, words: List[str]
+    ) -> None:
+        """Collect words in range from a node, skipping subtrees outside it"""
+        if node._is_end_of_word and node._word and low <= node._word < high:
+            words.append(node._word)
+
+        for key in sorted(node._children):
+            child = node._children[key]
+            child_prefix = prefix + self._edge_label(key, child)
+            # Every word below child_prefix is at least child_prefix, and
+            # later siblings are greater still
+            if child_prefix >= high:
+                break
+            # Every word below is less than low unless low continues the prefix
+            if child_prefix < low and not low.startswith(child_prefix):
+                continue
+            self._collect_words_in_range(child, child_prefix, low, high, words)
+
+    def fuzzy_search(self, word: str, max_distance: int) -> Dict[str, int]:
+        """Find all words within max_distance edits of word
+
+        Returns:
+            Dict mapping each matching word to its Levenshtein distance
+        """
+        word = word.lower()
+        matches: Dict[str, int] = {}
+        stack = [(self.root, list(range(len(word) + 1)))]
+        while stack:
+            node, row = stack.pop()
+            if node._is_end_of_word and node._word and row[-1] <= max_distance:
+                matches[node._word] = row[-1]
+
+            for key, child in node._children.items():
+                child_row = row
+                for char in self._edge_label(key, child):
+                    child_row = self._next_distance_row(child_row, char, word)
+                    # Distances only grow further down, so prune the branch
+                    if min(child_row) > max_distance:
+                        break
+                else:
+                    stack.append((child, child_row))
+        return matches
+
+    def _edge_label(self, key: str, child: TrieNode) -> str:
+        """Get the characters on the edge from a node to its child"""
+        return key
+
+    @staticmethod
+    def _next_distance_row(previous: List[int], char: str, word: str) -> List[int]:
+        """Extend a row of edit distances to word by one more trie character"""
+        row = [previous[0] + 1]
+        for i, word_char in enumerate(word, 1):
+            substitution_cost = previous[i - 1] + (word_char != char)
+            row.append(min(row[i - 1] + 1, previous[i] + 1, substitution_cost))
+        return row
+
     def _collect_words(self, node: TrieNode, words: List[str]) -> None:
-        """Collect all words from the given node and its descendants"""
+        """Collect all words from the given node and its descendants in sorted order"""
         if node._is_end_of_word and node._word:
             words.append(node._word)
 
-        for child in node._children.values():
-            self._collect_words(child, words)
+        for char in sorted(node._children):
+            self._collect_words(node._children[char], words)
 
     def _collect_documents_from_node(
         self, node: TrieNode, doc_counts: Dict[str, int]
@@ -132,6 +281,7 @@ class Trie:
                 return False
             node._is_end_of_word = False
             node._word = None
+            self._word_count -= 1
             return len(node._children) == 0
 
         char = word[index]
@@ -146,19 +296,273 @@ class Trie:
 
         return False
 
+    def get_unique_word_count(self) -> int:
+        """Get the number of words in the trie without walking it"""
+        return self._word_count
+
+    def get_node_count(self) -> int:
+        """Get the number of nodes in the trie, including the root"""
+        count = 0
+        nodes = [self.root]
+        while nodes:
+            node = nodes.pop()
+            count += 1
+            nodes.extend(node._children.values())
+        return count
+
+    def get_max_depth(self) -> int:
+        """Get the length of the longest path from the root to a leaf node"""
+        max_depth = 0
+        nodes = [(self.root, 0)]
+        while nodes:
+            node, depth = nodes.pop()
+            max_depth = max(max_depth, depth)
+            nodes.extend((child, depth + 1) for child in node._children.values())
+        return max_depth
+
     def get_all_words(self) -> List[str]:
-        """Get all words stored in the trie"""
+        """Get all words stored in the trie, sorted"""
         words = []
         self._collect_words(self.root, words)
         return words
 
+    def for_each_word(self, callback: Callable[[str, int], bool]) -> None:
+        """Call callback with each word and its document frequency in sorted order
+
+        Traversal stops early when callback returns False. Words are visited
+        without first collecting them into a list.
+        """
+        stack = [self.root]
+        while stack:
+            node = stack.pop()
+            if node._is_end_of_word and node._word:
+                if callback(node._word, len(node._containing_documents)) is False:
+                    return
+            stack.extend(
+                node._children[key] for key in sorted(node._children, reverse=True)
+            )
+
+    def get_all_words_with_frequency(self) -> Dict[str, int]:
+        """Get all words stored in the trie with their document frequencies"""
+        word_to_freq: Dict[str, int] = {}
+        self._collect_word_frequencies(self.root, word_to_freq)
+        return word_to_freq
+
+    def _collect_word_frequencies(
+        self, node: TrieNode, word_to_freq: Dict[str, int]
+    ) -> None:
+        """Collect the document frequency of each word from the given node down"""
+        if node._is_end_of_word and node._word:
+            word_to_freq[node._word] = len(node._containing_documents)
+
+        for child in node._children.values():
+            self._collect_word_frequencies(child, word_to_freq)
+
     def cleanup_empty_words(self) -> None:
         """Remove words that have no documents"""
-        words_to_remove = []
-        for word in self.get_all_words():
-            node = self._find_node(word)
-            if node and len(node._containing_documents) == 0:
-                words_to_remove.append(word)
+        words_to_remove = [
+            word
+            for word, freq in self.get_all_words_with_frequency().items()
+            if freq == 0
+        ]
 
         for word in words_to_remove:
             self.remove(word)
+
+
+class RadixTrieNode(TrieNode):
+    """A node in the radix trie, reached by an edge labeled with a substring"""
+
+    def __init__(self, label: str = ""):
+        super().__init__()
+        self._label: str = label
+
+
+class RadixTrie(Trie):
+    """Trie that collapses non-branching chains of nodes into single edges
+
+    Children are keyed by the first character of their edge label, so lookups
+    cost the same as in Trie while storing far fewer nodes for long words.
+    """
+
+    def __init__(self):
+        self.root = RadixTrieNode()
+        self._word_count = 0
+
+    def _node_to_dict(self, node: TrieNode) -> Dict[str, Any]:
+        """Serialize a node and its descendants, keyed by edge label"""
+        data: Dict[str, Any] = {
+            "children": {
+                child._label: self._node_to_dict(child)
+                for child in node._children.values()
+            }
+        }
+        if node._is_end_of_word:
+            data["documents"] = dict(node._doc_to_word_count)
+        return data
+
+    @classmethod
+    def from_dict(cls, data: Mapping[str, Any]) -> "RadixTrie":
+        """Build a radix trie from the output of to_dict without re-inserting words"""
+        trie = cls()
+        stack = [(trie.root, data, "")]
+        while stack:
+            node, node_data, word = stack.pop()
+            if "documents" in node_data:
+                node._is_end_of_word = True
+                node._word = word
+                trie._word_count += 1
+                node._doc_to_word_count = dict(node_data["documents"])
+                node._containing_documents = set(node._doc_to_word_count)
+            for label, child_data in node_data["children"].items():
+                child = RadixTrieNode(label)
+                node._children[label[0]] = child
+                stack.append((child, child_data, word + label))
+        return trie
+
+    def insert(self, word: str) -> None:
+        """Insert a word into the trie, splitting an edge if needed"""
+        word = word.lower()
+        node = self.root
+        index = 0
+        while index < len(word):
+            child = node._children.get(word[index])
+            if child is None:
+                node._children[word[index]] = self._new_word_node(word, index)
+                self._word_count += 1
+                return
+
+            common = self._common_prefix_length(child._label, word, index)
+            if common < len(child._label):
+                child = self._split_edge(node, child, common)
+            node = child
+            index += common
+
+        if not node._is_end_of_word:
+            self._word_count += 1
+        node._is_end_of_word = True
+        node._word = word
+
+    def _new_word_node(self, word: str, index: int) -> RadixTrieNode:
+        """Create a leaf node holding the remainder of a word"""
+        node = RadixTrieNode(word[index:])
+        node._is_end_of_word = True
+        node._word = word
+        return node
+
+    @staticmethod
+    def _common_prefix_length(label: str, word: str, index: int) -> int:
+        """Count the leading characters an edge label shares with word[index:]"""
+        length = 0
+        while (
+            length < len(label)
+            and index + length < len(word)
+            and label[length] == word[index + length]
+        ):
+            length += 1
+        return length
+
+    @staticmethod
+    def _split_edge(
+        parent: TrieNode, child: RadixTrieNode, length: int
+    ) -> RadixTrieNode:
+        """Split a child's edge after length characters, returning the new node"""
+        middle = RadixTrieNode(child._label[:length])
+        child._label = child._label[length:]
+        middle._children[child._label[0]] = child
+        parent._children[middle._label[0]] = middle
+        return middle
+
+    def _edge_label(self, key: str, child: TrieNode) -> str:
+        """Get the characters on the edge from a node to its child"""
+        return child._label
+
+    def _find_node(self, prefix: str) -> Optional[TrieNode]:
+        """Find the node whose path spells exactly the given prefix"""
+        node = self.root
+        index = 0
+        while index < len(prefix):
+            child = node._children.get(prefix[index])
+            if child is None or not prefix.startswith(child._label, index):
+                return None
+            node = child
+            index += len(child._label)
+        return node
+
+    def _find_prefix_node(self, prefix: str) -> Optional[TrieNode]:
+        """Find the highest node whose path starts with the given prefix"""
+        node = self.root
+        index = 0
+        while index < len(prefix):
+            child = node._children.get(prefix[index])
+            if child is None:
+                return None
+            remaining = prefix[index:]
+            if not (
+                remaining.startswith(child._label)
+                or child._label.startswith(remaining)
+            ):
+                return None
+            node = child
+            index += len(child._label)
+        return node
+
+    def starts_with(self, prefix: str) -> List[str]:
+        """Find all words that start with the given prefix, sorted"""
+        node = self._find_prefix_node(prefix.lower())
+        if node is None:
+            return []
+
+        words = []
+        self._collect_words(node, words)
+        return words
+
+    def get_documents_for_prefix(self, prefix: str) -> Dict[str, int]:
+        """Get all documents containing words that start with the given prefix"""
+        node = self._find_prefix_node(prefix.lower())
+        if node is None:
+            return {}
+
+        doc_counts: MutableMapping[str, int] = {}
+        self._collect_documents_from_node(node, doc_counts)
+        return doc_counts
+
+    def remove(self, word: str) -> bool:
+        """Remove a word from the trie (only if no documents contain it)"""
+        word = word.lower()
+        path: List[TrieNode] = [self.root]
+        index = 0
+        while index < len(word):
+            child = path[-1]._children.get(word[index])
+            if child is None or not word.startswith(child._label, index):
+                return False
+            path.append(child)
+            index += len(child._label)
+
+        node = path[-1]
+        if not node._is_end_of_word or node._containing_documents:
+            return False
+
+        node._is_end_of_word = False
+        node._word = None
+        self._word_count -= 1
+        if len(path) > 1 and not node._children:
+            parent = path[-2]
+            del parent._children[node._label[0]]
+            self._merge_with_only_child(parent)
+        else:
+            self._merge_with_only_child(node)
+        return True
+
+    def _merge_with_only_child(self, node: TrieNode) -> None:
+        """Absorb a non-word node's only child into its edge"""
+        if node is self.root or node._is_end_of_word or len(node._children) != 1:
+            return
+
+        (child,) = node._children.values()
+        node._label += child._label
+        node._is_end_of_word = child._is_end_of_word
+        node._word = child._word
+        node._containing_documents = child._containing_documents
+        node._doc_to_word_count = child._doc_to_word_count
+        node._children = child._children
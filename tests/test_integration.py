@@ -3,9 +3,20 @@
 Integration tests for DocuSearch
 """
 
+import codecs
+import csv
+import json
+import os
+import re
+import threading
+import zipfile
+
 import pytest
+from click.testing import CliRunner
 
-from docusearch import DocumentStorage
+from docusearch import DocumentStorage, IngestionCancelled
+from docusearch.cli import main, repl
+from docusearch.storage import STORAGE_FORMAT_VERSION
 
 
 class TestDocumentStorageIntegration:
@@ -275,3 +286,1103 @@ class TestDocumentStorageIntegration:
         assert doc_info_after is None
         final_stats = storage.get_stats()
         assert final_stats["total_documents"] == 0
+
+
+def _write_docx(file_path, paragraphs):
+    """Write a minimal .docx file containing the given paragraphs"""
+    namespace = "http://schemas.openxmlformats.org/wordprocessingml/2006/main"
+    body = "".join(f"<w:p><w:r><w:t>{text}</w:t></w:r></w:p>" for text in paragraphs)
+    with zipfile.ZipFile(file_path, "w") as archive:
+        archive.writestr(
+            "word/document.xml",
+            f'<w:document xmlns:w="{namespace}"><w:body>{body}</w:body></w:document>',
+        )
+
+
+def _write_pdf(file_path, text):
+    """Write a minimal single-page PDF file containing the given text"""
+    stream = f"BT /F1 12 Tf 72 720 Td ({text}) Tj ET".encode()
+    objects = [
+        b"<< /Type /Catalog /Pages 2 0 R >>",
+        b"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+        b"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] "
+        b"/Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+        b"<< /Length %d >>\nstream\n%s\nendstream" % (len(stream), stream),
+        b"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+    ]
+
+    output = b"%PDF-1.4\n"
+    offsets = []
+    for number, obj in enumerate(objects, 1):
+        offsets.append(len(output))
+        output += b"%d 0 obj\n%s\nendobj\n" % (number, obj)
+
+    xref_offset = len(output)
+    output += b"xref\n0 %d\n0000000000 65535 f \n" % (len(objects) + 1)
+    for offset in offsets:
+        output += b"%010d 00000 n \n" % offset
+    output += b"trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n" % (
+        len(objects) + 1,
+        xref_offset,
+    )
+    file_path.write_bytes(output)
+
+
+class TestContentExtractors:
+    """Integration tests for extracting text from non-plain-text files"""
+
+    @pytest.fixture
+    def storage(self):
+        """Create a fresh DocumentStorage instance for each test"""
+        return DocumentStorage()
+
+    def test_add_docx_file(self, storage, tmp_path):
+        """Test that text in a .docx file becomes searchable"""
+        file_path = tmp_path / "report.docx"
+        _write_docx(file_path, ["Quarterly revenue report", "Growth was strong"])
+
+        doc_ids = storage.add_document_from_path(str(file_path))
+
+        results = storage.search("revenue growth")
+        assert [doc_id for doc_id, _, _ in results] == doc_ids
+
+    def test_add_pdf_file(self, storage, tmp_path):
+        """Test that text in a .pdf file becomes searchable"""
+        pytest.importorskip("pypdf")
+        file_path = tmp_path / "invoice.pdf"
+        _write_pdf(file_path, "Outstanding invoice balance")
+
+        doc_ids = storage.add_document_from_path(str(file_path))
+
+        results = storage.search("invoice")
+        assert [doc_id for doc_id, _, _ in results] == doc_ids
+
+    def test_directory_includes_documents(self, storage, tmp_path):
+        """Test that directories pick up .docx files alongside text files"""
+        (tmp_path / "notes.txt").write_text("Meeting notes about revenue")
+        _write_docx(tmp_path / "report.docx", ["Quarterly revenue report"])
+        (tmp_path / "image.png").write_bytes(b"\x89PNG")
+
+        doc_ids = storage.add_document_from_path(str(tmp_path))
+
+        assert len(doc_ids) == 2
+        assert len(storage.search("revenue")) == 2
+
+    def test_extraction_failure_warns_and_continues(self, storage, tmp_path, capsys):
+        """Test that a broken file is skipped with a warning"""
+        (tmp_path / "notes.txt").write_text("Meeting notes")
+        (tmp_path / "broken.docx").write_bytes(b"not a zip file")
+
+        doc_ids = storage.add_document_from_path(str(tmp_path))
+
+        assert doc_ids == [str(tmp_path / "notes.txt")]
+        assert "Warning: Could not add" in capsys.readouterr().out
+
+    def test_register_custom_extractor(self, storage, tmp_path):
+        """Test that custom extractors are used for their extension"""
+        (tmp_path / "data.rev").write_text("desrever")
+        storage.register_extractor(".REV", lambda path: path.read_text()[::-1])
+
+        doc_ids = storage.add_document_from_path(str(tmp_path))
+
+        assert len(doc_ids) == 1
+        assert storage.search("reversed")[0][0] == doc_ids[0]
+
+    def test_extracted_text_is_cached(self, tmp_path):
+        """Test that unchanged files reuse cached text and changed ones do not"""
+        calls = []
+
+        def extractor(path):
+            calls.append(path)
+            return path.read_text()[::-1]
+
+        file_path = tmp_path / "docs" / "data.rev"
+        file_path.parent.mkdir()
+        file_path.write_text("desrever")
+        cache_dir = tmp_path / "cache"
+
+        for _ in range(2):
+            storage = DocumentStorage(cache_dir=cache_dir)
+            storage.register_extractor(".rev", extractor)
+            [doc_id] = storage.add_document_from_path(str(file_path))
+            assert storage.search("reversed")[0][0] == doc_id
+        assert len(calls) == 1
+
+        file_path.write_text("degnahc")
+        stat = file_path.stat()
+        os.utime(file_path, ns=(stat.st_atime_ns, stat.st_mtime_ns + 10**9))
+        storage.remove_document(doc_id)
+        storage.add_document_from_path(str(file_path))
+
+        assert len(calls) == 2
+        assert storage.search("changed")[0][0] == doc_id
+
+
+class TestByteOrderMarks:
+    """Test reading text files that start with a byte order mark"""
+
+    @pytest.mark.parametrize("encoding", ["utf-8-sig", "utf-16-le", "utf-16-be"])
+    def test_first_word_searchable(self, tmp_path, encoding):
+        """Test that the first word is indexed without the byte order mark"""
+        bom = {
+            "utf-8-sig": b"",
+            "utf-16-le": codecs.BOM_UTF16_LE,
+            "utf-16-be": codecs.BOM_UTF16_BE,
+        }[encoding]
+        file_path = tmp_path / "bom.txt"
+        file_path.write_bytes(bom + "Hello world\nfrom Windows".encode(encoding))
+
+        storage = DocumentStorage()
+        doc_id = storage.add_document_from_path(file_path)[0]
+
+        content = storage.get_document_info(doc_id)["content"]
+        assert content == "Hello world\nfrom Windows"
+        assert storage.search("hello")[0][0] == doc_id
+
+
+class TestConcurrentDirectoryIngestion:
+    """Integration tests for adding directories with a worker pool"""
+
+    @pytest.fixture
+    def generated_dir(self, tmp_path):
+        """Create a directory tree of generated text files"""
+        words = ["python", "java", "rust", "search", "index", "trie", "query"]
+        for i in range(60):
+            subdir = tmp_path / f"group_{i % 4}"
+            subdir.mkdir(exist_ok=True)
+            content = " ".join(words[(i + j) % len(words)] for j in range(i % 5 + 3))
+            (subdir / f"file_{i}.txt").write_text(f"{content} document{i}")
+        return tmp_path
+
+    def test_concurrent_matches_sequential(self, generated_dir):
+        """Test that concurrent ingestion indexes the same documents"""
+        sequential = DocumentStorage()
+        sequential_ids = sequential.add_document_from_path(
+            str(generated_dir), max_workers=1
+        )
+
+        concurrent = DocumentStorage()
+        concurrent_ids = concurrent.add_document_from_path(
+            str(generated_dir), max_workers=8
+        )
+
+        assert len(concurrent_ids) == len(set(concurrent_ids)) == 60
+        assert sorted(concurrent_ids) == sorted(sequential_ids)
+        assert concurrent.get_stats() == sequential.get_stats()
+        assert concurrent.search("python trie", top_k=60) == sequential.search(
+            "python trie", top_k=60
+        )
+
+    def test_read_ahead_is_bounded(self, generated_dir):
+        """Test that no more than twice the workers' files wait to be indexed"""
+        storage = DocumentStorage()
+        read_and_tokenize = storage._read_and_tokenize
+        index_document = storage._index_document
+        waiting = []
+        max_waiting = []
+        lock = threading.Lock()
+
+        def counting_read(file_path):
+            result = read_and_tokenize(file_path)
+            with lock:
+                waiting.append(file_path)
+                max_waiting.append(len(waiting))
+            return result
+
+        def counting_index(doc_id, *args, **kwargs):
+            with lock:
+                waiting.pop()
+            return index_document(doc_id, *args, **kwargs)
+
+        storage._read_and_tokenize = counting_read
+        storage._index_document = counting_index
+        added = storage.add_document_from_path(str(generated_dir), max_workers=2)
+
+        assert len(added) == 60
+        assert max(max_waiting) <= 4
+
+
+class TestDirectoryFiltering:
+    """Integration tests for extension and recursion options when adding directories"""
+
+    @pytest.fixture
+    def nested_dir(self, tmp_path):
+        """Create a directory with top-level and nested files"""
+        (tmp_path / "top.md").write_text("Top level markdown notes")
+        (tmp_path / "analysis.ipynb").write_text('{"cells": ["notebook analysis"]}')
+        (tmp_path / "script.py").write_text("print('python script')")
+        nested = tmp_path / "nested"
+        nested.mkdir()
+        (nested / "deep.md").write_text("Nested markdown notes")
+        return tmp_path
+
+    @pytest.fixture
+    def storage(self):
+        """Create a fresh DocumentStorage instance for each test"""
+        return DocumentStorage()
+
+    def test_custom_extensions(self, storage, nested_dir):
+        """Test that only explicitly listed extensions are added"""
+        doc_ids = storage.add_document_from_path(
+            str(nested_dir), extensions=[".md", " IPYNB "]
+        )
+
+        assert sorted(doc_ids) == sorted(
+            str(nested_dir / name)
+            for name in ["top.md", "analysis.ipynb", "nested/deep.md"]
+        )
+        assert storage.search("notebook")[0][0] == str(nested_dir / "analysis.ipynb")
+
+    def test_cli_extensions_with_spaces(self, nested_dir, tmp_path):
+        """Test that spaces after commas in --extensions are ignored"""
+        storage_file = tmp_path / "storage.json"
+        result = CliRunner().invoke(
+            main,
+            [
+                "add",
+                str(nested_dir),
+                "--extensions",
+                ".md, .ipynb",
+                "--no-recursive",
+                "-s",
+                str(storage_file),
+            ],
+        )
+
+        assert result.exit_code == 0, result.output
+        assert "Added 2 documents from directory" in result.output
+        assert str(nested_dir / "analysis.ipynb") in result.output
+
+    def test_no_recursion(self, storage, nested_dir):
+        """Test that nested files are skipped when recursion is disabled"""
+        doc_ids = storage.add_document_from_path(str(nested_dir), recursive=False)
+
+        assert sorted(doc_ids) == sorted(
+            str(nested_dir / name) for name in ["top.md", "script.py"]
+        )
+
+    @pytest.mark.parametrize("follow_symlinks", [False, True])
+    def test_symlink_cycle_terminates(self, nested_dir, follow_symlinks):
+        """Test that a link back to an ancestor directory is walked at most once"""
+        (nested_dir / "nested" / "loop").symlink_to(nested_dir)
+        storage = DocumentStorage(follow_symlinks=follow_symlinks)
+
+        doc_ids = storage.add_document_from_path(str(nested_dir))
+
+        assert sorted(doc_ids) == sorted(
+            str(nested_dir / name)
+            for name in ["top.md", "script.py", "nested/deep.md"]
+        )
+
+    def test_follow_symlinks(self, tmp_path):
+        """Test that linked directories are only added when following links"""
+        root = tmp_path / "root"
+        linked = tmp_path / "linked"
+        root.mkdir()
+        linked.mkdir()
+        (root / "own.md").write_text("Own markdown notes")
+        (linked / "shared.md").write_text("Shared markdown notes")
+        (root / "link").symlink_to(linked)
+
+        default_ids = DocumentStorage().add_document_from_path(str(root))
+        following_ids = DocumentStorage(follow_symlinks=True).add_document_from_path(
+            str(root)
+        )
+
+        assert default_ids == [str(root / "own.md")]
+        assert sorted(following_ids) == [
+            str(root / "link" / "shared.md"),
+            str(root / "own.md"),
+        ]
+
+    def test_max_depth(self, nested_dir):
+        """Test that directories below max_depth are skipped"""
+        deeper = nested_dir / "nested" / "deeper"
+        deeper.mkdir()
+        (deeper / "deepest.md").write_text("Deepest markdown notes")
+
+        doc_ids = DocumentStorage(max_depth=1).add_document_from_path(str(nested_dir))
+
+        assert str(nested_dir / "nested" / "deep.md") in doc_ids
+        assert str(deeper / "deepest.md") not in doc_ids
+
+
+class TestPersistence:
+    """Integration tests for saving and loading storage"""
+
+    @pytest.fixture
+    def storage(self, sample_documents):
+        """Create a DocumentStorage instance with sample documents"""
+        storage = DocumentStorage()
+        for doc_id, content in sample_documents.items():
+            storage.add_document(content, doc_id)
+        return storage
+
+    @pytest.mark.parametrize("include_trie", [False, True])
+    def test_save_and_load(self, storage, tmp_path, include_trie):
+        """Test that a loaded storage returns identical search results"""
+        file_path = tmp_path / "storage.json"
+        storage.save(file_path, include_trie=include_trie)
+
+        loaded = DocumentStorage.load(file_path)
+
+        for query in ["programming", "web development", "data science"]:
+            assert loaded.search(query) == storage.search(query)
+        assert loaded.prefix_search("d") == storage.prefix_search("d")
+        assert loaded.get_stats() == storage.get_stats()
+        assert loaded.trie.to_dict() == storage.trie.to_dict()
+
+    def test_compact_save_and_load(self, sample_documents, tmp_path):
+        """Test that a compact file is smaller and loads the same storage"""
+        storage = DocumentStorage(deduplicate_by_content=True)
+        for doc_id, content in sample_documents.items():
+            storage.add_document(content, doc_id)
+        storage.save(tmp_path / "full.json")
+        storage.save(tmp_path / "compact.json", compact=True)
+
+        loaded = DocumentStorage.load(tmp_path / "compact.json", strict=True)
+
+        assert (tmp_path / "compact.json").stat().st_size < (
+            tmp_path / "full.json"
+        ).stat().st_size
+        data = json.loads((tmp_path / "compact.json").read_text())
+        assert "trie" not in data
+        assert "doc_lengths" not in data["forward_index"]
+        for query in ["programming", "web development", "data science"]:
+            assert loaded.search(query) == storage.search(query)
+        assert loaded.get_stats() == storage.get_stats()
+        assert loaded.trie.to_dict() == storage.trie.to_dict()
+        assert loaded.add_document(sample_documents["doc1"]) == "doc1"
+
+    def test_compact_save_keeps_content_hashes_without_contents(
+        self, sample_documents, tmp_path
+    ):
+        """Test that dropped contents do not turn into empty-content hashes"""
+        storage = DocumentStorage(deduplicate_by_content=True)
+        for doc_id, content in sample_documents.items():
+            storage.add_document(content, doc_id)
+        storage.drop_contents()
+        storage.save(tmp_path / "compact.json", compact=True)
+
+        loaded = DocumentStorage.load(tmp_path / "compact.json")
+
+        assert loaded._content_hash_to_doc_id == storage._content_hash_to_doc_id
+        assert loaded.add_document(sample_documents["doc1"]) == "doc1"
+        assert loaded.add_document("Unrelated text about gardening", "new") == "new"
+
+    def test_compact_save_rejects_trie(self, storage, tmp_path):
+        """Test that a compact file cannot also include the trie"""
+        with pytest.raises(ValueError, match="cannot include the trie"):
+            storage.save(tmp_path / "storage.json", include_trie=True, compact=True)
+
+    def test_save_with_trie_serializes_nodes(self, storage, tmp_path):
+        """Test that the trie is only written when requested"""
+        file_path = tmp_path / "storage.json"
+
+        storage.save(file_path)
+        assert "trie" not in json.loads(file_path.read_text())
+
+        storage.save(file_path, include_trie=True)
+        assert "trie" in json.loads(file_path.read_text())
+
+    def test_document_boosts_persist(self, storage, tmp_path):
+        """Test that document boosts survive save and load"""
+        storage.set_document_boost("doc2", 4)
+        file_path = tmp_path / "storage.json"
+        storage.save(file_path)
+
+        loaded = DocumentStorage.load(file_path)
+        assert loaded.get_document_boost("doc2") == 4
+        assert loaded.search("programming") == storage.search("programming")
+
+    def test_loaded_trie_supports_updates(self, storage, tmp_path):
+        """Test that a storage loaded with its trie can be modified"""
+        file_path = tmp_path / "storage.json"
+        storage.save(file_path, include_trie=True)
+
+        loaded = DocumentStorage.load(file_path)
+        loaded.remove_document("doc1")
+        loaded.add_document("Python scripting", "doc5")
+
+        storage.remove_document("doc1")
+        storage.add_document("Python scripting", "doc5")
+        assert loaded.search("python") == storage.search("python")
+        assert loaded.trie.to_dict() == storage.trie.to_dict()
+
+    def test_current_version_written_and_loaded(self, storage, tmp_path):
+        """Test that saved files carry the format version and load back"""
+        file_path = tmp_path / "storage.json"
+        storage.save(file_path)
+
+        assert json.loads(file_path.read_text())["version"] == STORAGE_FORMAT_VERSION
+        assert DocumentStorage.load(file_path).get_stats() == storage.get_stats()
+
+    def test_load_legacy_file(self, tmp_path):
+        """Test that a version 0 file with only a forward index loads"""
+        file_path = tmp_path / "storage.json"
+        file_path.write_text(
+            json.dumps(
+                {
+                    "documents": {"doc1": "python code", "doc2": "java code"},
+                    "doc_counter": 2,
+                    "forward_index": {
+                        "documents": {
+                            "doc1": {"python": 1, "code": 1},
+                            "doc2": {"java": 1, "code": 1},
+                        }
+                    },
+                }
+            )
+        )
+
+        loaded = DocumentStorage.load(file_path)
+
+        stats = loaded.get_stats()
+        assert stats["total_documents"] == 2
+        assert stats["total_documents_in_index"] == 2
+        assert stats["average_document_length"] == 2
+        assert [doc_id for doc_id, _, _ in loaded.search("python")] == ["doc1"]
+
+    def test_load_legacy_file_with_only_documents(self, tmp_path):
+        """Test that a version 0 file without a forward index is reindexed"""
+        file_path = tmp_path / "storage.json"
+        file_path.write_text(json.dumps({"documents": {"doc1": "python code"}}))
+
+        loaded = DocumentStorage.load(file_path)
+
+        assert loaded.get_stats()["total_documents"] == 1
+        assert loaded.get_word_count("doc1", "python") == 1
+
+    def test_load_newer_version_fails(self, tmp_path):
+        """Test that a file from a newer format version is rejected"""
+        file_path = tmp_path / "storage.json"
+        file_path.write_text(
+            json.dumps({"version": STORAGE_FORMAT_VERSION + 1, "documents": {}})
+        )
+
+        with pytest.raises(ValueError, match="newer"):
+            DocumentStorage.load(file_path)
+
+    def test_strict_load_accepts_saved_file(self, storage, tmp_path):
+        """Test that a file written by save passes the strict checks"""
+        file_path = tmp_path / "storage.json"
+        storage.save(file_path)
+
+        loaded = DocumentStorage.load(file_path, strict=True)
+
+        assert loaded.get_stats() == storage.get_stats()
+
+    @pytest.mark.parametrize(
+        "change, message",
+        [
+            (
+                lambda data: data["documents"].pop("doc2"),
+                "Forward index has unknown document 'doc2'",
+            ),
+            (
+                lambda data: data["forward_index"]["documents"]["doc1"].update(
+                    python=100
+                ),
+                "Length of document 'doc1' is",
+            ),
+            (
+                lambda data: data.update(total_documents=100),
+                "Total documents is 100 but there are",
+            ),
+            (
+                lambda data: data["documents"].update(ghost="Hello"),
+                "Document 'ghost' is missing from the forward index",
+            ),
+        ],
+    )
+    def test_strict_load_reports_inconsistency(
+        self, storage, tmp_path, change, message
+    ):
+        """Test that strict loading names the inconsistency in a file"""
+        file_path = tmp_path / "storage.json"
+        storage.save(file_path)
+        data = json.loads(file_path.read_text())
+        change(data)
+        file_path.write_text(json.dumps(data))
+
+        with pytest.raises(ValueError, match=re.escape(message)):
+            DocumentStorage.load(file_path, strict=True)
+        DocumentStorage.load(file_path)
+
+    def test_strict_load_checks_saved_trie(self, storage, tmp_path):
+        """Test that a saved trie posting for an unknown document is rejected"""
+        file_path = tmp_path / "storage.json"
+        storage.add_document("hello world", "greeting")
+        storage.save(file_path, include_trie=True)
+        data = json.loads(file_path.read_text())
+        node = data["trie"]
+        for char in "hello":
+            node = node["children"][char]
+        node["documents"]["ghost"] = 1
+        file_path.write_text(json.dumps(data))
+
+        with pytest.raises(ValueError, match="posting of 'hello' for document 'ghost'"):
+            DocumentStorage.load(file_path, strict=True)
+
+
+class TestDirectoryErrors:
+    """Test reporting files that could not be added from a directory"""
+
+    @pytest.fixture
+    def dir_with_broken_file(self, tmp_path):
+        (tmp_path / "good.txt").write_text("Python programming")
+        (tmp_path / "broken.docx").write_text("not a zip archive")
+        return tmp_path
+
+    def test_errors_are_returned(self, dir_with_broken_file):
+        """Test that a failing file is reported while the rest are added"""
+        storage = DocumentStorage()
+
+        doc_ids, errors = storage.add_document_from_path_with_errors(
+            str(dir_with_broken_file)
+        )
+
+        assert doc_ids == [str(dir_with_broken_file / "good.txt")]
+        assert [error.path for error in errors] == [
+            str(dir_with_broken_file / "broken.docx")
+        ]
+        assert "zip" in errors[0].reason
+
+    def test_errors_are_printed(self, dir_with_broken_file, capsys):
+        """Test that add_document_from_path still warns about failing files"""
+        storage = DocumentStorage()
+
+        doc_ids = storage.add_document_from_path(str(dir_with_broken_file))
+
+        assert doc_ids == [str(dir_with_broken_file / "good.txt")]
+        output = capsys.readouterr().out
+        assert "Could not add" in output
+        assert "broken.docx" in output
+
+
+class TestIngestionProgress:
+    """Test progress reporting and cancellation when adding a directory"""
+
+    @pytest.fixture
+    def many_files(self, tmp_path):
+        for i in range(10):
+            (tmp_path / f"doc{i}.txt").write_text(f"Document number {i} about python")
+        return tmp_path
+
+    def test_progress_reported_per_file(self, many_files):
+        """Test that progress is reported after every file"""
+        storage = DocumentStorage()
+        progress = []
+
+        def on_progress(done, total):
+            progress.append((done, total))
+
+        doc_ids, errors = storage.add_document_from_path_with_errors(
+            str(many_files), on_progress=on_progress
+        )
+
+        assert len(doc_ids) == 10
+        assert errors == []
+        assert progress == [(done, 10) for done in range(1, 11)]
+
+    def test_cancel_after_some_files(self, many_files):
+        """Test that cancelling stops ingestion and keeps the files added so far"""
+        storage = DocumentStorage()
+        cancel = threading.Event()
+
+        def on_progress(done, total):
+            if done == 3:
+                cancel.set()
+
+        with pytest.raises(IngestionCancelled, match="cancelled") as exc_info:
+            storage.add_document_from_path_with_errors(
+                str(many_files), on_progress=on_progress, cancel=cancel
+            )
+
+        assert len(exc_info.value.doc_ids) == 3
+        assert storage.get_stats()["total_documents"] == 3
+        assert len(storage.search("python", top_k=10)) == 3
+
+    def test_timeout(self, many_files):
+        """Test that an expired timeout stops ingestion before any file"""
+        storage = DocumentStorage()
+
+        with pytest.raises(IngestionCancelled, match="timed out") as exc_info:
+            storage.add_document_from_path_with_errors(str(many_files), timeout=0)
+
+        assert exc_info.value.doc_ids == []
+        assert storage.get_stats()["total_documents"] == 0
+
+
+class TestCSVLoader:
+    """Test adding one document per row of a CSV file"""
+
+    @pytest.fixture
+    def csv_file(self, tmp_path):
+        file_path = tmp_path / "articles.csv"
+        file_path.write_text(
+            "id,title,body\n"
+            'a1,Python,"Python is great, for scripting"\n'
+            "a2,Rust,Rust offers memory safety\n"
+            ",Go,Go has goroutines\n"
+        )
+        return file_path
+
+    def test_one_document_per_row(self, csv_file):
+        """Test that each row becomes a document with its ID and content"""
+        storage = DocumentStorage()
+
+        doc_ids = storage.add_documents_from_csv(
+            str(csv_file), content_column=2, id_column=0, has_header=True
+        )
+
+        assert doc_ids[:2] == ["a1", "a2"]
+        assert doc_ids[2].startswith("doc_")
+        assert storage.search("scripting")[0][0] == "a1"
+        assert storage.search("memory")[0][0] == "a2"
+        assert storage.search("goroutines")[0][0] == doc_ids[2]
+        assert storage.get_document_info("a1")["content"] == (
+            "Python is great, for scripting"
+        )
+
+    def test_generated_ids_without_id_column(self, csv_file):
+        """Test that IDs are generated when no ID column is given"""
+        storage = DocumentStorage()
+
+        doc_ids = storage.add_documents_from_csv(str(csv_file), content_column=1)
+
+        assert len(doc_ids) == 4
+        assert all(doc_id.startswith("doc_") for doc_id in doc_ids)
+
+    def test_malformed_rows_skipped(self, tmp_path, capsys):
+        """Test that short rows and duplicate IDs are skipped with warnings"""
+        file_path = tmp_path / "bad.csv"
+        file_path.write_text("a1,Python scripting\nshort\na1,Duplicate\na2,Rust\n")
+        storage = DocumentStorage()
+
+        doc_ids = storage.add_documents_from_csv(
+            str(file_path), content_column=1, id_column=0
+        )
+
+        assert doc_ids == ["a1", "a2"]
+        output = capsys.readouterr().out
+        assert "Skipping CSV line 2" in output
+        assert "Skipping CSV line 3" in output
+
+    def test_byte_order_mark_removed(self, tmp_path):
+        """Test that a UTF-8 byte order mark does not become part of an ID"""
+        file_path = tmp_path / "excel.csv"
+        file_path.write_bytes(codecs.BOM_UTF8 + b"a1,Python scripting\na2,Rust\n")
+        storage = DocumentStorage()
+
+        doc_ids = storage.add_documents_from_csv(
+            str(file_path), content_column=1, id_column=0
+        )
+
+        assert doc_ids == ["a1", "a2"]
+
+    def test_rows_rejected_by_reader_skipped(self, tmp_path, capsys):
+        """Test that a field over the CSV size limit skips only its row"""
+        file_path = tmp_path / "huge.csv"
+        huge_field = "x" * (csv.field_size_limit() + 1)
+        file_path.write_text(f"a1,Python scripting\na2,{huge_field}\na3,Rust\n")
+        storage = DocumentStorage()
+
+        doc_ids = storage.add_documents_from_csv(
+            str(file_path), content_column=1, id_column=0
+        )
+
+        assert doc_ids == ["a1", "a3"]
+        assert "Skipping CSV line 2" in capsys.readouterr().out
+
+
+class TestBinaryFileDetection:
+    """Test skipping text-extension files with binary content"""
+
+    @pytest.fixture
+    def mixed_dir(self, tmp_path):
+        (tmp_path / "notes.txt").write_text("Python programming notes")
+        (tmp_path / "garbage.log").write_bytes(b"\x00\x01binary\x00data\xff" * 50)
+        (tmp_path / "utf16.txt").write_bytes("Unicode text".encode("utf-16"))
+        return tmp_path
+
+    def test_binary_files_indexed_by_default(self, mixed_dir):
+        """Test that binary content is indexed when detection is off"""
+        storage = DocumentStorage()
+
+        doc_ids = storage.add_document_from_path(str(mixed_dir))
+
+        assert len(doc_ids) == 3
+
+    def test_binary_files_skipped(self, mixed_dir, capsys):
+        """Test that binary content is skipped with a warning when detection is on"""
+        storage = DocumentStorage(skip_binary_files=True)
+
+        doc_ids = storage.add_document_from_path(str(mixed_dir))
+
+        assert sorted(doc_ids) == [
+            str(mixed_dir / "notes.txt"),
+            str(mixed_dir / "utf16.txt"),
+        ]
+        assert "binary" in capsys.readouterr().out
+        assert storage.search("binary") == []
+
+    def test_single_binary_file_raises(self, mixed_dir):
+        """Test that adding a binary file directly raises"""
+        storage = DocumentStorage(skip_binary_files=True)
+
+        with pytest.raises(ValueError, match="binary"):
+            storage.add_document_from_path(str(mixed_dir / "garbage.log"))
+
+
+class TestPathIndexing:
+    """Test indexing file path components as searchable terms"""
+
+    @pytest.fixture
+    def nested_dir(self, tmp_path):
+        (tmp_path / "reports").mkdir()
+        (tmp_path / "notes").mkdir()
+        (tmp_path / "reports" / "quarterly.txt").write_text("Revenue grew steadily")
+        (tmp_path / "notes" / "meeting.txt").write_text("Revenue was discussed")
+        return tmp_path
+
+    def test_path_terms_disabled_by_default(self, nested_dir):
+        """Test that path components are not indexed unless enabled"""
+        storage = DocumentStorage()
+        storage.add_document_from_path(nested_dir)
+
+        assert storage.search("path:reports") == []
+
+    def test_search_by_directory(self, nested_dir):
+        """Test that documents can be found by a directory in their path"""
+        storage = DocumentStorage(index_paths=True)
+        storage.add_document_from_path(nested_dir)
+
+        results = storage.search("path:reports")
+        assert [doc_id for doc_id, _, _ in results] == [
+            str(nested_dir / "reports" / "quarterly.txt")
+        ]
+
+    def test_search_by_file_stem(self, nested_dir):
+        """Test that documents can be found by their file name without extension"""
+        storage = DocumentStorage(index_paths=True)
+        storage.add_document_from_path(nested_dir / "notes" / "meeting.txt")
+
+        assert len(storage.search("path:meeting")) == 1
+        assert storage.search("meeting") == []
+
+    def test_path_terms_do_not_affect_content_tf(self, nested_dir):
+        """Test that path terms are excluded from the document length"""
+        file_path = nested_dir / "reports" / "quarterly.txt"
+        storage = DocumentStorage(index_paths=True)
+        storage.add_document_from_path(file_path)
+
+        assert storage.get_document_info(str(file_path))["total_words"] == 3
+
+    def test_path_terms_left_out_of_similarity(self, tmp_path):
+        """Test that the same content in different directories is fully similar"""
+        for directory in ["ml", "notes"]:
+            (tmp_path / directory).mkdir()
+            (tmp_path / directory / "intro.txt").write_text(
+                "Neural networks learn representations"
+            )
+        (tmp_path / "ml" / "recipes.txt").write_text("Bake bread with flour")
+        storage = DocumentStorage(index_paths=True)
+        storage.add_document_from_path(tmp_path)
+        ml_intro = str(tmp_path / "ml" / "intro.txt")
+        notes_intro = str(tmp_path / "notes" / "intro.txt")
+
+        for results in [
+            storage.search_cosine("neural networks learn representations"),
+            storage.search_by_similarity("Neural networks learn representations"),
+        ]:
+            assert {doc_id for doc_id, _, _ in results} == {ml_intro, notes_intro}
+            assert all(score == pytest.approx(1.0) for _, score, _ in results)
+        assert [doc_id for doc_id, _, _ in storage.more_like_this(ml_intro)] == [
+            notes_intro
+        ]
+
+    def test_path_terms_hidden_from_word_listings(self, nested_dir):
+        """Test that path terms stay out of vocabulary, completions and stats"""
+        storage = DocumentStorage(index_paths=True)
+        storage.add_document_from_path(nested_dir)
+        content_only = DocumentStorage()
+        content_only.add_document_from_path(nested_dir)
+
+        assert storage.vocabulary() == content_only.vocabulary()
+        assert storage.get_stats()["total_words"] == (
+            content_only.get_stats()["total_words"]
+        )
+        assert storage.autocomplete("pa") == content_only.autocomplete("pa")
+        assert storage.words_in_range("a", "z") == content_only.words_in_range("a", "z")
+        assert "path:reports" in storage.prefix_search("path:rep")
+        assert "path:reports" in storage.autocomplete("path:")
+
+    def test_index_paths_persists(self, nested_dir, tmp_path):
+        """Test that the path indexing option survives save and load"""
+        storage = DocumentStorage(index_paths=True)
+        storage.add_document_from_path(nested_dir)
+        file_path = tmp_path / "storage.json"
+        storage.save(file_path)
+
+        loaded = DocumentStorage.load(file_path)
+        assert loaded.index_paths
+        assert loaded.search("path:reports") == storage.search("path:reports")
+
+
+class TestWordPositionPersistence:
+    """Integration tests for saving and loading word positions"""
+
+    def test_positions_survive_save_and_load(self, tmp_path):
+        """Test that stored positions round-trip through a storage file"""
+        storage = DocumentStorage(store_positions=True)
+        storage.add_document("python is fun and python is fast", "doc1")
+        file_path = tmp_path / "storage.json"
+        storage.save(file_path)
+
+        loaded = DocumentStorage.load(file_path)
+        assert loaded.get_word_positions("doc1", "python") == [0, 4]
+
+        loaded.add_document("fast python", "doc2")
+        assert loaded.get_word_positions("doc2", "python") == [1]
+
+
+class TestReplPersistence:
+    """Integration tests for saving and loading from the REPL"""
+
+    @pytest.fixture
+    def run_repl(self, tmp_path, monkeypatch):
+        """Run the REPL on the given input lines from a temporary directory"""
+        monkeypatch.chdir(tmp_path)
+
+        def run(*lines):
+            result = CliRunner().invoke(repl, input="\n".join([*lines, "exit", ""]))
+            assert result.exit_code == 0, result.output
+            return result.output
+
+        return run
+
+    @pytest.fixture
+    def document(self, tmp_path):
+        """A text file to add from the REPL"""
+        file_path = tmp_path / "guide.txt"
+        file_path.write_text("Python programming guide")
+        return file_path
+
+    def test_save_then_load_in_new_session(self, run_repl, document, tmp_path):
+        """Test that documents saved in one session are found in another"""
+        run_repl(f"add {document}", "save docs.json")
+
+        assert (tmp_path / "docs.json").exists()
+        output = run_repl("load docs.json", "search python")
+        assert "Loaded 1 documents from docs.json" in output
+        assert "Python programming guide" in output
+
+    def test_failed_load_keeps_current_storage(self, run_repl, document):
+        """Test that a load error is reported and the documents are kept"""
+        output = run_repl(f"add {document}", "load missing.json", "stats")
+
+        assert "Error:" in output
+        assert "Total documents: 1" in output
+
+
+class TestSearchCommandRanking:
+    """Integration tests for choosing the ranking algorithm from the CLI"""
+
+    @pytest.fixture
+    def storage_file(self, sample_documents, tmp_path):
+        """A storage file holding the sample documents"""
+        storage = DocumentStorage()
+        for doc_id, content in sample_documents.items():
+            storage.add_document(content, doc_id)
+        file_path = tmp_path / "storage.json"
+        storage.save(file_path)
+        return file_path
+
+    @pytest.mark.parametrize("rank", ["tfidf", "bm25", "cosine"])
+    def test_each_rank_finds_results(self, storage_file, rank):
+        """Test that every ranking algorithm runs and finds documents"""
+        result = CliRunner().invoke(
+            main, ["search", "python", "--rank", rank, "-s", str(storage_file)]
+        )
+
+        assert result.exit_code == 0, result.output
+        assert "Found" in result.output
+        assert "Document: doc1" in result.output
+
+    def test_unknown_rank_lists_options(self, storage_file):
+        """Test that an unknown algorithm is rejected with the valid choices"""
+        result = CliRunner().invoke(
+            main, ["search", "python", "--rank", "pagerank", "-s", str(storage_file)]
+        )
+
+        assert result.exit_code != 0
+        for rank in ["tfidf", "bm25", "cosine"]:
+            assert rank in result.output
+
+
+class TestCodeTokenization:
+    """Integration tests for indexing source files by identifier parts"""
+
+    @pytest.fixture
+    def source_file(self, tmp_path):
+        file_path = tmp_path / "users.py"
+        file_path.write_text(
+            "def getUserName(user_id):\n    return load_user(user_id)\n"
+        )
+        return file_path
+
+    @pytest.mark.parametrize("query", ["user", "name", "getUserName", "load_user"])
+    def test_identifier_parts_findable(self, source_file, query):
+        """Test that identifiers are found whole and by their parts"""
+        storage = DocumentStorage(code_extensions=[".py"])
+        storage.add_document_from_path(str(source_file))
+
+        assert [doc_id for doc_id, _, _ in storage.search(query)] == [
+            str(source_file)
+        ]
+
+    def test_other_extensions_use_plain_tokenizer(self, source_file):
+        """Test that files without a code extension are not split"""
+        storage = DocumentStorage(code_extensions=["js"])
+        storage.add_document_from_path(str(source_file))
+
+        assert storage.search("user") == []
+
+    def test_code_extensions_persist(self, source_file, tmp_path):
+        """Test that the code extensions survive save and load"""
+        storage = DocumentStorage(code_extensions=["PY"])
+        file_path = tmp_path / "storage.json"
+        storage.save(file_path)
+
+        loaded = DocumentStorage.load(file_path)
+        loaded.add_document_from_path(str(source_file))
+        assert loaded.code_extensions == {".py"}
+        assert len(loaded.search("name")) == 1
+
+
+class TestReindexDirectory:
+    """Integration tests for reindexing only changed files"""
+
+    @pytest.fixture
+    def docs_dir(self, tmp_path):
+        docs_dir = tmp_path / "docs"
+        docs_dir.mkdir()
+        (docs_dir / "python.txt").write_text("Python programming")
+        (docs_dir / "java.txt").write_text("Java programming")
+        return docs_dir
+
+    def test_mtime_recorded_as_metadata(self, docs_dir):
+        """Test that file-sourced documents record their modification time"""
+        storage = DocumentStorage()
+        storage.add_document_from_path(str(docs_dir))
+
+        file_path = docs_dir / "python.txt"
+        assert storage.get_metadata(str(file_path)) == {
+            "mtime": str(file_path.stat().st_mtime_ns)
+        }
+
+    def test_only_changed_file_reindexed(self, docs_dir):
+        """Test that touching one file reindexes only that file"""
+        storage = DocumentStorage()
+        storage.add_document_from_path(str(docs_dir))
+        changed = docs_dir / "python.txt"
+        changed.write_text("Python scripting")
+        stat = changed.stat()
+        os.utime(changed, ns=(stat.st_atime_ns, stat.st_mtime_ns + 1_000_000_000))
+        (docs_dir / "rust.txt").write_text("Rust programming")
+
+        assert storage.reindex_directory(str(docs_dir)) == (1, 1, 1, 0)
+        assert [doc_id for doc_id, _, _ in storage.search("scripting")] == [
+            str(changed)
+        ]
+        assert str(changed) not in [
+            doc_id for doc_id, _, _ in storage.search("programming")
+        ]
+        assert storage.get_stats()["total_documents"] == 3
+
+    def test_unchanged_directory_skipped(self, docs_dir):
+        """Test that reindexing an unchanged directory skips every file"""
+        storage = DocumentStorage()
+        storage.add_document_from_path(str(docs_dir))
+
+        assert storage.reindex_directory(str(docs_dir)) == (0, 0, 2, 0)
+
+    def test_update_keeps_boost(self, docs_dir):
+        """Test that an updated document keeps its boost"""
+        storage = DocumentStorage()
+        storage.add_document_from_path(str(docs_dir))
+        changed = docs_dir / "java.txt"
+        storage.set_document_boost(str(changed), 3)
+        stat = changed.stat()
+        os.utime(changed, ns=(stat.st_atime_ns, stat.st_mtime_ns + 1_000_000_000))
+
+        assert storage.reindex_directory(str(docs_dir)) == (0, 1, 1, 0)
+        assert storage.get_document_boost(str(changed)) == 3
+
+    def test_change_to_duplicate_keeps_document(self, docs_dir):
+        """Test that a file changed to duplicate another is left as it was"""
+        storage = DocumentStorage(deduplicate_by_content=True)
+        storage.add_document_from_path(str(docs_dir))
+        changed = docs_dir / "java.txt"
+        changed.write_text("Python programming")
+        stat = changed.stat()
+        os.utime(changed, ns=(stat.st_atime_ns, stat.st_mtime_ns + 1_000_000_000))
+
+        assert storage.reindex_directory(str(docs_dir)) == (0, 0, 1, 0)
+        assert [doc_id for doc_id, _, _ in storage.search("java")] == [str(changed)]
+        assert storage.reindex_directory(str(docs_dir)) == (0, 0, 1, 0)
+        assert storage.get_stats()["total_documents"] == 2
+
+    def test_change_to_rejected_empty_keeps_document(self, docs_dir):
+        """Test that a file emptied under the reject policy is left as it was"""
+        storage = DocumentStorage(empty_documents="reject")
+        storage.add_document_from_path(str(docs_dir))
+        changed = docs_dir / "java.txt"
+        changed.write_text("")
+        stat = changed.stat()
+        os.utime(changed, ns=(stat.st_atime_ns, stat.st_mtime_ns + 1_000_000_000))
+
+        assert storage.reindex_directory(str(docs_dir)) == (0, 0, 1, 0)
+        assert [doc_id for doc_id, _, _ in storage.search("java")] == [str(changed)]
+        assert storage.get_document_info(str(changed))["content"] == "Java programming"
+
+    def test_deleted_file_removed(self, docs_dir):
+        """Test that documents for deleted files are removed"""
+        storage = DocumentStorage()
+        storage.add_document_from_path(str(docs_dir))
+        storage.add_document("Go programming", "notes")
+        deleted = docs_dir / "java.txt"
+        deleted.unlink()
+
+        assert storage.reindex_directory(str(docs_dir)) == (0, 0, 1, 1)
+        assert storage.get_document_info(str(deleted)) is None
+        assert {doc_id for doc_id, _, _ in storage.search("programming")} == {
+            "notes",
+            str(docs_dir / "python.txt"),
+        }
+
+    def test_deleted_file_outside_directory_kept(self, docs_dir, tmp_path):
+        """Test that documents for files in other directories are not removed"""
+        other_dir = tmp_path / "other"
+        other_dir.mkdir()
+        other_file = other_dir / "rust.txt"
+        other_file.write_text("Rust programming")
+        storage = DocumentStorage()
+        storage.add_document_from_path(str(docs_dir))
+        storage.add_document_from_path(str(other_file))
+        other_file.unlink()
+
+        assert storage.reindex_directory(str(docs_dir)) == (0, 0, 2, 0)
+        assert storage.get_document_info(str(other_file)) is not None
+
+    def test_relative_and_absolute_paths_share_ids(self, docs_dir, monkeypatch):
+        """Test that a directory added by a relative path is not added again"""
+        monkeypatch.chdir(docs_dir.parent)
+        storage = DocumentStorage(deduplicate_by_content=False)
+        storage.add_document_from_path("docs")
+
+        assert storage.reindex_directory(str(docs_dir)) == (0, 0, 2, 0)
+        with pytest.raises(ValueError, match="already exists"):
+            storage.add_document_from_path(str(docs_dir / "python.txt"))
+        assert storage.get_stats()["total_documents"] == 2
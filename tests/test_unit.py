@@ -3,10 +3,32 @@
 Unit tests for DocuSearch components
 """
 
+import csv
+import io
+import json
+import math
+import re
+
 import pytest
 
-from docusearch import DocumentStorage
-from docusearch.trie import Trie
+from docusearch import (
+    BM25Scorer,
+    DocumentStorage,
+    IndexStats,
+    MetricsObserver,
+    QuerySyntaxError,
+    SearchOptions,
+    cjk_bigram_tokenize,
+    code_tokenize,
+    collapse_repeats,
+    fold_diacritics,
+    join_hyphenated,
+    normalize_width,
+    parse,
+)
+from docusearch.query import And, Not, Or, Phrase, Prefix, Term
+from docusearch.storage import smoothed_idf
+from docusearch.trie import RadixTrie, Trie
 
 
 class TestTrie:
@@ -30,6 +52,40 @@ class TestTrie:
         assert "programming" in trie.starts_with("prog")
         assert trie.starts_with("xyz") == []
 
+    def test_trie_sorted_words(self):
+        """Test that prefix and full word listings are sorted and stable"""
+        trie = Trie()
+        for word in ["python", "pyramid", "py", "pylon", "java", "pyx"]:
+            trie.insert(word)
+
+        words = trie.starts_with("py")
+
+        assert words == ["py", "pylon", "pyramid", "python", "pyx"]
+        assert trie.starts_with("py") == words
+        assert trie.get_all_words() == sorted(trie.get_all_words())
+
+    def test_trie_node_count(self):
+        """Test that nodes shared by prefixes are counted once"""
+        trie = Trie()
+        assert trie.get_node_count() == 1
+
+        trie.insert("py")
+        trie.insert("pyx")
+        trie.insert("ja")
+
+        assert trie.get_node_count() == 6
+
+    def test_trie_max_depth(self):
+        """Test that max depth is the length of the longest word"""
+        trie = Trie()
+        assert trie.get_max_depth() == 0
+
+        for word in ["py", "python", "java"]:
+            trie.insert(word)
+
+        assert trie.get_max_depth() == 6
+        assert trie.get_node_count() == 11
+
     def test_trie_word_counts(self):
         """Test word count tracking in trie"""
         trie = Trie()
@@ -54,15 +110,38 @@ class TestTrie:
         trie.add_document_to_word("programming", "doc1", 1)
 
         # Delete word from specific document
-        trie.remove_document_from_word("python", "doc1")
+        assert not trie.remove_document_from_word("python", "doc1")
         docs = trie.get_documents_for_word("python")
         assert "doc1" not in docs
         assert "doc2" in docs
 
         # Delete word completely
-        trie.remove_document_from_word("python", "doc2")
+        assert trie.remove_document_from_word("python", "doc2")
         docs = trie.get_documents_for_word("python")
         assert len(docs) == 0
+        assert not trie.remove_document_from_word("python", "doc2")
+
+    def test_trie_words_with_frequency(self):
+        """Test word frequencies match per-word lookups"""
+        trie = Trie()
+        for word, doc_ids in {
+            "python": ["doc1", "doc2"],
+            "programming": ["doc1"],
+            "pro": [],
+        }.items():
+            trie.insert(word)
+            for doc_id in doc_ids:
+                trie.add_document_to_word(word, doc_id)
+
+        word_to_freq = trie.get_all_words_with_frequency()
+
+        assert set(word_to_freq) == set(trie.get_all_words())
+        for word, freq in word_to_freq.items():
+            assert freq == trie.get_document_frequency(word)
+        assert word_to_freq == {"python": 2, "programming": 1, "pro": 0}
+
+        trie.cleanup_empty_words()
+        assert trie.get_all_words_with_frequency() == {"python": 2, "programming": 1}
 
     def test_trie_empty_operations(self):
         """Test trie operations on empty trie"""
@@ -99,6 +178,17 @@ class TestDocumentStorage:
         assert doc_info is not None
         assert doc_info["content"] == "Another test document."
 
+    def test_add_document_duplicate_id(self, storage):
+        """Test that a duplicate ID raises an error and leaves storage intact"""
+        storage.add_document("Original content.", "dup")
+
+        with pytest.raises(ValueError, match="dup"):
+            storage.add_document("Replacement content.", "dup")
+
+        assert storage.get_document_info("dup")["content"] == "Original content."
+        assert storage.get_stats()["total_documents_in_index"] == 1
+        assert storage.search("replacement") == []
+
     def test_delete_document(self, storage):
         """Test deleting a document"""
         doc_id = storage.add_document("Test document to delete.", "delete_test")
@@ -117,6 +207,21 @@ class TestDocumentStorage:
         stats = storage.get_stats()
         assert stats["total_documents"] == 0
 
+    def test_delete_document_prunes_only_unshared_words(self, storage):
+        """Test that deleting a document prunes words no other document uses"""
+        storage.add_document("python shared words", "doc1")
+        storage.add_document("java shared words", "doc2")
+
+        storage.remove_document("doc1")
+
+        words = storage.trie.get_all_words()
+        assert "python" not in words
+        assert {"java", "shared", "words"} <= set(words)
+        assert storage.trie.get_documents_for_word("shared") == {"doc2": 1}
+
+        storage.remove_document("doc2")
+        assert storage.trie.get_all_words() == []
+
     def test_delete_nonexistent_document(self, storage):
         """Test deleting a document that doesn't exist"""
         # Should not raise an exception
@@ -138,6 +243,18 @@ class TestDocumentStorage:
         assert info["unique_words"] == 7
         assert "content" in info
 
+    def test_get_word_count(self, storage):
+        """Test word counts match those in the document info"""
+        storage.add_document("python python java python", "doc1")
+
+        word_counts = storage.get_document_info("doc1")["word_counts"]
+
+        for word, count in word_counts.items():
+            assert storage.get_word_count("doc1", word) == count
+        assert storage.get_word_count("doc1", "Python") == 3
+        assert storage.get_word_count("doc1", "rust") == 0
+        assert storage.get_word_count("missing", "python") == 0
+
     def test_get_nonexistent_document_info(self, storage):
         """Test getting info for nonexistent document"""
         info = storage.get_document_info("nonexistent")
@@ -149,6 +266,8 @@ class TestDocumentStorage:
 
         assert stats["total_documents"] == 0
         assert stats["total_words"] == 0
+        assert stats["average_document_length"] == 0
+        assert stats["max_document_length"] == 0
 
     def test_get_stats_with_documents(self, storage):
         """Test getting stats with documents"""
@@ -160,6 +279,29 @@ class TestDocumentStorage:
         assert stats["total_documents"] == 2
         assert stats["total_words"] > 0
 
+    def test_get_stats_document_lengths(self, storage):
+        """Test average and max document length in stats"""
+        storage.add_document("one two three four", "doc1")
+        storage.add_document("one two", "doc2")
+        storage.add_document("one two three", "doc3")
+
+        stats = storage.get_stats()
+
+        assert stats["average_document_length"] == pytest.approx(3.0)
+        assert stats["max_document_length"] == 4
+
+    def test_estimate_memory_usage_grows(self, storage, sample_documents):
+        """Test that the memory estimate grows as documents are added"""
+        estimates = [storage.estimate_memory_usage()]
+        for doc_id, content in sample_documents.items():
+            storage.add_document(content, doc_id)
+            estimates.append(storage.estimate_memory_usage())
+
+        assert all(later > earlier for earlier, later in zip(estimates, estimates[1:]))
+
+        storage.remove_document("doc1")
+        assert storage.estimate_memory_usage() < estimates[-1]
+
     def test_search_empty_storage(self, storage):
         """Test search on empty storage"""
         results = storage.search("test")
@@ -254,3 +396,3420 @@ class TestCLI:
 
         assert callable(main)
         assert callable(repl)
+
+
+class TestMerge:
+    """Unit tests for merging DocumentStorage instances"""
+
+    def test_merge_non_overlapping(self):
+        """Test merging two stores makes the union searchable"""
+        first = DocumentStorage()
+        first.add_document("Python programming language.", "doc1")
+        first.add_document("Web development with HTML.", "doc2")
+
+        second = DocumentStorage()
+        second.add_document("Java programming language.", "doc3")
+
+        first.merge(second)
+
+        stats = first.get_stats()
+        assert stats["total_documents"] == 3
+        assert stats["total_documents_in_index"] == 3
+
+        doc_ids = [doc_id for doc_id, _, _ in first.search("programming")]
+        assert sorted(doc_ids) == ["doc1", "doc3"]
+        assert "java" in first.prefix_search("ja")
+
+    def test_merge_matches_single_store_scores(self):
+        """Test merged IDF totals match a store built from the full corpus"""
+        documents = {
+            "doc1": "python python java",
+            "doc2": "python rust",
+            "doc3": "java go",
+        }
+
+        combined = DocumentStorage()
+        for doc_id, content in documents.items():
+            combined.add_document(content, doc_id)
+
+        first, second = DocumentStorage(), DocumentStorage()
+        first.add_document(documents["doc1"], "doc1")
+        second.add_document(documents["doc2"], "doc2")
+        second.add_document(documents["doc3"], "doc3")
+        first.merge(second)
+
+        assert first.search("python java") == combined.search("python java")
+
+    def test_merge_collision(self):
+        """Test merging stores with a shared document ID fails without changes"""
+        first = DocumentStorage()
+        first.add_document("Python programming.", "doc1")
+
+        second = DocumentStorage()
+        second.add_document("Java programming.", "doc1")
+        second.add_document("Rust programming.", "doc2")
+
+        with pytest.raises(ValueError, match="doc1"):
+            first.merge(second)
+
+        assert first.get_stats()["total_documents"] == 1
+        assert first.get_document_info("doc2") is None
+        assert first.search("java") == []
+
+    def test_merge_rejected_empty_document(self):
+        """Test that a rejected empty document fails the merge without changes"""
+        first = DocumentStorage(empty_documents="reject")
+        first.add_document("Python programming.", "doc1")
+
+        second = DocumentStorage(empty_documents="allow")
+        second.add_document("Java programming.", "doc2")
+        second.add_document("!!!", "doc3")
+
+        with pytest.raises(ValueError, match="doc3"):
+            first.merge(second)
+
+        assert first.get_stats()["total_documents"] == 1
+        assert first.get_document_info("doc2") is None
+        assert first.search("java") == []
+
+    def test_merge_different_tokenizer_settings(self):
+        """Test merging stores that tokenize differently fails without changes"""
+        first = DocumentStorage(min_token_length=3)
+        first.add_document("Python programming.", "doc1")
+
+        second = DocumentStorage(min_token_length=1)
+        second.add_document("Go is a language.", "doc2")
+
+        with pytest.raises(ValueError, match="min_token_length"):
+            first.merge(second)
+
+        assert first.get_stats()["total_documents"] == 1
+        assert first.get_document_info("doc2") is None
+
+    def test_merge_skips_duplicate_content(self):
+        """Test that documents whose content is already stored are skipped"""
+        first = DocumentStorage(deduplicate_by_content=True)
+        first.add_document("Python programming.", "doc1")
+
+        second = DocumentStorage()
+        second.add_document("Python programming.", "doc2")
+        second.add_document("Java programming.", "doc3")
+
+        first.merge(second)
+
+        assert first.get_document_info("doc2") is None
+        assert first.get_stats()["total_documents"] == 2
+
+    def test_merge_without_contents_not_deduplicated(self):
+        """Test that documents without kept content are not taken as duplicates"""
+        first = DocumentStorage(deduplicate_by_content=True)
+        first.add_document("Python programming.", "doc1")
+
+        second = DocumentStorage(store_contents=False)
+        second.add_document("Java programming.", "o1")
+        second.add_document("Rust programming.", "o2")
+        second.add_document("Go programming.", "o3")
+
+        first.merge(second)
+
+        assert first.get_stats()["total_documents"] == 4
+        assert sorted(doc_id for doc_id, _, _ in first.search("programming")) == [
+            "doc1",
+            "o1",
+            "o2",
+            "o3",
+        ]
+
+    def test_merge_keeps_boosts(self):
+        """Test that merged documents keep their boosts"""
+        first = DocumentStorage()
+        first.add_document("Python programming.", "doc1")
+
+        second = DocumentStorage()
+        second.add_document("Java programming.", "doc2")
+        second.add_document("Rust programming.", "doc3")
+        second.set_document_boost("doc2", 0)
+        second.set_document_boost("doc3", 2.5)
+
+        first.merge(second)
+
+        assert first.get_document_boost("doc2") == 0
+        assert first.get_document_boost("doc3") == 2.5
+        assert sorted(doc_id for doc_id, _, _ in first.search("programming")) == [
+            "doc1",
+            "doc3",
+        ]
+
+
+class TestCosineSearch:
+    """Unit tests for cosine-normalized TF-IDF search"""
+
+    @pytest.fixture
+    def storage(self):
+        """Create a DocumentStorage instance with varied documents"""
+        storage = DocumentStorage()
+        storage.add_document("python java", "exact")
+        storage.add_document("python python python rust go", "python_heavy")
+        storage.add_document("java scripting and web development", "java_doc")
+        storage.add_document("rust systems programming", "rust_doc")
+        return storage
+
+    def test_cosine_scores_in_unit_range(self, storage):
+        """Test that cosine scores fall between 0 and 1"""
+        for query in ["python", "python java", "rust go python web"]:
+            results = storage.search_cosine(query, top_k=10)
+            assert results
+            for _, score, _ in results:
+                assert 0 <= score <= 1 + 1e-9
+
+    def test_cosine_exact_match_ranks_first(self, storage):
+        """Test that a document matching the query exactly ranks at the top"""
+        results = storage.search_cosine("python java", top_k=10)
+
+        assert results[0][0] == "exact"
+
+    def test_cosine_excludes_negated_terms(self, storage):
+        """Test that a -term exclusion drops documents instead of scoring them"""
+        results = storage.search_cosine("python -java", top_k=10)
+
+        assert [doc_id for doc_id, _, _ in results] == ["python_heavy"]
+
+    def test_cosine_norms_invalidated(self, storage):
+        """Test that cached norms are recomputed after adding and removing"""
+        before = storage.search_cosine("python", top_k=10)
+
+        storage.add_document("python python", "another")
+        assert storage.search_cosine("python", top_k=10) != before
+
+        storage.remove_document("another")
+
+        assert storage.search_cosine("python", top_k=10) == before
+
+
+class TestMinScoreSearch:
+    """Unit tests for minimum-score threshold filtering"""
+
+    @pytest.fixture
+    def storage(self):
+        """Create a DocumentStorage instance with strong and weak matches"""
+        storage = DocumentStorage()
+        storage.add_document("python python python", "strong1")
+        storage.add_document("python python java", "strong2")
+        storage.add_document("python java rust go scala kotlin swift ruby", "weak1")
+        storage.add_document("python html css javascript php perl lua dart", "weak2")
+        return storage
+
+    def test_min_score_zero_matches_search(self, storage):
+        """Test that a min_score of zero behaves like search"""
+        assert storage.search_with_min_score("python", 3, 0) == storage.search(
+            "python", 3
+        )
+
+    def test_min_score_excludes_weak_results(self, storage):
+        """Test that results below the threshold are dropped"""
+        results = storage.search_with_min_score("python", top_k=10, min_score=0.5)
+
+        assert [doc_id for doc_id, _, _ in results] == ["strong1", "strong2"]
+        assert all(score >= 0.5 for _, score, _ in results)
+
+    def test_min_score_applied_before_top_k(self, storage):
+        """Test that top_k limits the results that clear the threshold"""
+        results = storage.search_with_min_score("python", top_k=1, min_score=0.5)
+
+        assert [doc_id for doc_id, _, _ in results] == ["strong1"]
+        assert storage.search_with_min_score("python", top_k=5, min_score=10) == []
+
+
+class TestDocumentFrequencyAndIDF:
+    """Unit tests for the public document frequency and IDF API"""
+
+    @pytest.fixture
+    def storage(self):
+        """Create a DocumentStorage instance with common and rare terms"""
+        storage = DocumentStorage()
+        storage.add_document("python common", "doc1")
+        storage.add_document("java common", "doc2")
+        storage.add_document("rust common", "doc3")
+        return storage
+
+    def test_document_frequency(self, storage):
+        """Test document frequency for common, rare and unknown words"""
+        assert storage.get_document_frequency("common") == 3
+        assert storage.get_document_frequency("Python") == 1
+        assert storage.get_document_frequency("unknown") == 0
+
+    def test_idf(self, storage):
+        """Test IDF follows the search formula and ranks rare terms higher"""
+        assert storage.get_idf("common") == pytest.approx(1.0)
+        assert storage.get_idf("python") == pytest.approx(math.log2(4 / 2) + 1)
+        assert storage.get_idf("python") > storage.get_idf("common")
+        assert storage.get_idf("unknown") == 0
+
+
+class TestExplainSearch:
+    """Unit tests for explaining search scores"""
+
+    def test_explain_contributions_sum_to_score(self, populated_storage):
+        """Test that term contributions sum to the search score"""
+        query = "python programming data programming"
+        for doc_id, score, _ in populated_storage.search(query, top_k=10):
+            explanation = populated_storage.explain_search(query, doc_id)
+            total = sum(term["contribution"] for term in explanation)
+            assert total == pytest.approx(score)
+
+    def test_explain_term_breakdown(self, populated_storage):
+        """Test that each term reports its TF and IDF"""
+        explanation = populated_storage.explain_search("python science", "doc1")
+
+        assert [term["term"] for term in explanation] == ["python", "science"]
+        for term in explanation:
+            assert term["idf"] == pytest.approx(populated_storage.get_idf(term["term"]))
+            assert term["contribution"] == pytest.approx(term["tf"] * term["idf"])
+
+    def test_explain_no_match(self, populated_storage):
+        """Test that a non-matching document has an empty explanation"""
+        assert populated_storage.explain_search("python", "doc2") == []
+        assert populated_storage.explain_search("python", "missing") == []
+
+    def test_explain_excluded_document(self, populated_storage):
+        """Test that a document removed by a -term exclusion is not explained"""
+        assert populated_storage.explain_search("programming -python", "doc1") == []
+        assert populated_storage.explain_search("programming -python", "doc4")
+
+    def test_explain_zero_boost_document(self, populated_storage):
+        """Test that a document excluded by a boost of 0 is not explained"""
+        populated_storage.set_document_boost("doc1", 0)
+
+        assert populated_storage.explain_search("python", "doc1") == []
+        assert "doc1" not in [
+            doc_id for doc_id, _, _ in populated_storage.search("python")
+        ]
+
+
+class TestMatchCount:
+    """Unit tests for counting query term occurrences in a document"""
+
+    def test_repeated_term(self, storage):
+        """Test that every occurrence of a term is counted"""
+        storage.add_document("python code, python tests and python docs", "doc1")
+
+        assert storage.get_match_count("python", "doc1") == 3
+
+    def test_sums_over_query_terms(self, storage):
+        """Test that counts are summed over distinct query terms"""
+        storage.add_document("python code, python tests and python docs", "doc1")
+
+        assert storage.get_match_count("python tests java", "doc1") == 4
+        assert storage.get_match_count("python python", "doc1") == 3
+
+    def test_no_match(self, storage):
+        """Test that unmatched terms and unknown documents count zero"""
+        storage.add_document("python code", "doc1")
+
+        assert storage.get_match_count("java", "doc1") == 0
+        assert storage.get_match_count("python", "missing") == 0
+
+
+class TestMinTokenLength:
+    """Unit tests for the configurable minimum token length"""
+
+    def test_default_drops_single_letters(self):
+        """Test that single-letter tokens are dropped by default"""
+        storage = DocumentStorage()
+        storage.add_document("Vitamin C is important", "doc1")
+
+        assert storage.search("c") == []
+        assert storage.get_document_info("doc1")["total_words"] == 3
+
+    def test_single_letter_tokens_searchable(self):
+        """Test that a minimum of one indexes single-letter tokens"""
+        storage = DocumentStorage(min_token_length=1)
+        storage.add_document("Vitamin C is important", "doc1")
+        storage.add_document("Vitamin D is important", "doc2")
+
+        results = storage.search("C")
+        assert [doc_id for doc_id, _, _ in results] == ["doc1"]
+        assert "c" in storage.prefix_search("c")
+
+    def test_longer_minimum_applies_to_queries(self):
+        """Test that short tokens are dropped from both documents and queries"""
+        storage = DocumentStorage()
+        storage.min_token_length = 4
+        storage.add_document("the big python library", "doc1")
+
+        assert storage.search("big") == []
+        assert storage.search("big python")[0][0] == "doc1"
+
+    def test_minimum_survives_save_and_load(self, tmp_path):
+        """Test that a reloaded index keeps the minimum it was built with"""
+        storage = DocumentStorage(min_token_length=1)
+        storage.add_document("Vitamin C is important", "doc1")
+        storage.save(tmp_path / "storage.json")
+
+        loaded = DocumentStorage.load(tmp_path / "storage.json")
+
+        assert loaded.min_token_length == 1
+        assert loaded.search("c") == storage.search("c")
+        assert loaded.search("c")[0][0] == "doc1"
+
+
+class TestJSONL:
+    """Unit tests for JSONL export and import"""
+
+    def test_jsonl_round_trip(self, populated_storage, sample_documents):
+        """Test that exported documents are searchable after import"""
+        buffer = io.StringIO()
+        populated_storage.export_jsonl(buffer)
+
+        lines = buffer.getvalue().splitlines()
+        assert len(lines) == len(sample_documents)
+        assert json.loads(lines[0]) == {
+            "doc_id": "doc1",
+            "content": sample_documents["doc1"],
+        }
+
+        imported = DocumentStorage()
+        buffer.seek(0)
+        doc_ids = imported.import_jsonl(buffer)
+
+        assert doc_ids == list(sample_documents)
+        assert imported.search("programming") == populated_storage.search(
+            "programming"
+        )
+
+    def test_import_jsonl_generates_missing_ids(self):
+        """Test that lines without a doc_id get generated IDs"""
+        storage = DocumentStorage()
+        doc_ids = storage.import_jsonl(
+            io.StringIO('{"content": "python programming"}\n\n')
+        )
+
+        assert len(doc_ids) == 1
+        assert storage.search("python")[0][0] == doc_ids[0]
+
+    def test_import_jsonl_missing_content(self):
+        """Test that a line without content is rejected"""
+        storage = DocumentStorage()
+
+        with pytest.raises(ValueError, match="Line 1"):
+            storage.import_jsonl(io.StringIO('{"doc_id": "doc1"}\n'))
+
+
+class TestProximitySearch:
+    """Unit tests for proximity (NEAR) search"""
+
+    @pytest.fixture
+    def storage(self):
+        """Create a DocumentStorage instance with terms at varied distances"""
+        storage = DocumentStorage()
+        storage.add_document("python programming is fun", "adjacent")
+        storage.add_document("python is great for data programming", "distance_5")
+        storage.add_document(
+            "python has many uses but some people prefer java for programming",
+            "distance_10",
+        )
+        storage.add_document("only python here", "python_only")
+        return storage
+
+    def test_proximity_ranks_closer_terms_higher(self, storage):
+        """Test that adjacent terms outscore terms further apart"""
+        results = storage.search_proximity("python", "programming", 5, top_k=10)
+
+        assert [doc_id for doc_id, _, _ in results] == ["adjacent", "distance_5"]
+        assert results[0][1] > results[1][1]
+
+    def test_proximity_excludes_terms_beyond_window(self, storage):
+        """Test that documents with terms beyond the window are excluded"""
+        results = storage.search_proximity("python", "programming", 4, top_k=10)
+        assert [doc_id for doc_id, _, _ in results] == ["adjacent"]
+
+        results = storage.search_proximity("python", "java", 3, top_k=10)
+        assert results == []
+
+    def test_proximity_in_either_order(self, storage):
+        """Test that term order does not matter"""
+        assert storage.search_proximity(
+            "programming", "python", 9, top_k=10
+        ) == storage.search_proximity("python", "programming", 9, top_k=10)
+
+    def test_proximity_normalizes_terms(self):
+        """Test that terms are normalized like document text"""
+        storage = DocumentStorage(fold_diacritics=True)
+        storage.add_document("Café Crème is served here", "doc1")
+
+        results = storage.search_proximity("CAFÉ", "crème", 1)
+        assert [doc_id for doc_id, _, _ in results] == ["doc1"]
+
+    def test_proximity_uses_stored_positions(self):
+        """Test that stored positions are used once contents are dropped"""
+        storage = DocumentStorage(store_positions=True)
+        storage.add_document("python programming is fun", "doc1")
+        expected = storage.search_proximity("python", "programming", 1)
+
+        storage.drop_contents()
+
+        results = storage.search_proximity("python", "programming", 1)
+        assert [(d, s) for d, s, _ in results] == [(d, s) for d, s, _ in expected]
+
+    def test_smart_search_near_syntax(self, storage):
+        """Test that smart search parses the NEAR/n syntax"""
+        assert storage.smart_search(
+            "python NEAR/5 programming"
+        ) == storage.search_proximity("python", "programming", 5)
+
+
+class TestTopKSelection:
+    """Unit tests for bounded top-k result selection"""
+
+    def test_top_k_matches_full_ranking(self):
+        """Test that top-k results are the best-first prefix of the full ranking"""
+        storage = DocumentStorage()
+        for i in range(50):
+            content = "python " * (i % 7 + 1) + "filler " * (i % 5)
+            storage.add_document(content, f"doc{i}")
+
+        full = storage.search("python", top_k=50)
+        assert [score for _, score, _ in full] == sorted(
+            (score for _, score, _ in full), reverse=True
+        )
+        for top_k in [1, 3, 10]:
+            assert storage.search("python", top_k=top_k) == full[:top_k]
+            assert storage.search_by_prefix("pyth", top_k=top_k) == list(
+                storage.search_by_prefix("pyth", top_k=50)
+            )[:top_k]
+
+    def test_top_k_ties_keep_insertion_order(self):
+        """Test that tied scores are broken deterministically by insertion order"""
+        storage = DocumentStorage()
+        for doc_id in ["b", "a", "c"]:
+            storage.add_document("python programming", doc_id)
+
+        assert [doc_id for doc_id, _, _ in storage.search("python", top_k=2)] == [
+            "b",
+            "a",
+        ]
+
+
+class TestAutocomplete:
+    """Unit tests for autocomplete suggestions"""
+
+    @pytest.fixture
+    def storage(self):
+        """Create a DocumentStorage instance with prefix-sharing words"""
+        storage = DocumentStorage()
+        storage.add_document("program programming", "doc1")
+        storage.add_document("programming progress", "doc2")
+        storage.add_document("programming progress project", "doc3")
+        storage.add_document("project", "doc4")
+        return storage
+
+    def test_autocomplete_ranked_by_document_frequency(self, storage):
+        """Test that more common words are suggested first"""
+        assert storage.autocomplete("pro") == [
+            "programming",
+            "progress",
+            "project",
+            "program",
+        ]
+
+    def test_autocomplete_limit(self, storage):
+        """Test that suggestions are capped at the limit"""
+        assert storage.autocomplete("prog", limit=2) == ["programming", "progress"]
+
+    def test_autocomplete_no_matches(self, storage):
+        """Test that unknown prefixes have no suggestions"""
+        assert storage.autocomplete("xyz") == []
+
+
+class TestRenameDocument:
+    """Unit tests for renaming documents"""
+
+    def test_rename_document(self, populated_storage):
+        """Test that a renamed document is found under its new ID"""
+        before = populated_storage.search("python programming")
+
+        populated_storage.rename_document("doc1", "python_doc")
+
+        after = populated_storage.search("python programming")
+        assert [doc_id for doc_id, _, _ in after] == [
+            "python_doc" if doc_id == "doc1" else doc_id for doc_id, _, _ in before
+        ]
+        assert populated_storage.get_document_info("doc1") is None
+        info = populated_storage.get_document_info("python_doc")
+        assert info["total_words"] == 11
+        assert populated_storage.get_stats()["total_documents"] == 4
+
+    def test_rename_then_remove(self, populated_storage):
+        """Test that a renamed document can be removed cleanly"""
+        populated_storage.rename_document("doc1", "python_doc")
+
+        assert populated_storage.remove_document("python_doc") is True
+        assert "python" not in populated_storage.prefix_search("py")
+
+    def test_rename_errors(self, populated_storage):
+        """Test renaming a missing document or onto an existing ID fails"""
+        with pytest.raises(ValueError, match="missing"):
+            populated_storage.rename_document("missing", "new")
+        with pytest.raises(ValueError, match="doc2"):
+            populated_storage.rename_document("doc1", "doc2")
+
+
+class TestForEachDocument:
+    """Unit tests for iterating documents with a callback"""
+
+    def test_visits_each_document_once(self, populated_storage, sample_documents):
+        """Test that every document is visited exactly once"""
+        visited = []
+
+        populated_storage.for_each_document(
+            lambda doc_id, content: visited.append((doc_id, content))
+        )
+
+        assert sorted(visited) == sorted(sample_documents.items())
+
+    def test_stops_on_error(self, populated_storage):
+        """Test that an exception from the callback stops iteration"""
+        visited = []
+
+        def callback(doc_id, content):
+            visited.append(doc_id)
+            if len(visited) == 2:
+                raise RuntimeError("stop here")
+
+        with pytest.raises(RuntimeError, match="stop here"):
+            populated_storage.for_each_document(callback)
+
+        assert len(visited) == 2
+
+
+class TestRegexSearch:
+    """Unit tests for regex content search"""
+
+    @pytest.fixture
+    def storage(self):
+        """Create a DocumentStorage instance with email-like content"""
+        storage = DocumentStorage()
+        storage.add_document("Contact alice@example.com or bob@example.com", "two")
+        storage.add_document("Write to carol@example.org for details", "one")
+        storage.add_document("No addresses in this document", "none")
+        return storage
+
+    def test_regex_search_scores_by_matches(self, storage):
+        """Test that documents are ranked by number of matches"""
+        results = storage.regex_search(r"\w+@example\.\w+", top_k=10)
+
+        assert [(doc_id, score) for doc_id, score, _ in results] == [
+            ("two", 2),
+            ("one", 1),
+        ]
+
+    def test_regex_search_preview_centers_on_match(self, storage):
+        """Test that the preview starts near the first match"""
+        content = "filler text " * 30 + "reach dave@example.net today " + "end " * 30
+        storage.add_document(content, "long")
+
+        results = storage.regex_search(r"dave@\w+\.net")
+
+        assert results[0][0] == "long"
+        assert "dave@example.net" in results[0][2]
+        assert results[0][2].startswith("...")
+
+    def test_regex_search_invalid_pattern(self, storage):
+        """Test that an invalid pattern raises an error"""
+        with pytest.raises(re.error):
+            storage.regex_search("(unclosed")
+
+
+class TestWeightedQuery:
+    """Unit tests for boosting query terms with term^weight"""
+
+    @pytest.fixture
+    def storage(self):
+        """Create a DocumentStorage instance where two terms compete"""
+        storage = DocumentStorage()
+        storage.add_document("python python snake", "python_doc")
+        storage.add_document("programming programming programming code", "prog_doc")
+        storage.add_document("filler text only", "other")
+        return storage
+
+    def test_boost_changes_ranking(self, storage):
+        """Test that boosting a term moves its documents up"""
+        unboosted = storage.search("python programming")
+        boosted = storage.search("python^3 programming")
+
+        assert unboosted[0][0] == "prog_doc"
+        assert boosted[0][0] == "python_doc"
+
+    def test_boost_multiplies_contribution(self, storage):
+        """Test that a weight multiplies the term's score"""
+        plain = storage.search("python")[0][1]
+
+        assert storage.search("python^2.5")[0][1] == pytest.approx(plain * 2.5)
+        assert storage.explain_search("python^2.5", "python_doc")[0][
+            "contribution"
+        ] == pytest.approx(plain * 2.5)
+
+    def test_malformed_weight_defaults_to_one(self, storage):
+        """Test that malformed weights are treated as 1.0"""
+        expected = storage.search("python programming")
+
+        assert storage.search("python^abc programming") == expected
+        assert storage.search("python^ programming^nan") == expected
+
+    def test_negative_weight_defaults_to_one(self, storage):
+        """Test that a negative weight is malformed rather than sinking a match"""
+        expected = storage.search("python programming")
+
+        assert storage.search("python^-1 programming") == expected
+        assert storage.search("python^-0.5 programming^-inf") == expected
+
+
+class TestDropContents:
+    """Unit tests for index-only operation without document content"""
+
+    def test_search_after_drop_contents(self, populated_storage):
+        """Test that search ranks the same documents with empty previews"""
+        before = populated_storage.search("programming data")
+
+        populated_storage.drop_contents()
+
+        after = populated_storage.search("programming data")
+        assert [(doc_id, score) for doc_id, score, _ in after] == [
+            (doc_id, score) for doc_id, score, _ in before
+        ]
+        assert all(preview == "" for _, _, preview in after)
+        assert populated_storage.get_document_info("doc1")["content"] == ""
+        assert populated_storage.get_document_info("doc1")["total_words"] == 11
+
+    def test_store_contents_disabled(self, sample_documents):
+        """Test that content is never kept when store_contents is False"""
+        storage = DocumentStorage(store_contents=False)
+        for doc_id, content in sample_documents.items():
+            storage.add_document(content, doc_id)
+
+        results = storage.search("python")
+        assert [(doc_id, preview) for doc_id, _, preview in results] == [("doc1", "")]
+
+    def test_settings_survive_save_and_load(self, tmp_path):
+        """Test that store_contents and empty_documents are restored on load"""
+        storage = DocumentStorage(store_contents=False, empty_documents="reject")
+        storage.add_document("python code", "doc1")
+        storage.save(tmp_path / "storage.json")
+
+        loaded = DocumentStorage.load(tmp_path / "storage.json")
+        loaded.add_document("java code", "doc2")
+
+        assert loaded.get_document_info("doc2")["content"] == ""
+        with pytest.raises(ValueError, match="no indexable words"):
+            loaded.add_document("", "empty")
+
+    def test_merge_without_contents(self, populated_storage):
+        """Test that stores without content can still be merged"""
+        populated_storage.drop_contents()
+        merged = DocumentStorage()
+
+        merged.merge(populated_storage)
+
+        assert merged.search("python") == populated_storage.search("python")
+
+
+class TestTokenizer:
+    """Unit tests for pluggable tokenizers"""
+
+    def test_cjk_bigram_tokenize(self):
+        """Test that CJK runs become bigrams and Latin words stay whole"""
+        assert cjk_bigram_tokenize("机器学习 with Python 和") == [
+            "机器",
+            "器学",
+            "学习",
+            "with",
+            "python",
+            "和",
+        ]
+
+    def test_default_tokenizer_ignores_cjk(self):
+        """Test that the default tokenizer cannot index Chinese text"""
+        storage = DocumentStorage()
+        storage.add_document("机器学习很有趣", "zh")
+
+        assert storage.search("学习") == []
+
+    def test_cjk_text_searchable_with_tokenizer(self):
+        """Test that a Chinese phrase is searchable with the CJK tokenizer"""
+        storage = DocumentStorage(tokenizer=cjk_bigram_tokenize)
+        storage.add_document("机器学习很有趣", "zh_ml")
+        storage.add_document("今天天气很好", "zh_weather")
+        storage.add_document("Machine learning is fun", "en_ml")
+
+        assert [doc_id for doc_id, _, _ in storage.search("机器学习")] == ["zh_ml"]
+        assert [doc_id for doc_id, _, _ in storage.search("天气")] == ["zh_weather"]
+        assert [doc_id for doc_id, _, _ in storage.search("Learning")] == ["en_ml"]
+
+    def test_custom_tokenizer(self):
+        """Test that a custom tokenizer is used for documents and queries"""
+        storage = DocumentStorage(tokenizer=lambda text: text.split("-"))
+        storage.add_document("Alpha-BETA-x", "doc1")
+
+        assert storage.search("beta")[0][0] == "doc1"
+        assert storage.search("x")[0][0] == "doc1"
+        assert storage.get_document_info("doc1")["word_counts"] == {
+            "alpha": 1,
+            "beta": 1,
+            "x": 1,
+        }
+
+    def test_fold_diacritics(self):
+        """Test that accents are removed from letters"""
+        assert fold_diacritics("Café naïve Ångström") == "Cafe naive Angstrom"
+
+    def test_collapse_repeats(self):
+        """Test that elongations shrink to two letters and doubles are kept"""
+        assert collapse_repeats("Sooooo coooool!!! book aaa") == "Soo cool!!! book aa"
+
+    def test_normalize_width(self):
+        """Test that full-width letters and ligatures become plain letters"""
+        assert normalize_width("ｐｙｔｈｏｎ ﬁle") == "python file"
+
+    def test_full_width_query_matches(self):
+        """Test that full-width queries match half-width text when normalizing"""
+        storage = DocumentStorage(normalize_width=True)
+        storage.add_document("A python file", "doc1")
+
+        assert storage.search("ｐｙｔｈｏｎ")[0][0] == "doc1"
+        assert storage.search("ﬁle")[0][0] == "doc1"
+
+        plain = DocumentStorage()
+        plain.add_document("A python file", "doc1")
+        assert plain.search("ｐｙｔｈｏｎ") == []
+
+    def test_elongated_query_matches(self):
+        """Test that elongated and normal spellings meet when collapsing"""
+        storage = DocumentStorage(collapse_repeats=True)
+        storage.add_document("That book was cool", "normal")
+        storage.add_document("Sooo coooooool", "elongated")
+
+        doc_ids = {doc_id for doc_id, _, _ in storage.search("cooooool", top_k=10)}
+        assert doc_ids == {"normal", "elongated"}
+        assert storage.search("book")[0][0] == "normal"
+        assert storage.search("booooook")[0][0] == "normal"
+
+    def test_elongations_kept_without_collapsing(self):
+        """Test that elongated words are distinct by default"""
+        storage = DocumentStorage()
+        storage.add_document("That was cool", "doc1")
+
+        assert storage.search("coooool") == []
+
+    def test_accents_split_words_without_folding(self):
+        """Test that the default tokenizer splits words at accented letters"""
+        storage = DocumentStorage()
+        storage.add_document("A café on the corner", "doc1")
+
+        assert storage.search("cafe") == []
+
+    def test_accented_and_unaccented_queries_match(self):
+        """Test that folding makes accented and unaccented forms the same word"""
+        storage = DocumentStorage(fold_diacritics=True)
+        storage.add_document("A café on the corner", "accented")
+        storage.add_document("A cafe by the station", "plain")
+
+        accented = storage.search("café", top_k=10)
+        plain = storage.search("cafe", top_k=10)
+        assert accented == plain
+        assert {doc_id for doc_id, _, _ in plain} == {"accented", "plain"}
+
+    def test_folding_keeps_letters_without_folded_form(self):
+        """Test that non-ASCII letters with no accent to fold stay in the word"""
+        storage = DocumentStorage(fold_diacritics=True)
+        storage.add_document("Smørrebrød and straße", "doc1")
+
+        assert storage.get_document_info("doc1")["word_counts"] == {
+            "smørrebrød": 1,
+            "and": 1,
+            "straße": 1,
+        }
+
+
+class TestIDFFunction:
+    """Unit tests for configurable IDF formulas"""
+
+    @staticmethod
+    def _add_documents(storage):
+        """Add documents where term frequency and rarity pull in opposite ways"""
+        storage.add_document("common common common rare", "frequent_common")
+        storage.add_document("common rare rare rare rare", "frequent_rare")
+        storage.add_document("common filler", "filler1")
+        storage.add_document("common filler", "filler2")
+
+    def test_default_idf_is_smoothed(self):
+        """Test that the default IDF matches the smoothed formula"""
+        storage = DocumentStorage()
+        self._add_documents(storage)
+
+        assert storage.get_idf("rare") == pytest.approx(smoothed_idf(4, 2))
+        assert storage.get_idf("rare") == pytest.approx(math.log2(5 / 3) + 1)
+
+    def test_custom_idf_changes_ranking(self):
+        """Test that a custom IDF can produce a different ranking"""
+        default = DocumentStorage()
+        self._add_documents(default)
+
+        # Rewards common words instead of rare ones
+        inverted = DocumentStorage(
+            idf_function=lambda total_documents, doc_freq: float(doc_freq)
+        )
+        self._add_documents(inverted)
+
+        assert default.search("common rare")[0][0] == "frequent_rare"
+        assert inverted.search("common rare")[0][0] == "frequent_common"
+        assert inverted.get_idf("common") == 4.0
+        assert inverted.get_idf("unknown") == 0
+
+    def test_custom_idf_passed_to_load(self, tmp_path):
+        """Test that a custom IDF, which is not saved, can be given to load"""
+        def idf_function(total_documents, doc_freq):
+            return float(doc_freq)
+
+        storage = DocumentStorage(idf_function=idf_function)
+        self._add_documents(storage)
+        storage.save(tmp_path / "storage.json")
+
+        loaded = DocumentStorage.load(
+            tmp_path / "storage.json", idf_function=idf_function
+        )
+
+        assert loaded.get_idf("common") == 4.0
+        assert loaded.search("common rare") == storage.search("common rare")
+        assert DocumentStorage.load(tmp_path / "storage.json").get_idf(
+            "common"
+        ) == pytest.approx(smoothed_idf(4, 4))
+
+    def test_load_rejects_saved_settings(self, tmp_path):
+        """Test that load options cannot override settings from the file"""
+        storage = DocumentStorage()
+        self._add_documents(storage)
+        storage.save(tmp_path / "storage.json")
+
+        with pytest.raises(ValueError, match="min_token_length"):
+            DocumentStorage.load(tmp_path / "storage.json", min_token_length=1)
+
+
+class TestMoreLikeThis:
+    """Unit tests for finding similar documents"""
+
+    @pytest.fixture
+    def similar_storage(self, populated_storage):
+        """Add a near-duplicate pair to the sample documents"""
+        populated_storage.add_document(
+            "Rust offers memory safety without garbage collection overhead.", "rust1"
+        )
+        populated_storage.add_document(
+            "Rust provides memory safety without needing garbage collection.", "rust2"
+        )
+        return populated_storage
+
+    def test_near_duplicates_are_most_similar(self, similar_storage):
+        """Test that near-duplicates are each other's top result"""
+        assert similar_storage.more_like_this("rust1")[0][0] == "rust2"
+        assert similar_storage.more_like_this("rust2")[0][0] == "rust1"
+
+    def test_source_document_excluded(self, similar_storage):
+        """Test that the source document is never returned"""
+        results = similar_storage.more_like_this("doc1", top_k=10)
+
+        assert results
+        assert "doc1" not in [doc_id for doc_id, _, _ in results]
+
+    def test_max_terms_limits_query(self, similar_storage):
+        """Test that only the top terms drive the query"""
+        # The single highest TF-IDF term of rust1 appears in no other document
+        assert similar_storage.more_like_this("rust1", max_terms=1) == []
+        assert similar_storage.more_like_this("rust1", max_terms=10)
+
+    def test_unknown_document(self, similar_storage):
+        """Test that an unknown document has no similar documents"""
+        assert similar_storage.more_like_this("missing") == []
+
+
+class TestEmptyDocuments:
+    """Unit tests for handling documents with no indexable words"""
+
+    @pytest.mark.parametrize("content", ["", "   \n\t  "])
+    def test_empty_document_warns_by_default(self, content, capsys):
+        """Test that empty documents are added with a warning by default"""
+        storage = DocumentStorage()
+
+        doc_id = storage.add_document(content, "empty")
+
+        assert doc_id == "empty"
+        assert storage.get_document_info("empty")["total_words"] == 0
+        captured = capsys.readouterr()
+        assert "Warning: Document empty has no indexable words" in captured.out
+
+    @pytest.mark.parametrize("content", ["", "   \n\t  "])
+    def test_empty_document_allowed(self, content, capsys):
+        """Test that empty documents are added silently when allowed"""
+        storage = DocumentStorage(empty_documents="allow")
+
+        storage.add_document(content, "empty")
+
+        assert storage.get_stats()["total_documents"] == 1
+        assert capsys.readouterr().out == ""
+
+    @pytest.mark.parametrize("content", ["", "   \n\t  "])
+    def test_empty_document_rejected(self, content):
+        """Test that empty documents raise an error when rejected"""
+        storage = DocumentStorage(empty_documents="reject")
+
+        with pytest.raises(ValueError, match="no indexable words"):
+            storage.add_document(content, "empty")
+
+        assert storage.get_stats()["total_documents"] == 0
+        assert storage.add_document("Real content", "real") == "real"
+
+
+class TestMaxTokenLength:
+    """Unit tests for the maximum token length cap"""
+
+    def test_unlimited_by_default(self):
+        """Test that long tokens are indexed when no cap is set"""
+        storage = DocumentStorage()
+        storage.add_document("a" * 10_000 + " normal words", "doc1")
+
+        assert storage.trie.get_max_depth() == 10_000
+
+    def test_long_token_dropped_with_cap(self):
+        """Test that tokens over the cap are excluded from the index"""
+        storage = DocumentStorage(max_token_length=50)
+        storage.add_document("a" * 10_000 + " normal words", "doc1")
+
+        assert storage.trie.get_max_depth() == 6
+        assert storage.get_document_info("doc1")["total_words"] == 2
+        assert storage.search("a" * 10_000) == []
+        assert storage.search("normal")[0][0] == "doc1"
+
+    def test_cap_applies_to_queries(self):
+        """Test that over-long query terms are dropped at query time"""
+        storage = DocumentStorage(max_token_length=6)
+        storage.add_document("python programming", "doc1")
+
+        assert storage.search("programming") == []
+        assert storage.search("programming python")[0][0] == "doc1"
+
+    def test_cap_survives_save_and_load(self, tmp_path):
+        """Test that a reloaded index tokenizes with the cap it was built with"""
+        storage = DocumentStorage(max_token_length=6)
+        storage.add_document("python programming", "doc1")
+        storage.save(tmp_path / "storage.json")
+
+        loaded = DocumentStorage.load(tmp_path / "storage.json")
+        loaded.add_document("programming guide", "doc2")
+
+        assert loaded.max_token_length == 6
+        assert loaded.get_document_info("doc2")["word_counts"] == {"guide": 1}
+
+
+class TestSnapshot:
+    """Unit tests for snapshot and restore"""
+
+    def test_restore_after_mutation(self, populated_storage):
+        """Test that restoring undoes adds, removes and renames"""
+        before_search = populated_storage.search("programming data")
+        before_stats = populated_storage.get_stats()
+        before_trie = populated_storage.trie.to_dict()
+
+        snapshot = populated_storage.snapshot()
+        populated_storage.add_document("Rust programming language", "doc5")
+        populated_storage.remove_document("doc1")
+        populated_storage.rename_document("doc2", "ml")
+
+        populated_storage.restore(snapshot)
+
+        assert populated_storage.search("programming data") == before_search
+        assert populated_storage.get_stats() == before_stats
+        assert populated_storage.trie.to_dict() == before_trie
+        assert populated_storage.get_document_info("doc5") is None
+
+    def test_snapshot_is_independent(self, populated_storage):
+        """Test that mutations after restoring do not corrupt the snapshot"""
+        snapshot = populated_storage.snapshot()
+
+        populated_storage.restore(snapshot)
+        populated_storage.add_document("Rust programming language", "doc5")
+        populated_storage.restore(snapshot)
+
+        assert populated_storage.get_document_info("doc5") is None
+        assert populated_storage.get_stats()["total_documents"] == 4
+
+
+class TestDeduplication:
+    """Unit tests for deduplicating documents by content"""
+
+    @pytest.fixture
+    def storage(self):
+        """Create a DocumentStorage instance that deduplicates content"""
+        return DocumentStorage(deduplicate_by_content=True)
+
+    def test_identical_content_returns_existing_id(self, storage):
+        """Test that re-adding identical content returns the first ID"""
+        first_id = storage.add_document("Python is a programming language.")
+        stats = storage.get_stats()
+
+        second_id = storage.add_document("Python  is a\nprogramming language.  ")
+
+        assert second_id == first_id
+        assert storage.get_stats() == stats
+        assert storage.add_document("Python is a language.") != first_id
+
+    def test_disabled_by_default(self):
+        """Test that identical content is added twice without the flag"""
+        storage = DocumentStorage()
+
+        first_id = storage.add_document("Same content")
+        second_id = storage.add_document("Same content")
+
+        assert first_id != second_id
+        assert storage.get_stats()["total_documents"] == 2
+
+    def test_hashes_follow_remove_and_rename(self, storage):
+        """Test that removed content can be re-added and renames are tracked"""
+        storage.add_document("Same content", "doc1")
+        storage.rename_document("doc1", "renamed")
+        assert storage.add_document("Same content") == "renamed"
+
+        storage.remove_document("renamed")
+        assert storage.add_document("Same content", "doc2") == "doc2"
+
+    def test_hashes_persisted(self, storage, tmp_path):
+        """Test that deduplication survives saving and loading"""
+        storage.add_document("Same content", "doc1")
+        file_path = tmp_path / "storage.json"
+        storage.save(file_path)
+
+        loaded = DocumentStorage.load(file_path)
+
+        assert loaded.add_document("Same content") == "doc1"
+        assert loaded.get_stats()["total_documents"] == 1
+
+    def test_loaded_and_restored_hashes_removed(self, storage, tmp_path):
+        """Test that removing documents forgets hashes from a load or restore"""
+        storage.add_document("Same content", "doc1")
+        file_path = tmp_path / "storage.json"
+        storage.save(file_path)
+        loaded = DocumentStorage.load(file_path)
+
+        loaded.remove_document("doc1")
+        assert loaded.add_document("Same content", "doc2") == "doc2"
+
+        snapshot = storage.snapshot()
+        storage.remove_document("doc1")
+        storage.restore(snapshot)
+        storage.remove_document("doc1")
+        assert storage.add_document("Same content", "doc3") == "doc3"
+
+
+class TestSmartSearch:
+    """Unit tests for smart search combining exact and prefix terms"""
+
+    @pytest.fixture
+    def storage(self):
+        """Create a DocumentStorage instance with exact and prefix matches"""
+        storage = DocumentStorage()
+        storage.add_document("python development tools", "both")
+        storage.add_document("python scripting language", "exact_only")
+        storage.add_document("web developer handbook", "prefix_only")
+        storage.add_document("unrelated cooking recipes", "neither")
+        return storage
+
+    def test_mixed_exact_and_prefix_terms(self, storage):
+        """Test that documents matching both term kinds rank highest"""
+        results = storage.smart_search("python develop*", top_k=10)
+
+        doc_ids = [doc_id for doc_id, _, _ in results]
+        assert doc_ids[0] == "both"
+        assert set(doc_ids) == {"both", "exact_only", "prefix_only"}
+
+    def test_prefix_only_matches_search_by_prefix(self, storage):
+        """Test that a single prefix term behaves like search_by_prefix"""
+        assert storage.smart_search("develop*") == storage.search_by_prefix("develop")
+
+    def test_exact_only_matches_search(self, storage):
+        """Test that queries without wildcards behave like search"""
+        assert storage.smart_search("python tools") == storage.search("python tools")
+
+    def test_escaped_asterisk_is_not_a_wildcard(self, storage):
+        """Test that an escaped asterisk is treated literally"""
+        assert storage.smart_search("develop\\*") == []
+
+
+class TestRadixTrie:
+    """Unit tests for the compressed RadixTrie"""
+
+    WORDS = [
+        "program",
+        "programming",
+        "programmer",
+        "progress",
+        "project",
+        "python",
+        "pythonic",
+        "java",
+        "javascript",
+        "a",
+    ]
+
+    @pytest.fixture
+    def tries(self):
+        """Create a Trie and a RadixTrie holding the same words and documents"""
+        tries = (Trie(), RadixTrie())
+        for trie in tries:
+            for i, word in enumerate(self.WORDS):
+                trie.insert(word)
+                trie.add_document_to_word(word, f"doc{i % 3}", i + 1)
+        return tries
+
+    def test_same_results_as_trie(self, tries):
+        """Test that lookups return the same results as the uncompressed trie"""
+        trie, radix = tries
+
+        for word in [*self.WORDS, "prog", "pro", "programm", "jav", "x", ""]:
+            assert radix.search(word) == trie.search(word)
+            assert radix.starts_with(word) == trie.starts_with(word)
+            assert radix.get_documents_for_prefix(
+                word
+            ) == trie.get_documents_for_prefix(word)
+            assert radix.get_documents_for_word(word) == trie.get_documents_for_word(
+                word
+            )
+        assert radix.get_all_words() == trie.get_all_words()
+        assert (
+            radix.get_all_words_with_frequency() == trie.get_all_words_with_frequency()
+        )
+
+    def test_starts_with_batch(self, tries):
+        """Test that batched prefix lookups match individual lookups"""
+        prefixes = ["pro", "prog", "programm", "Py", "java", "x", "", "pro"]
+
+        for trie in tries:
+            results = trie.starts_with_batch(prefixes)
+
+            assert results == {prefix: trie.starts_with(prefix) for prefix in prefixes}
+            assert results["prog"] == [
+                "program",
+                "programmer",
+                "programming",
+                "progress",
+            ]
+
+    def test_same_fuzzy_results_as_trie(self, tries):
+        """Test that fuzzy lookups follow multi-character edges correctly"""
+        trie, radix = tries
+
+        for word in ["programing", "pyton", "jaav", "progres", "b"]:
+            for max_distance in range(3):
+                assert radix.fuzzy_search(word, max_distance) == trie.fuzzy_search(
+                    word, max_distance
+                )
+
+    def test_same_range_results_as_trie(self, tries):
+        """Test that range queries follow multi-character edges correctly"""
+        trie, radix = tries
+
+        for low, high in [("prog", "progs"), ("a", "java"), ("pro", "pyz"), ("", "z")]:
+            assert radix.words_in_range(low, high) == trie.words_in_range(low, high)
+
+    def test_unique_word_count(self, tries):
+        """Test that the running word count matches a full walk"""
+        for t in tries:
+            assert t.get_unique_word_count() == len(self.WORDS)
+            t.insert("program")
+            t.insert("prog")
+            assert t.get_unique_word_count() == len(self.WORDS) + 1
+
+            t.remove("prog")
+            for i, word in enumerate(self.WORDS):
+                t.remove_document_from_word(word, f"doc{i % 3}")
+                t.remove(word)
+                assert t.get_unique_word_count() == len(t.get_all_words())
+
+            restored = type(t).from_dict(t.to_dict())
+            assert restored.get_unique_word_count() == 0
+
+    def test_same_for_each_word_as_trie(self, tries):
+        """Test that both tries visit the same words in the same order"""
+        visits = []
+        for t in tries:
+            visited = []
+            t.for_each_word(lambda word, freq: visited.append((word, freq)) or True)
+            visits.append(visited)
+
+        assert visits[0] == visits[1]
+
+    def test_prefix_ending_mid_edge(self):
+        """Test that a prefix ending inside an edge label matches its words"""
+        radix = RadixTrie()
+        radix.insert("programming")
+
+        assert radix.starts_with("progr") == ["programming"]
+        assert not radix.search("progr")
+        assert radix.starts_with("progx") == []
+
+    def test_fewer_nodes_than_trie(self, tries):
+        """Test that collapsing chains reduces the node count"""
+        trie, radix = tries
+
+        assert radix.get_node_count() < trie.get_node_count()
+        assert radix.get_node_count() <= 2 * len(self.WORDS)
+
+    def test_remove_merges_nodes(self, tries):
+        """Test that removing words keeps results and node count consistent"""
+        trie, radix = tries
+        for t in tries:
+            for i, word in enumerate(self.WORDS):
+                t.remove_document_from_word(word, f"doc{i % 3}")
+            t.remove("programmer")
+            t.remove("program")
+            t.remove("prog")
+
+        assert radix.get_all_words() == trie.get_all_words()
+        assert radix.starts_with("prog") == ["programming", "progress"]
+
+        rebuilt = RadixTrie()
+        for word in radix.get_all_words():
+            rebuilt.insert(word)
+        assert radix.get_node_count() == rebuilt.get_node_count()
+
+    def test_dict_round_trip(self, tries):
+        """Test that a radix trie survives to_dict and from_dict"""
+        _, radix = tries
+
+        restored = RadixTrie.from_dict(radix.to_dict())
+        assert restored.to_dict() == radix.to_dict()
+        assert restored.starts_with("java") == ["java", "javascript"]
+
+    def test_storage_with_compressed_trie(self, sample_documents):
+        """Test that storage search results do not depend on the trie variant"""
+        storage = DocumentStorage()
+        compressed = DocumentStorage(compress_trie=True)
+        for doc_id, content in sample_documents.items():
+            storage.add_document(content, doc_id)
+            compressed.add_document(content, doc_id)
+
+        assert isinstance(compressed.trie, RadixTrie)
+        for query in ["python", "web development", "data"]:
+            assert compressed.search(query) == storage.search(query)
+        assert compressed.search_by_prefix("prog") == storage.search_by_prefix("prog")
+        assert compressed.prefix_search("d") == storage.prefix_search("d")
+        assert compressed.trie.get_node_count() < storage.trie.get_node_count()
+
+
+class TestMetadata:
+    """Test per-document metadata fields"""
+
+    def test_metadata_is_stored(self, storage):
+        """Test that metadata passed when adding is returned"""
+        storage.add_document("Python guide", "doc1", metadata={"category": "code"})
+        storage.add_document("Cooking guide", "doc2")
+
+        assert storage.get_metadata("doc1") == {"category": "code"}
+        assert storage.get_metadata("doc2") == {}
+        assert storage.get_document_info("doc1")["metadata"] == {"category": "code"}
+
+    def test_metadata_follows_rename_and_remove(self, storage):
+        """Test that metadata moves with a renamed document and is removed with it"""
+        storage.add_document("Python guide", "doc1", metadata={"category": "code"})
+
+        storage.rename_document("doc1", "guide")
+        assert storage.get_metadata("guide") == {"category": "code"}
+
+        storage.remove_document("guide")
+        assert storage.get_metadata("guide") == {}
+
+    def test_metadata_restored_from_snapshot(self, storage):
+        """Test that restoring a snapshot restores metadata"""
+        storage.add_document("Python guide", "doc1", metadata={"category": "code"})
+        snapshot = storage.snapshot()
+
+        storage.remove_document("doc1")
+        storage.restore(snapshot)
+        assert storage.get_metadata("doc1") == {"category": "code"}
+
+
+class TestSearchGroupBy:
+    """Test collapsing search results by a metadata field"""
+
+    @pytest.fixture
+    def versioned_storage(self):
+        """Create a DocumentStorage with several versions of logical documents"""
+        storage = DocumentStorage()
+        storage.add_document("python python guide", "guide_v1", {"name": "guide"})
+        storage.add_document("python guide", "guide_v2", {"name": "guide"})
+        storage.add_document("python python python tips", "tips_v1", {"name": "tips"})
+        storage.add_document("python tips and tricks", "tips_v2", {"name": "tips"})
+        storage.add_document("python notes", "notes")
+        return storage
+
+    def test_keeps_best_result_per_group(self, versioned_storage):
+        """Test that only the highest-scoring version of each group is returned"""
+        results = versioned_storage.search_group_by("python", "name", top_k=10)
+        scores = {
+            doc_id: score
+            for doc_id, score, _ in versioned_storage.search("python", top_k=10)
+        }
+
+        doc_ids = [doc_id for doc_id, _, _ in results]
+        assert sorted(doc_ids) == ["guide_v1", "notes", "tips_v1"]
+        for doc_id, score, _ in results:
+            assert score == scores[doc_id]
+
+    def test_top_k_applies_to_groups(self, versioned_storage):
+        """Test that top_k counts groups rather than raw results"""
+        results = versioned_storage.search_group_by("python", "name", top_k=2)
+
+        assert [doc_id for doc_id, _, _ in results] == ["tips_v1", "guide_v1"]
+
+    def test_documents_without_field_are_kept(self, versioned_storage):
+        """Test that documents missing the field each form their own group"""
+        results = versioned_storage.search_group_by("python", "author", top_k=10)
+
+        assert len(results) == 5
+
+
+class TestSearchWhere:
+    """Test restricting search results with a predicate"""
+
+    def test_top_k_filled_from_passing_documents(self):
+        """Test that excluded documents do not use up top_k"""
+        storage = DocumentStorage()
+        for i in range(6):
+            storage.add_document("python " * (i + 1) + "code", f"doc{i}")
+
+        results = storage.search_where(
+            "python", 2, lambda doc_id, content: int(doc_id[-1]) % 2 == 0
+        )
+
+        assert [doc_id for doc_id, _, _ in storage.search("python", top_k=2)] == [
+            "doc5",
+            "doc4",
+        ]
+        assert [doc_id for doc_id, _, _ in results] == ["doc4", "doc2"]
+
+    def test_predicate_receives_content(self, populated_storage):
+        """Test that documents can be filtered by their content"""
+        results = populated_storage.search_where(
+            "python", 10, lambda doc_id, content: "web" in content.lower()
+        )
+
+        assert results
+        for doc_id, _, _ in results:
+            info = populated_storage.get_document_info(doc_id)
+            assert "web" in info["content"].lower()
+
+
+class TestSearchWithFacets:
+    """Test counting matching documents by metadata field values"""
+
+    @pytest.fixture
+    def categorized_storage(self):
+        """Create a DocumentStorage with documents in several categories"""
+        storage = DocumentStorage()
+        for i in range(4):
+            storage.add_document(f"python guide {i}", f"guide{i}", {"category": "docs"})
+        for i in range(3):
+            storage.add_document(f"python tip {i}", f"tip{i}", {"category": "tips"})
+        storage.add_document("java guide", "java", {"category": "docs"})
+        storage.add_document("python notes", "notes")
+        return storage
+
+    def test_counts_cover_all_matches(self, categorized_storage):
+        """Test that facet counts include matches beyond the top-k results"""
+        results, facets = categorized_storage.search_with_facets(
+            "python", top_k=2, facet_fields=["category"]
+        )
+
+        assert len(results) == 2
+        assert facets == {"category": {"docs": 4, "tips": 3}}
+
+    def test_missing_field_has_empty_counts(self, categorized_storage):
+        """Test that a field no matching document has yields no counts"""
+        _, facets = categorized_storage.search_with_facets(
+            "python -tip", facet_fields=["category", "author"]
+        )
+
+        assert facets == {"category": {"docs": 4}, "author": {}}
+
+
+class TestSearchIter:
+    """Unit tests for lazily iterating over search results"""
+
+    def test_matches_search_order(self, populated_storage):
+        """Test that iteration yields the same results as an unbounded search"""
+        for query in ["python", "programming data", "web^2 development"]:
+            assert list(populated_storage.search_iter(query)) == list(
+                populated_storage.search(query, top_k=1000)
+            )
+
+    def test_previews_built_lazily(self, populated_storage, monkeypatch):
+        """Test that previews are only built for results that are consumed"""
+        calls = []
+        build_preview = populated_storage._get_content_preview
+        monkeypatch.setattr(
+            populated_storage,
+            "_get_content_preview",
+            lambda *args: calls.append(args) or build_preview(*args),
+        )
+
+        results = populated_storage.search_iter("programming")
+        assert calls == []
+        next(results)
+        assert len(calls) == 1
+
+    def test_empty_query(self, populated_storage):
+        """Test that a query without words yields nothing"""
+        assert list(populated_storage.search_iter("!!")) == []
+
+
+class TestGetPreview:
+    """Unit tests for generating previews outside of search"""
+
+    @pytest.fixture
+    def long_storage(self):
+        """Create a DocumentStorage with a document longer than a preview"""
+        storage = DocumentStorage()
+        storage.add_document("filler " * 60 + "python appears late " * 5, "long")
+        storage.add_document("Python is short", "short")
+        return storage
+
+    def test_matches_search_preview(self, long_storage):
+        """Test that the preview matches the one embedded in search results"""
+        for doc_id, _, preview in long_storage.search("python", top_k=10):
+            assert long_storage.get_preview(doc_id, ["python"]) == preview
+
+    def test_terms_are_case_insensitive(self, long_storage):
+        """Test that terms match regardless of case"""
+        expected = long_storage.get_preview("long", ["python"])
+        assert long_storage.get_preview("long", ["PYTHON"]) == expected
+
+    def test_max_length(self, long_storage):
+        """Test that the preview respects max_length"""
+        preview = long_storage.get_preview("long", ["python"], max_length=20)
+
+        assert preview.startswith("...") and preview.endswith("...")
+        assert len(preview) == 20 + len("......")
+
+    def test_unknown_document(self, long_storage):
+        """Test that unknown documents have an empty preview"""
+        assert long_storage.get_preview("missing", ["python"]) == ""
+
+
+class TestPreviewSettings:
+    """Unit tests for configurable preview length and context"""
+
+    CONTENT = "filler " * 100 + "python " + "trailing " * 100
+
+    def test_default_preview_length(self, storage):
+        """Test that previews default to 200 characters plus ellipses"""
+        storage.add_document(self.CONTENT, "doc1")
+
+        preview = storage.search("python")[0][2]
+        assert len(preview) == 200 + len("......")
+        assert preview.index("python") == len("...") + 50
+
+    def test_longer_preview(self):
+        """Test that search previews honor a configured length"""
+        storage = DocumentStorage(preview_length=500)
+        storage.add_document(self.CONTENT, "doc1")
+
+        preview = storage.search("python")[0][2]
+        assert len(preview) == 500 + len("......")
+        assert storage.get_preview("doc1", ["python"]) == preview
+
+    def test_context_before(self):
+        """Test that the configured context precedes the first match"""
+        storage = DocumentStorage(preview_context_before=0)
+        storage.add_document(self.CONTENT, "doc1")
+
+        assert storage.search("python")[0][2].startswith("...python trailing")
+
+
+class TestDocumentBoost:
+    """Unit tests for per-document score multipliers"""
+
+    @pytest.fixture
+    def ranked_storage(self):
+        """Create a DocumentStorage where "strong" outscores "weak" for python"""
+        storage = DocumentStorage()
+        storage.add_document("python python python guide", "strong")
+        storage.add_document("python notes on many other topics", "weak")
+        storage.add_document("unrelated cooking recipes", "other")
+        return storage
+
+    def test_boost_overtakes_higher_scoring_document(self, ranked_storage):
+        """Test that a boosted document outranks a naturally better match"""
+        assert ranked_storage.search("python")[0][0] == "strong"
+
+        ranked_storage.set_document_boost("weak", 10)
+
+        assert [doc_id for doc_id, _, _ in ranked_storage.search("python")] == [
+            "weak",
+            "strong",
+        ]
+        assert ranked_storage.search_by_prefix("pyth")[0][0] == "weak"
+
+    def test_boost_multiplies_score(self, ranked_storage):
+        """Test that the boost multiplies the summed score"""
+        scores = {d: s for d, s, _ in ranked_storage.search("python guide")}
+        ranked_storage.set_document_boost("strong", 2.5)
+
+        boosted = {d: s for d, s, _ in ranked_storage.search("python guide")}
+        assert boosted["strong"] == pytest.approx(scores["strong"] * 2.5)
+        assert boosted["weak"] == pytest.approx(scores["weak"])
+        explanation = ranked_storage.explain_search("python guide", "strong")
+        assert sum(term["contribution"] for term in explanation) == pytest.approx(
+            boosted["strong"]
+        )
+
+    def test_zero_boost_hides_document(self, ranked_storage):
+        """Test that a boost of 0 removes a document from results"""
+        ranked_storage.set_document_boost("strong", 0)
+
+        assert [doc_id for doc_id, _, _ in ranked_storage.search("python")] == [
+            "weak"
+        ]
+        assert ranked_storage.search_by_prefix("pyth")[0][0] == "weak"
+
+    def test_default_boost(self, ranked_storage):
+        """Test that documents default to a boost of 1.0"""
+        assert ranked_storage.get_document_boost("strong") == 1.0
+        ranked_storage.set_document_boost("strong", 3)
+        assert ranked_storage.get_document_boost("strong") == 3
+
+    def test_boost_follows_rename_and_remove(self, ranked_storage):
+        """Test that boosts move with renamed documents and go with removed ones"""
+        ranked_storage.set_document_boost("strong", 3)
+
+        ranked_storage.rename_document("strong", "renamed")
+        assert ranked_storage.get_document_boost("renamed") == 3
+
+        ranked_storage.remove_document("renamed")
+        ranked_storage.add_document("python again", "renamed")
+        assert ranked_storage.get_document_boost("renamed") == 1.0
+
+    def test_invalid_boost(self, ranked_storage):
+        """Test that unknown documents and negative boosts are rejected"""
+        with pytest.raises(ValueError, match="does not exist"):
+            ranked_storage.set_document_boost("missing", 2)
+        with pytest.raises(ValueError, match="non-negative"):
+            ranked_storage.set_document_boost("strong", -1)
+        with pytest.raises(ValueError, match="non-negative"):
+            ranked_storage.set_document_boost("strong", float("nan"))
+
+
+class TestVocabulary:
+    """Unit tests for vocabulary introspection"""
+
+    def test_has_word(self, storage):
+        """Test that indexed words are found and unknown words are not"""
+        storage.add_document("Python programming", "doc1")
+
+        assert storage.has_word("python")
+        assert storage.has_word("Programming")
+        assert not storage.has_word("java")
+        assert not storage.has_word("prog")
+
+    def test_vocabulary(self, storage):
+        """Test that the vocabulary lists the added words in sorted order"""
+        storage.add_document("Python programming", "doc1")
+        storage.add_document("Data science with python", "doc2")
+
+        assert storage.vocabulary() == [
+            "data",
+            "programming",
+            "python",
+            "science",
+            "with",
+        ]
+
+    def test_removed_words_leave_vocabulary(self, storage):
+        """Test that words are dropped once no document contains them"""
+        storage.add_document("Python programming", "doc1")
+        storage.add_document("Python scripting", "doc2")
+        storage.remove_document("doc1")
+
+        assert storage.vocabulary() == ["python", "scripting"]
+        assert not storage.has_word("programming")
+
+
+class TestPrefixScoring:
+    """Unit tests for IDF-weighted prefix scoring"""
+
+    def test_rarer_completion_ranks_higher(self, storage):
+        """Test that matching a rarer word outranks matching a common one"""
+        storage.add_document("program notes", "common_match")
+        storage.add_document("progress notes", "rare_match")
+        storage.add_document("program guide", "filler1")
+        storage.add_document("program tips", "filler2")
+
+        results = storage.search_by_prefix("prog", top_k=4)
+
+        assert results[0][0] == "rare_match"
+        scores = {doc_id: score for doc_id, score, _ in results}
+        assert scores["rare_match"] > scores["common_match"]
+
+    def test_score_is_idf_weighted_fraction(self, storage):
+        """Test that each completion contributes count * IDF / document length"""
+        storage.add_document("program progress program notes", "doc1")
+        storage.add_document("program", "doc2")
+
+        results = storage.search_by_prefix("prog")
+        scores = {doc_id: score for doc_id, score, _ in results}
+        expected = (2 * storage.get_idf("program") + storage.get_idf("progress")) / 4
+        assert scores["doc1"] == pytest.approx(expected)
+
+
+class TestFuzzySearch:
+    """Unit tests for finding words within an edit distance in the trie"""
+
+    @pytest.fixture
+    def trie(self):
+        """Create a Trie with similar words"""
+        trie = Trie()
+        for word in ["python", "pythons", "typhon", "java", "program"]:
+            trie.insert(word)
+        return trie
+
+    def test_exact_match(self, trie):
+        """Test that a distance of 0 only matches the word itself"""
+        assert trie.fuzzy_search("Python", 0) == {"python": 0}
+
+    def test_edits(self, trie):
+        """Test that insertions, deletions and substitutions are counted"""
+        assert trie.fuzzy_search("pyton", 1) == {"python": 1}
+        assert trie.fuzzy_search("pythom", 1) == {"python": 1}
+        assert trie.fuzzy_search("pythonn", 1) == {"python": 1, "pythons": 1}
+        assert trie.fuzzy_search("pyton", 2) == {"python": 1, "pythons": 2}
+
+    def test_no_match(self, trie):
+        """Test that distant words are not matched"""
+        assert trie.fuzzy_search("rust", 2) == {}
+
+
+class TestSearchOptions:
+    """Unit tests for searching with a SearchOptions"""
+
+    def test_defaults_match_search(self, populated_storage):
+        """Test that default options give the same results as search"""
+        for query in ["python", "programming data", "web^2 development"]:
+            results, _ = populated_storage.search_with_options(query)
+            assert results == populated_storage.search(query)
+
+    def test_total_counts_all_matches(self, populated_storage):
+        """Test that the total counts matches beyond top_k"""
+        all_results = populated_storage.search("programming", top_k=100)
+
+        results, total = populated_storage.search_with_options(
+            "programming", SearchOptions(top_k=1)
+        )
+        assert len(results) == 1
+        assert total == len(all_results)
+
+    def test_offset_pages_through_results(self, populated_storage):
+        """Test that consecutive offsets return consecutive pages"""
+        all_results = populated_storage.search("programming data", top_k=100)
+
+        pages = [
+            populated_storage.search_with_options(
+                "programming data", SearchOptions(top_k=2, offset=offset)
+            )[0]
+            for offset in range(0, len(all_results), 2)
+        ]
+        assert [result for page in pages for result in page] == all_results
+
+    def test_negative_offset_rejected(self):
+        """Test that a negative offset is rejected instead of returning nothing"""
+        with pytest.raises(ValueError, match="non-negative"):
+            SearchOptions(offset=-1)
+
+    def test_min_score_and_no_previews(self, populated_storage):
+        """Test combining min_score with skipping previews"""
+        all_results = populated_storage.search("programming data", top_k=100)
+        min_score = all_results[1][1]
+
+        results, total = populated_storage.search_with_options(
+            "programming data",
+            SearchOptions(top_k=100, min_score=min_score, include_previews=False),
+        )
+        assert [(doc_id, score) for doc_id, score, _ in results] == [
+            (doc_id, score) for doc_id, score, _ in all_results if score >= min_score
+        ]
+        assert all(preview == "" for _, _, preview in results)
+        assert total == len(results)
+
+    def test_full_content(self, storage):
+        """Test that full_content returns whole documents instead of previews"""
+        content = "python " + "filler text " * 200
+        storage.add_document(content, "long")
+        storage.add_document("short python note", "short")
+
+        previews, _ = storage.search_with_options("python")
+        results, _ = storage.search_with_options(
+            "python", SearchOptions(full_content=True)
+        )
+
+        assert all(len(preview) < len(content) for _, _, preview in previews)
+        assert {doc_id: text for doc_id, _, text in results} == {
+            "long": content,
+            "short": "short python note",
+        }
+
+    def test_normalized_scores(self, populated_storage):
+        """Test that the top result scores 100 and ordering is preserved"""
+        raw, _ = populated_storage.search_with_options(
+            "programming data", SearchOptions(top_k=10)
+        )
+        normalized, _ = populated_storage.search_with_options(
+            "programming data", SearchOptions(top_k=10, normalize_scores=True)
+        )
+
+        assert len(raw) > 1
+        assert [doc_id for doc_id, _, _ in normalized] == [
+            doc_id for doc_id, _, _ in raw
+        ]
+        assert normalized[0][1] == pytest.approx(100)
+        for (_, score, _), (_, raw_score, _) in zip(normalized, raw):
+            assert score == pytest.approx(raw_score / raw[0][1] * 100)
+
+    def test_normalized_single_and_zero_scores(self, storage):
+        """Test normalizing a single result and results that all score zero"""
+        storage.add_document("python programming", "doc1")
+        options = SearchOptions(normalize_scores=True)
+
+        results, _ = storage.search_with_options("python", options)
+        assert [(doc_id, score) for doc_id, score, _ in results] == [("doc1", 100)]
+
+        zero_storage = DocumentStorage(idf_function=lambda total, doc_freq: 0.0)
+        zero_storage.add_document("python programming", "doc1")
+        zero_storage.add_document("python", "doc2")
+        results, _ = zero_storage.search_with_options("python", options)
+        assert [score for _, score, _ in results] == [0, 0]
+
+    def test_fuzzy_matches_misspelling(self, populated_storage):
+        """Test that fuzzy search finds documents despite a typo"""
+        assert populated_storage.search_with_options("pyhton") == ([], 0)
+
+        results, _ = populated_storage.search_with_options(
+            "pythn", SearchOptions(fuzzy=True, top_k=100)
+        )
+        exact = populated_storage.search("python", top_k=100)
+        assert [doc_id for doc_id, _, _ in results] == [
+            doc_id for doc_id, _, _ in exact
+        ]
+        for (_, score, _), (_, exact_score, _) in zip(results, exact):
+            assert score == pytest.approx(exact_score / 2)
+
+    def test_fuzzy_respects_max_edit_distance(self, populated_storage):
+        """Test that words further than max_edit_distance are not matched"""
+        options = SearchOptions(fuzzy=True, max_edit_distance=1)
+        assert populated_storage.search_with_options("pyhton", options) == ([], 0)
+
+        options = SearchOptions(fuzzy=True, max_edit_distance=2)
+        assert populated_storage.search_with_options("pyhton", options)[1] > 0
+
+
+class TestWarmup:
+    """Unit tests for precomputing scoring caches"""
+
+    QUERIES = ["python", "programming data", "web development"]
+
+    def test_same_results_with_and_without_warmup(self, sample_documents):
+        """Test that warming up does not change search results"""
+        cold = DocumentStorage()
+        warm = DocumentStorage()
+        for doc_id, content in sample_documents.items():
+            cold.add_document(content, doc_id)
+            warm.add_document(content, doc_id)
+
+        warm.warmup()
+
+        for query in self.QUERIES:
+            assert warm.search(query) == cold.search(query)
+            assert warm.search_cosine(query) == cold.search_cosine(query)
+
+    def test_changes_after_warmup_update_scores(self, populated_storage):
+        """Test that adding and removing documents after warm-up is reflected"""
+        populated_storage.warmup()
+        idf_before = populated_storage.get_idf("python")
+
+        populated_storage.add_document("Python python python", "new")
+
+        assert populated_storage.get_idf("python") < idf_before
+        assert populated_storage.search("python")[0][0] == "new"
+        assert populated_storage.search_cosine("python")[0][0] == "new"
+
+        populated_storage.remove_document("new")
+
+        assert populated_storage.get_idf("python") == pytest.approx(idf_before)
+        results = populated_storage.search("python")
+        assert "new" not in [doc_id for doc_id, _, _ in results]
+
+
+class TestPurgeTerm:
+    """Unit tests for removing a word from every document's index"""
+
+    def test_purged_term_not_searchable(self, populated_storage):
+        """Test that a purged word no longer matches any document"""
+        doc_ids = [doc_id for doc_id, _, _ in populated_storage.search("python", 10)]
+
+        assert populated_storage.purge_term("Python") == len(doc_ids)
+        assert populated_storage.search("python") == []
+        assert not populated_storage.has_word("python")
+        assert populated_storage.get_document_frequency("python") == 0
+
+    def test_document_lengths_drop(self, storage):
+        """Test that document lengths drop by the removed occurrences"""
+        storage.add_document("secret token secret value", "doc1")
+        storage.add_document("no match here", "doc2")
+
+        assert storage.purge_term("secret") == 1
+        assert storage.get_document_info("doc1")["total_words"] == 2
+        assert storage.get_document_info("doc1")["word_counts"] == {
+            "token": 1,
+            "value": 1,
+        }
+        assert storage.get_document_info("doc2")["total_words"] == 3
+
+    def test_content_unchanged(self, storage):
+        """Test that document content still contains the purged word"""
+        storage.add_document("secret token", "doc1")
+        storage.purge_term("secret")
+
+        assert storage.get_document_info("doc1")["content"] == "secret token"
+        assert storage.search("token")[0][0] == "doc1"
+
+    def test_unknown_term(self, populated_storage):
+        """Test that purging a word not in the index touches no documents"""
+        assert populated_storage.purge_term("nonexistent") == 0
+
+
+class TestPruneRareTerms:
+    """Unit tests for pruning words with a low document frequency"""
+
+    @pytest.fixture
+    def corpus(self, storage):
+        """Create a DocumentStorage where each word's document frequency is known"""
+        storage.add_document("common shared unique", "doc1")
+        storage.add_document("common shared rare", "doc2")
+        storage.add_document("common another", "doc3")
+        return storage
+
+    def test_prunes_words_below_threshold(self, corpus):
+        """Test that only words in fewer than min_doc_freq documents are removed"""
+        assert corpus.prune_rare_terms(2) == 3
+
+        assert corpus.vocabulary() == ["common", "shared"]
+        assert corpus.search("unique") == []
+        assert corpus.search("rare") == []
+        assert len(corpus.search("shared")) == 2
+        assert corpus.get_document_info("doc3")["total_words"] == 1
+
+    def test_threshold_of_one_prunes_nothing(self, corpus):
+        """Test that every indexed word meets a threshold of one"""
+        vocabulary = corpus.vocabulary()
+
+        assert corpus.prune_rare_terms(1) == 0
+        assert corpus.vocabulary() == vocabulary
+
+
+class TestSearchBySimilarity:
+    """Unit tests for ranking documents by similarity to external text"""
+
+    @pytest.fixture
+    def similarity_storage(self):
+        """Create a DocumentStorage with close and loose matches for a text"""
+        storage = DocumentStorage()
+        storage.add_document(
+            "Python web frameworks like Django and Flask build web applications",
+            "close",
+        )
+        storage.add_document("Python is used for data analysis", "loose")
+        storage.add_document("Gardening tips for growing tomatoes", "unrelated")
+        return storage
+
+    def test_close_match_ranks_first(self, similarity_storage):
+        """Test that the most similar document ranks above a loose match"""
+        results = similarity_storage.search_by_similarity(
+            "Building web applications in Python with Flask or Django"
+        )
+
+        assert [doc_id for doc_id, _, _ in results] == ["close", "loose"]
+        assert 0 < results[1][1] < results[0][1] <= 1
+
+    def test_identical_text_scores_one(self, similarity_storage):
+        """Test that a stored document's own text has similarity one"""
+        results = similarity_storage.search_by_similarity(
+            "Gardening tips for growing tomatoes"
+        )
+
+        assert results[0][0] == "unrelated"
+        assert results[0][1] == pytest.approx(1.0)
+
+    def test_no_known_words(self, similarity_storage):
+        """Test that text sharing no indexed words matches nothing"""
+        assert similarity_storage.search_by_similarity("quantum chromodynamics") == []
+        assert similarity_storage.search_by_similarity("") == []
+
+
+class TestIDGenerator:
+    """Unit tests for custom document ID generation"""
+
+    def test_default_ids(self, storage):
+        """Test that generated IDs default to the UUID scheme"""
+        doc_id = storage.add_document("Python programming")
+
+        assert re.fullmatch(r"doc_[0-9a-f-]{36}", doc_id)
+
+    def test_sequential_ids(self):
+        """Test that a counter-based generator gives sequential IDs"""
+        counter = iter(range(1, 100))
+        storage = DocumentStorage(id_generator=lambda: f"doc{next(counter)}")
+
+        assert storage.add_document("Python programming") == "doc1"
+        assert storage.add_document("Java programming") == "doc2"
+        assert storage.add_document("Rust programming", "custom") == "custom"
+        assert storage.add_document("Go programming") == "doc3"
+
+    def test_generator_can_be_replaced(self, storage):
+        """Test that the generator can be set after construction"""
+        storage.id_generator = lambda: "fixed"
+
+        assert storage.add_document("Python programming") == "fixed"
+
+
+class TestWordsInRange:
+    """Unit tests for finding words between two bounds"""
+
+    @pytest.fixture
+    def trie(self):
+        """Create a Trie with words spread across the alphabet"""
+        trie = Trie()
+        for word in ["al", "alpha", "alphabet", "apple", "beta", "bet", "gamma", "b"]:
+            trie.insert(word)
+        return trie
+
+    def test_subset(self, trie):
+        """Test that only words within the bounds are returned, sorted"""
+        assert trie.words_in_range("alpha", "beta") == [
+            "alpha",
+            "alphabet",
+            "apple",
+            "b",
+            "bet",
+        ]
+
+    def test_bounds_inclusivity(self, trie):
+        """Test that the low bound is inclusive and the high bound exclusive"""
+        assert trie.words_in_range("bet", "gamma") == ["bet", "beta"]
+        assert trie.words_in_range("bet", "gammaa") == ["bet", "beta", "gamma"]
+
+    def test_empty_range(self, trie):
+        """Test that empty and inverted ranges return no words"""
+        assert trie.words_in_range("beta", "beta") == []
+        assert trie.words_in_range("gamma", "alpha") == []
+        assert trie.words_in_range("c", "f") == []
+
+    def test_storage_words_in_range(self, populated_storage):
+        """Test that the storage exposes range queries over its vocabulary"""
+        words = populated_storage.words_in_range("d", "e")
+
+        assert words == [
+            word for word in populated_storage.vocabulary() if "d" <= word < "e"
+        ]
+        assert words
+
+
+class TestPreviewFormat:
+    """Unit tests for plain, markdown and HTML previews"""
+
+    CONTENT = "Learn Python <script>alert('x')</script> & more python"
+
+    def test_plain(self, storage):
+        """Test that plain previews are the unmodified content"""
+        storage.add_document(self.CONTENT, "doc1")
+
+        assert storage.search("python")[0][2] == self.CONTENT
+
+    def test_markdown(self):
+        """Test that markdown previews bold each query word"""
+        storage = DocumentStorage(preview_format="markdown")
+        storage.add_document(self.CONTENT, "doc1")
+
+        assert storage.search("python")[0][2] == (
+            "Learn **Python** <script>alert('x')</script> & more **python**"
+        )
+
+    def test_html_escapes_content(self):
+        """Test that HTML previews escape markup and mark query words"""
+        storage = DocumentStorage(preview_format="html")
+        storage.add_document(self.CONTENT, "doc1")
+
+        preview = storage.search("python")[0][2]
+
+        assert "<script>" not in preview
+        assert preview == (
+            "Learn <mark>Python</mark> &lt;script&gt;alert(&#x27;x&#x27;)"
+            "&lt;/script&gt; &amp; more <mark>python</mark>"
+        )
+
+    def test_html_truncated_preview(self):
+        """Test that truncated HTML previews are escaped inside the ellipses"""
+        storage = DocumentStorage(
+            preview_format="html", preview_length=20, preview_context_before=4
+        )
+        storage.add_document("<b> " * 30 + "python", "doc1")
+
+        preview = storage.search("python")[0][2]
+
+        assert preview == "...&lt;b&gt; <mark>python</mark>"
+
+    def test_regex_search_preview_escaped(self):
+        """Test that previews without query words are still escaped"""
+        storage = DocumentStorage(preview_format="html")
+        storage.add_document(self.CONTENT, "doc1")
+
+        assert "<script>" not in storage.regex_search(r"alert")[0][2]
+
+
+class TestUniqueWordCount:
+    """Unit tests for the running count of distinct indexed words"""
+
+    def test_count_matches_vocabulary(self, storage, sample_documents):
+        """Test that the count stays correct across adds, removes and cleanup"""
+        for doc_id, content in sample_documents.items():
+            storage.add_document(content, doc_id)
+            assert storage.get_stats()["total_words"] == len(storage.vocabulary())
+
+        storage.trie.insert("orphan")
+        storage.trie.cleanup_empty_words()
+        assert storage.get_stats()["total_words"] == len(storage.vocabulary())
+
+        for doc_id in list(sample_documents)[:2]:
+            storage.remove_document(doc_id)
+            assert storage.get_stats()["total_words"] == len(storage.vocabulary())
+
+        storage.purge_term("python")
+        assert storage.get_stats()["total_words"] == len(storage.vocabulary())
+
+    @pytest.mark.parametrize("include_trie", [False, True])
+    def test_count_after_load(self, populated_storage, tmp_path, include_trie):
+        """Test that a loaded storage reports the same count"""
+        file_path = tmp_path / "storage.json"
+        populated_storage.save(file_path, include_trie=include_trie)
+
+        loaded = DocumentStorage.load(file_path)
+        assert loaded.get_stats()["total_words"] == len(loaded.vocabulary())
+        assert loaded.get_stats() == populated_storage.get_stats()
+
+
+class TestForEachWord:
+    """Unit tests for streaming the trie's words"""
+
+    @pytest.fixture
+    def trie(self):
+        """Create a Trie with words in several documents"""
+        trie = Trie()
+        for word, doc_ids in [
+            ("python", ["doc1", "doc2"]),
+            ("program", ["doc1"]),
+            ("programming", ["doc2", "doc3", "doc4"]),
+            ("java", ["doc3"]),
+        ]:
+            trie.insert(word)
+            for doc_id in doc_ids:
+                trie.add_document_to_word(word, doc_id)
+        return trie
+
+    def test_visits_every_word_once(self, trie):
+        """Test that each word is visited once in sorted order"""
+        visited = []
+
+        def callback(word, doc_freq):
+            visited.append((word, doc_freq))
+            return True
+
+        trie.for_each_word(callback)
+
+        assert visited == [
+            ("java", 1),
+            ("program", 1),
+            ("programming", 3),
+            ("python", 2),
+        ]
+
+    def test_stops_when_callback_returns_false(self, trie):
+        """Test that returning False stops the traversal"""
+        visited = []
+
+        def callback(word, doc_freq):
+            visited.append(word)
+            return len(visited) < 2
+
+        trie.for_each_word(callback)
+
+        assert visited == ["java", "program"]
+
+
+class TestSearchWithFallback:
+    """Unit tests for exact search with fuzzy backfilling"""
+
+    @pytest.fixture
+    def fallback_storage(self):
+        """Create a DocumentStorage with exact and near matches for a query"""
+        storage = DocumentStorage()
+        storage.add_document("python web development", "exact")
+        storage.add_document("python data science", "python_only")
+        storage.add_document("flask development server", "development_only")
+        storage.add_document("gardening tips", "unrelated")
+        return storage
+
+    def test_no_fallback_when_exact_fills_top_k(self, fallback_storage):
+        """Test that results match search when exact matches are enough"""
+        expected = fallback_storage.search("python", top_k=2)
+        assert fallback_storage.search_with_fallback("python", top_k=2) == expected
+
+    def test_partially_misspelled_query(self, fallback_storage):
+        """Test that fuzzy matches follow exact ones without duplicates"""
+        exact = fallback_storage.search("python developmnt", top_k=10)
+
+        results = fallback_storage.search_with_fallback("python developmnt", top_k=10)
+
+        doc_ids = [doc_id for doc_id, _, _ in results]
+        assert doc_ids[: len(exact)] == [doc_id for doc_id, _, _ in exact]
+        assert set(doc_ids) == {"exact", "python_only", "development_only"}
+        assert len(doc_ids) == len(set(doc_ids))
+        assert doc_ids.index("exact") < doc_ids.index("development_only")
+
+    def test_top_k_limits_backfill(self, fallback_storage):
+        """Test that backfilling stops at top_k results"""
+        results = fallback_storage.search_with_fallback("pythn developmnt", top_k=1)
+
+        assert [doc_id for doc_id, _, _ in results] == ["exact"]
+
+    @pytest.mark.parametrize("top_k", [0, -1])
+    def test_non_positive_top_k_backfills_everything(self, fallback_storage, top_k):
+        """Test that a non-positive top_k returns every exact and fuzzy match"""
+        results = fallback_storage.search_with_fallback("python developmnt", top_k)
+
+        assert results == fallback_storage.search_with_fallback(
+            "python developmnt", top_k=10
+        )
+        assert {doc_id for doc_id, _, _ in results} == {
+            "exact",
+            "python_only",
+            "development_only",
+        }
+
+    def test_no_close_words(self, fallback_storage):
+        """Test that unmatched words with no close indexed words add nothing"""
+        assert fallback_storage.search_with_fallback("zzzzzz", top_k=5) == []
+
+
+class TestMaxPostingsPerWord:
+    """Unit tests for capping the documents tracked per word"""
+
+    def test_capped_word_keeps_top_documents(self):
+        """Test that only the documents with the highest counts are kept"""
+        storage = DocumentStorage(max_postings_per_word=2)
+        storage.add_document("python " * 2, "two")
+        storage.add_document("python " * 5, "five")
+        storage.add_document("python " * 1, "one")
+        storage.add_document("python " * 3 + "java", "three")
+
+        assert storage.trie.get_documents_for_word("python") == {"five": 5, "three": 3}
+        assert storage.get_document_frequency("python") == 2
+        assert {doc_id for doc_id, _, _ in storage.search("python", 10)} == {
+            "five",
+            "three",
+        }
+
+    @pytest.mark.parametrize("cap", [0, -1])
+    def test_cap_below_one_rejected(self, cap):
+        """Test that a cap leaving words without postings is rejected"""
+        with pytest.raises(ValueError, match="at least 1"):
+            DocumentStorage(max_postings_per_word=cap)
+
+    def test_ties_keep_existing_documents(self):
+        """Test that a new document tying the lowest count is not tracked"""
+        storage = DocumentStorage(max_postings_per_word=1)
+        storage.add_document("python code", "first")
+        storage.add_document("python tests", "second")
+
+        assert storage.trie.get_documents_for_word("python") == {"first": 1}
+        assert storage.search("tests")[0][0] == "second"
+
+    def test_uncapped_by_default(self, populated_storage):
+        """Test that every document is tracked without a cap"""
+        python_docs = [
+            doc_id
+            for doc_id in ["doc1", "doc2", "doc3", "doc4"]
+            if populated_storage.get_word_count(doc_id, "python")
+        ]
+
+        assert populated_storage.get_document_frequency("python") == len(python_docs)
+
+    def test_removing_dropped_document(self):
+        """Test that removing a document whose posting was dropped works"""
+        storage = DocumentStorage(max_postings_per_word=1)
+        storage.add_document("python python", "kept")
+        storage.add_document("python", "dropped")
+
+        assert storage.remove_document("dropped")
+        assert storage.trie.get_documents_for_word("python") == {"kept": 2}
+
+    def test_cap_survives_save_and_load(self, tmp_path):
+        """Test that a reloaded capped index has the same postings and results"""
+        storage = DocumentStorage(max_postings_per_word=2)
+        storage.add_document("python " * 2, "two")
+        storage.add_document("python " * 5 + "java", "five")
+        storage.add_document("python java", "one")
+        storage.add_document("python " * 3 + "java", "three")
+        storage.save(tmp_path / "storage.json")
+
+        loaded = DocumentStorage.load(tmp_path / "storage.json")
+
+        assert loaded.trie.to_dict() == storage.trie.to_dict()
+        assert loaded.get_document_frequency("python") == 2
+        for query in ["python", "java", "python java"]:
+            assert loaded.search(query, 10) == storage.search(query, 10)
+
+
+class TestAddDocumentFromStream:
+    """Unit tests for indexing a document from a text stream"""
+
+    CONTENT = "Python streaming works.\n" * 50 + "Split across: supercalifragilistic"
+
+    def test_tokens_searchable(self, storage):
+        """Test that every word in the stream is indexed despite small chunks"""
+        doc_id = storage.add_document_from_stream(
+            io.StringIO(self.CONTENT), "stream", chunk_size=7
+        )
+        storage.add_document(self.CONTENT, "string")
+
+        assert doc_id == "stream"
+        assert storage.search("supercalifragilistic", top_k=10)[0][1] > 0
+        assert storage.get_document_info("stream")["word_counts"] == (
+            storage.get_document_info("string")["word_counts"]
+        )
+
+    def test_stored_content_is_bounded(self, storage):
+        """Test that only a prefix of the stream is kept as content"""
+        storage.add_document_from_stream(
+            io.StringIO(self.CONTENT), "stream", max_stored_length=30, chunk_size=8
+        )
+
+        assert storage.get_document_info("stream")["content"] == self.CONTENT[:30]
+        assert storage.get_document_info("stream")["total_words"] == 153
+
+    def test_generated_id(self, storage):
+        """Test that an ID is generated when none is given"""
+        doc_id = storage.add_document_from_stream(io.StringIO("Python streaming"))
+
+        assert doc_id.startswith("doc_")
+
+    def test_deduplicates_like_add_document(self):
+        """Test that a streamed duplicate of a stored document is detected"""
+        storage = DocumentStorage(deduplicate_by_content=True)
+        storage.add_document(self.CONTENT, "original")
+
+        doc_id = storage.add_document_from_stream(
+            io.StringIO(self.CONTENT), chunk_size=5
+        )
+
+        assert doc_id == "original"
+
+
+class TestWordPositions:
+    """Unit tests for optional word positions in the forward index"""
+
+    def test_positions_in_document_order(self):
+        """Test that token offsets are recorded in document order"""
+        storage = DocumentStorage(store_positions=True)
+        storage.add_document("python is fun and python is fast", "doc1")
+
+        assert storage.get_word_positions("doc1", "python") == [0, 4]
+        assert storage.get_word_positions("doc1", "fast") == [6]
+        assert storage.get_word_positions("doc1", "missing") == []
+
+    def test_disabled_by_default(self, storage):
+        """Test that positions are not stored unless enabled"""
+        storage.add_document("python is fun", "doc1")
+
+        assert storage.get_word_positions("doc1", "python") == []
+        assert storage._forward_index._doc_id_to_positions == {}
+
+    def test_stream_offsets_match_add_document(self):
+        """Test that streamed documents get the same offsets as added ones"""
+        content = "python streaming works " * 20
+        storage = DocumentStorage(store_positions=True)
+        storage.add_document(content, "string")
+        storage.add_document_from_stream(io.StringIO(content), "stream", chunk_size=7)
+
+        assert storage.get_word_positions("stream", "works") == (
+            storage.get_word_positions("string", "works")
+        )
+
+    def test_positions_follow_document_changes(self):
+        """Test that renaming, purging and removing update positions"""
+        storage = DocumentStorage(store_positions=True)
+        storage.add_document("python is fun", "doc1")
+
+        storage.rename_document("doc1", "doc2")
+        assert storage.get_word_positions("doc2", "fun") == [2]
+
+        storage.purge_term("fun")
+        assert storage.get_word_positions("doc2", "fun") == []
+
+        storage.remove_document("doc2")
+        assert storage.get_word_positions("doc2", "python") == []
+
+
+class TestScorers:
+    """Unit tests for pluggable search scorers"""
+
+    class ConstantScorer:
+        """Scores every match as 1 regardless of frequency"""
+
+        def score(self, doc_id, term, stats):
+            return 1.0
+
+    def test_default_scorer_is_tf_idf(self, populated_storage):
+        """Test that the default scorer gives TF-IDF scores"""
+        results = populated_storage.search("python programming")
+
+        for doc_id, score, _ in results:
+            expected = sum(
+                populated_storage._calculate_tf_idf(doc_id, word)
+                for word in ["python", "programming"]
+            )
+            assert score == pytest.approx(expected)
+
+    def test_custom_scorer_ranks_by_matched_terms(self, storage):
+        """Test that rankings reflect a custom scorer"""
+        storage.add_document("python python python python", "frequent")
+        storage.add_document("python programming and other words here", "both")
+        storage.scorer = self.ConstantScorer()
+
+        results = storage.search("python programming")
+
+        assert [(doc_id, score) for doc_id, score, _ in results] == [
+            ("both", 2.0),
+            ("frequent", 1.0),
+        ]
+
+    def test_bm25_saturates_term_frequency(self):
+        """Test that BM25 gives diminishing credit for repeated terms"""
+        storage = DocumentStorage(scorer=BM25Scorer())
+        storage.add_document("python python python python", "frequent")
+        storage.add_document("python java ruby rust", "once")
+        storage.add_document("java ruby", "other")
+
+        scores = {doc_id: score for doc_id, score, _ in storage.search("python")}
+
+        assert scores["frequent"] > scores["once"] > 0
+        assert scores["frequent"] < 4 * scores["once"]
+
+    def test_scorer_receives_index_stats(self, storage):
+        """Test that the scorer is given the statistics for each match"""
+        calls = []
+
+        class RecordingScorer:
+            def score(self, doc_id, term, stats):
+                calls.append((doc_id, term, stats))
+                return 0.0
+
+        storage.add_document("python python java", "doc1")
+        storage.add_document("java", "doc2")
+        storage.scorer = RecordingScorer()
+        storage.search("python")
+
+        assert calls == [
+            (
+                "doc1",
+                "python",
+                IndexStats(
+                    total_documents=2,
+                    doc_freq=1,
+                    term_count=2,
+                    doc_length=3,
+                    average_doc_length=2.0,
+                    tf=2 / 3,
+                    idf=storage.get_idf("python"),
+                ),
+            )
+        ]
+
+    def test_explain_search_uses_scorer(self, populated_storage):
+        """Test that explained contributions match the custom scorer"""
+        populated_storage.scorer = self.ConstantScorer()
+
+        explanation = populated_storage.explain_search("python programming", "doc1")
+
+        assert [entry["contribution"] for entry in explanation] == [1.0, 1.0]
+
+
+class TestAddDocumentWithExplicitId:
+    """Unit tests for adding documents under an exact ID"""
+
+    def test_valid_explicit_id(self, storage):
+        """Test that the given ID is used as is"""
+        doc_id = storage.add_document_with_explicit_id("Python guide", "guides/python")
+
+        assert doc_id == "guides/python"
+        assert storage.search("python")[0][0] == "guides/python"
+
+    def test_empty_id_is_literal(self, storage):
+        """Test that an empty ID is kept rather than generated"""
+        assert storage.add_document_with_explicit_id("Python guide", "") == ""
+        assert storage.get_document_info("")["content"] == "Python guide"
+
+    def test_collision_raises(self, storage):
+        """Test that reusing an existing ID is an error"""
+        storage.add_document_with_explicit_id("Python guide", "doc1")
+
+        with pytest.raises(ValueError, match="already exists"):
+            storage.add_document_with_explicit_id("Java guide", "doc1")
+        assert storage.get_document_info("doc1")["content"] == "Python guide"
+
+    def test_control_characters_rejected(self, storage):
+        """Test that IDs with control characters are rejected"""
+        for doc_id in ["line\nbreak", "nul\x00", "surrogate\ud800"]:
+            with pytest.raises(ValueError, match="invalid characters"):
+                storage.add_document_with_explicit_id("Python guide", doc_id)
+
+        assert storage.get_stats()["total_documents"] == 0
+
+    def test_deduplicated_content_raises(self):
+        """Test that content matching another document is an error"""
+        storage = DocumentStorage(deduplicate_by_content=True)
+        storage.add_document("Python guide", "original")
+
+        with pytest.raises(ValueError, match="duplicates"):
+            storage.add_document_with_explicit_id("Python guide", "copy")
+
+
+class TestTFMode:
+    """Unit tests for the term frequency modes used in scoring"""
+
+    @pytest.fixture
+    def documents(self):
+        """A keyword-stuffed document and a shorter relevant one"""
+        return {
+            "stuffed": " ".join(["python"] * 100 + ["filler"] * 20),
+            "focused": "python programming guide",
+            "other": "java programming guide",
+        }
+
+    def make_storage(self, documents, tf_mode):
+        storage = DocumentStorage(tf_mode=tf_mode)
+        for doc_id, content in documents.items():
+            storage.add_document(content, doc_id)
+        return storage
+
+    def test_linear_favors_stuffed_document(self, documents):
+        """Test that linear TF ranks by the share of the document"""
+        storage = self.make_storage(documents, "linear")
+
+        results = storage.search("python")
+
+        assert [doc_id for doc_id, _, _ in results] == ["stuffed", "focused"]
+        assert results[0][1] == pytest.approx(100 / 120 * storage.get_idf("python"))
+
+    def test_log_dampens_repetition(self, documents):
+        """Test that log TF grows with the logarithm of the count"""
+        storage = self.make_storage(documents, "log")
+
+        scores = {doc_id: score for doc_id, score, _ in storage.search("python")}
+        idf = storage.get_idf("python")
+
+        assert scores["stuffed"] == pytest.approx((1 + math.log(100)) * idf)
+        assert scores["focused"] == pytest.approx(idf)
+
+    def test_boolean_counts_any_occurrence_once(self, documents):
+        """Test that boolean TF ignores how often a word occurs"""
+        storage = self.make_storage(documents, "boolean")
+
+        results = storage.search("python guide")
+
+        assert [doc_id for doc_id, _, _ in results][0] == "focused"
+        scores = {doc_id: score for doc_id, score, _ in results}
+        assert scores["stuffed"] == pytest.approx(storage.get_idf("python"))
+
+    def test_changing_mode_recomputes_norms(self, documents):
+        """Test that cosine scores follow a tf_mode changed after searching"""
+        storage = self.make_storage(documents, "linear")
+        storage.search_cosine("python guide")
+
+        storage.tf_mode = "boolean"
+
+        expected = self.make_storage(documents, "boolean")
+        assert storage.search_cosine("python guide") == expected.search_cosine(
+            "python guide"
+        )
+
+
+class TestExportInvertedIndex:
+    """Unit tests for exporting the inverted index"""
+
+    @pytest.fixture
+    def small_storage(self):
+        storage = DocumentStorage()
+        storage.add_document("python python java", "doc1")
+        storage.add_document("java, rust", "doc,2")
+        return storage
+
+    def test_jsonl_round_trip(self, small_storage):
+        """Test that each term's postings are written as a JSON line"""
+        output = io.StringIO()
+        small_storage.export_inverted_index(output, "jsonl")
+
+        records = [json.loads(line) for line in output.getvalue().splitlines()]
+        assert records == [
+            {"term": "java", "postings": {"doc1": 1, "doc,2": 1}},
+            {"term": "python", "postings": {"doc1": 2}},
+            {"term": "rust", "postings": {"doc,2": 1}},
+        ]
+
+    def test_csv_round_trip(self, small_storage):
+        """Test that each posting is written as a CSV row"""
+        output = io.StringIO()
+        small_storage.export_inverted_index(output, "csv")
+
+        rows = list(csv.reader(io.StringIO(output.getvalue())))
+        assert rows[0] == ["term", "doc_id", "count"]
+        assert sorted(rows[1:]) == [
+            ["java", "doc,2", "1"],
+            ["java", "doc1", "1"],
+            ["python", "doc1", "2"],
+            ["rust", "doc,2", "1"],
+        ]
+
+    def test_unsupported_format(self, small_storage):
+        """Test that an unknown format is rejected"""
+        with pytest.raises(ValueError, match="Unsupported"):
+            small_storage.export_inverted_index(io.StringIO(), "xml")
+
+
+class TestQueryCache:
+    """Unit tests for caching search results"""
+
+    @pytest.fixture
+    def cached_storage(self, sample_documents):
+        storage = DocumentStorage(query_cache_size=2)
+        for doc_id, content in sample_documents.items():
+            storage.add_document(content, doc_id)
+        return storage
+
+    @pytest.fixture
+    def score_calls(self, cached_storage, monkeypatch):
+        """Count how many times search scores documents"""
+        calls = []
+        score_weighted_words = cached_storage._score_weighted_words
+
+        def counting(word_weights):
+            calls.append(word_weights)
+            return score_weighted_words(word_weights)
+
+        monkeypatch.setattr(cached_storage, "_score_weighted_words", counting)
+        return calls
+
+    def test_cached_results_identical(self, cached_storage, populated_storage):
+        """Test that a cached query returns the same results as uncached"""
+        first = cached_storage.search("python programming")
+        second = cached_storage.search("python programming")
+
+        assert first == second == populated_storage.search("python programming")
+
+    def test_cache_hit_does_not_recompute(self, cached_storage, score_calls):
+        """Test that repeating a query does not score documents again"""
+        cached_storage.search("python")
+        cached_storage.search("python")
+
+        assert len(score_calls) == 1
+
+    def test_top_k_is_part_of_key(self, cached_storage):
+        """Test that different result limits are cached separately"""
+        assert len(cached_storage.search("programming", top_k=1)) == 1
+        assert len(cached_storage.search("programming", top_k=5)) > 1
+
+    def test_mutation_invalidates(self, cached_storage, score_calls):
+        """Test that adding or removing documents clears the cache"""
+        cached_storage.search("python")
+        cached_storage.add_document("Python python python", "doc5")
+        assert cached_storage.search("python")[0][0] == "doc5"
+
+        cached_storage.remove_document("doc5")
+        results = cached_storage.search("python")
+        assert "doc5" not in [doc_id for doc_id, _, _ in results]
+        assert len(score_calls) == 3
+
+    def test_settings_change_invalidates(self, cached_storage, sample_documents):
+        """Test that changing search settings does not serve stale results"""
+        cached_storage.search("python")
+
+        cached_storage.max_doc_freq_ratio = 0.1
+        assert cached_storage.search("python") == []
+
+        cached_storage.max_doc_freq_ratio = None
+        cached_storage.tf_mode = "boolean"
+        uncached = DocumentStorage(tf_mode="boolean")
+        for doc_id, content in sample_documents.items():
+            uncached.add_document(content, doc_id)
+        assert cached_storage.search("python") == uncached.search("python")
+
+    def test_least_recently_used_evicted(self, cached_storage, score_calls):
+        """Test that the least recently used query is dropped when full"""
+        cached_storage.search("python")
+        cached_storage.search("java")
+        cached_storage.search("python")
+        cached_storage.search("web")
+        cached_storage.search("python")
+        cached_storage.search("java")
+
+        assert len(score_calls) == 4
+
+    def test_disabled_by_default(self, populated_storage):
+        """Test that no results are cached by default"""
+        populated_storage.search("python")
+
+        assert populated_storage._query_to_results == {}
+
+
+class TestMaxDocFreqRatio:
+    """Unit tests for ignoring query words common to most documents"""
+
+    @pytest.fixture
+    def ratio_storage(self):
+        storage = DocumentStorage(max_doc_freq_ratio=0.9)
+        storage.add_document("the python guide", "doc1")
+        storage.add_document("the java guide", "doc2")
+        storage.add_document("the rust book", "doc3")
+        return storage
+
+    def test_common_word_ignored(self, ratio_storage):
+        """Test that a word in every document matches nothing"""
+        assert ratio_storage.search("the") == []
+
+    def test_rarer_word_still_matches(self, ratio_storage):
+        """Test that rarer words in the same query still match"""
+        results = ratio_storage.search("the python")
+
+        assert [doc_id for doc_id, _, _ in results] == ["doc1"]
+        assert ratio_storage.explain_search("the python", "doc1")[0]["term"] == (
+            "python"
+        )
+
+    def test_ratio_adapts_to_corpus(self, ratio_storage):
+        """Test that a word stops being ignored once it becomes rarer"""
+        ratio_storage.add_document("a python primer", "doc4")
+
+        assert len(ratio_storage.search("the")) == 3
+
+    def test_disabled_by_default(self):
+        """Test that common words are searched when no ratio is set"""
+        storage = DocumentStorage()
+        storage.add_document("the python guide", "doc1")
+
+        assert len(storage.search("the")) == 1
+
+
+class TestExcludedTerms:
+    """Unit tests for excluding documents with "-term" query words"""
+
+    def test_exclusion_removes_matching_documents(self, populated_storage):
+        """Test that documents containing an excluded word are dropped"""
+        matching = {doc_id for doc_id, _, _ in populated_storage.search("programming")}
+        with_python = set(populated_storage.trie.get_documents_for_word("python"))
+
+        results = populated_storage.search("programming -python", top_k=10)
+
+        assert {doc_id for doc_id, _, _ in results} == matching - with_python
+        assert matching & with_python
+
+    def test_excluded_word_is_not_scored(self, storage):
+        """Test that an excluded word adds nothing to other documents' scores"""
+        storage.add_document("rust programming", "doc1")
+        storage.add_document("python programming", "doc2")
+
+        results = storage.search("programming -python")
+
+        assert results == [
+            result for result in storage.search("programming") if result[0] == "doc1"
+        ]
+
+    def test_only_exclusions_returns_nothing(self, populated_storage):
+        """Test that a query of only exclusions matches no documents"""
+        assert populated_storage.search("-python") == []
+        assert list(populated_storage.search_iter("-python -java")) == []
+
+    def test_lone_dash_is_ignored(self, populated_storage):
+        """Test that a bare dash does not exclude anything"""
+        assert populated_storage.search("python -") == populated_storage.search(
+            "python"
+        )
+
+    def test_smart_search_with_prefix_excludes(self, storage):
+        """Test that exclusions also apply alongside prefix terms"""
+        storage.add_document("programming in rust", "doc1")
+        storage.add_document("programming in python", "doc2")
+
+        results = storage.smart_search("prog* -python")
+
+        assert [doc_id for doc_id, _, _ in results] == ["doc1"]
+
+
+class TestRelatedTerms:
+    """Unit tests for finding co-occurring terms"""
+
+    @pytest.fixture
+    def corpus(self):
+        storage = DocumentStorage()
+        storage.add_document("python django web", "doc1")
+        storage.add_document("python django orm", "doc2")
+        storage.add_document("python numpy", "doc3")
+        storage.add_document("java spring web", "doc4")
+        return storage
+
+    def test_most_frequent_co_occurrence_first(self, corpus):
+        """Test that the term sharing the most documents is ranked first"""
+        assert corpus.related_terms("python") == ["django", "numpy", "orm", "web"]
+
+    def test_top_n_limits_results(self, corpus):
+        """Test that only top_n terms are returned, excluding the word itself"""
+        assert corpus.related_terms("Python", top_n=1) == ["django"]
+
+    def test_unknown_word(self, corpus):
+        """Test that a word in no documents has no related terms"""
+        assert corpus.related_terms("rust") == []
+
+
+class TestGetHighlights:
+    """Unit tests for match spans within previews"""
+
+    def test_spans_bracket_matches(self, storage):
+        """Test that each span covers a matched word in the preview"""
+        storage.add_document("Python is great. I love python programming.", "doc1")
+
+        _, _, preview = storage.search("python programming")[0]
+        spans = storage.get_highlights("python programming", preview)
+
+        assert [preview[start:end] for start, end in spans] == [
+            "Python",
+            "python",
+            "programming",
+        ]
+
+    def test_spans_account_for_ellipsis(self):
+        """Test that offsets include a leading ellipsis in the preview"""
+        storage = DocumentStorage(preview_length=40, preview_context_before=5)
+        content = "filler " * 20 + "python programming " + "end " * 20
+        storage.add_document(content, "doc1")
+
+        _, _, preview = storage.search("python")[0]
+        spans = storage.get_highlights("python", preview)
+
+        assert preview.startswith("...")
+        assert len(spans) == 1
+        start, end = spans[0]
+        assert preview[start:end] == "python"
+        assert start == preview.index("python")
+
+    def test_whole_words_only(self, storage):
+        """Test that words inside longer words are not highlighted"""
+        assert storage.get_highlights("python", "pythonic python") == [(9, 15)]
+
+    def test_empty_query(self, storage):
+        """Test that a query without words has no highlights"""
+        assert storage.get_highlights("", "python") == []
+
+
+class TestMetricsObserver:
+    """Unit tests for reporting storage activity to a metrics observer"""
+
+    class RecordingObserver(MetricsObserver):
+        def __init__(self):
+            self.events = []
+
+        def observe_search(self, duration, num_results):
+            self.events.append(("search", duration, num_results))
+
+        def observe_add(self, doc_id):
+            self.events.append(("add", doc_id))
+
+        def observe_remove(self, doc_id):
+            self.events.append(("remove", doc_id))
+
+    def test_hooks_fire(self):
+        """Test that adds, removes and searches are observed"""
+        observer = self.RecordingObserver()
+        storage = DocumentStorage(metrics=observer)
+
+        storage.add_document("python guide", "doc1")
+        storage.add_document("java guide", "doc2")
+        storage.search("guide")
+        storage.remove_document("doc2")
+        storage.remove_document("missing")
+
+        assert [event[:2] for event in observer.events if event[0] != "search"] == [
+            ("add", "doc1"),
+            ("add", "doc2"),
+            ("remove", "doc2"),
+        ]
+        searches = [event for event in observer.events if event[0] == "search"]
+        assert len(searches) == 1
+        _, duration, num_results = searches[0]
+        assert duration >= 0
+        assert num_results == 2
+
+    def test_cached_search_observed(self):
+        """Test that searches answered from the cache are still observed"""
+        observer = self.RecordingObserver()
+        storage = DocumentStorage(metrics=observer, query_cache_size=1)
+        storage.add_document("python guide", "doc1")
+
+        storage.search("python")
+        storage.search("python")
+
+        assert [event[2] for event in observer.events if event[0] == "search"] == [
+            1,
+            1,
+        ]
+
+    @pytest.mark.parametrize(
+        "run_search",
+        [
+            lambda storage: storage.smart_search("pyth* guide"),
+            lambda storage: storage.search_cosine("python"),
+            lambda storage: storage.search_by_prefix("pyth"),
+            lambda storage: storage.search_query("python OR java"),
+            lambda storage: storage.search_where("guide", 5, lambda d, c: True),
+            lambda storage: storage.search_group_by("guide", "name"),
+            lambda storage: storage.search_with_facets("guide", 5, ["name"]),
+            lambda storage: list(storage.search_iter("guide")),
+        ],
+    )
+    def test_every_search_observed_once(self, run_search):
+        """Test that each search method is observed once with its result count"""
+        observer = self.RecordingObserver()
+        storage = DocumentStorage(metrics=observer)
+        storage.add_document("python guide", "doc1")
+        storage.add_document("java guide", "doc2")
+
+        run_search(storage)
+
+        searches = [event for event in observer.events if event[0] == "search"]
+        assert len(searches) == 1
+        assert searches[0][2] >= 1
+
+    def test_deduplicated_add_not_observed(self):
+        """Test that adding duplicate content does not count as an addition"""
+        observer = self.RecordingObserver()
+        storage = DocumentStorage(metrics=observer, deduplicate_by_content=True)
+
+        storage.add_document("python guide", "doc1")
+        storage.add_document("python guide", "doc2")
+
+        assert observer.events == [("add", "doc1")]
+
+    def test_default_observer_is_no_op(self, populated_storage):
+        """Test that storage works without a configured observer"""
+        assert isinstance(populated_storage.metrics, MetricsObserver)
+        assert populated_storage.search("python")
+
+
+class TestTopKLimits:
+    """Unit tests for how top_k limits results across search methods"""
+
+    @pytest.fixture
+    def matching_count(self, populated_storage):
+        """Number of sample documents mentioning programming"""
+        return populated_storage.get_document_frequency("programming")
+
+    @pytest.mark.parametrize("top_k", [0, -1])
+    def test_non_positive_returns_all(self, populated_storage, matching_count, top_k):
+        """Test that zero or negative top_k returns every match"""
+        results = populated_storage.search("programming", top_k=top_k)
+
+        assert len(results) == matching_count > 1
+        assert results == populated_storage.search("programming", top_k=100)
+
+    @pytest.mark.parametrize("top_k", [0, -3])
+    def test_consistent_across_methods(
+        self, populated_storage, matching_count, top_k
+    ):
+        """Test that prefix and smart search treat top_k the same way"""
+        assert len(populated_storage.search_by_prefix("programm", top_k)) == (
+            matching_count
+        )
+        assert len(populated_storage.smart_search("programm*", top_k)) == (
+            matching_count
+        )
+        assert len(populated_storage.smart_search("programming", top_k)) == (
+            matching_count
+        )
+
+    def test_larger_than_result_count(self, populated_storage, matching_count):
+        """Test that a top_k above the number of matches returns them all"""
+        results = populated_storage.search("programming", top_k=matching_count + 10)
+
+        assert len(results) == matching_count
+
+    def test_positive_limits_results(self, populated_storage):
+        """Test that a positive top_k still caps the results"""
+        assert len(populated_storage.search("programming", top_k=1)) == 1
+
+
+class TestIncrementalAggregates:
+    """Unit tests for running totals kept as documents change"""
+
+    def full_average(self, storage):
+        doc_lengths = storage._forward_index.get_document_lengths().values()
+        return sum(doc_lengths) / len(doc_lengths) if doc_lengths else 0
+
+    def test_interleaved_changes_match_recomputation(self, storage):
+        """Test that the running average matches a full recomputation"""
+        storage.add_document("python is a programming language", "doc1")
+        storage.add_document("java", "doc2")
+        storage.remove_document("doc1")
+        storage.add_document("rust rust rust systems programming", "doc3")
+        storage.purge_term("rust")
+        storage.add_document("go concurrency", "doc4")
+        storage.remove_document("doc2")
+        storage.rename_document("doc4", "doc5")
+
+        average = storage.get_stats()["average_document_length"]
+        assert average == pytest.approx(self.full_average(storage))
+        assert average == pytest.approx((2 + 2) / 2)
+
+    def test_empty_after_removing_everything(self, storage):
+        """Test that the average returns to zero once all documents are gone"""
+        storage.add_document("python guide", "doc1")
+        storage.remove_document("doc1")
+
+        assert storage.get_stats()["average_document_length"] == 0
+
+    def test_recompute_aggregates_recovers(self, populated_storage):
+        """Test that recomputing fixes a total changed behind the index"""
+        expected = self.full_average(populated_storage)
+        populated_storage._forward_index._total_length += 100
+
+        populated_storage.recompute_aggregates()
+
+        assert populated_storage.get_stats()["average_document_length"] == (
+            pytest.approx(expected)
+        )
+
+
+class TestCodeTokenize:
+    """Unit tests for the source code tokenizer"""
+
+    def test_camel_case_split(self):
+        """Test that camelCase identifiers give the whole word and its parts"""
+        assert code_tokenize("getUserName()") == ["getusername", "get", "user", "name"]
+
+    def test_snake_case_split(self):
+        """Test that snake_case identifiers are split on underscores"""
+        assert code_tokenize("self._user_name") == ["self", "user_name", "user", "name"]
+
+    def test_acronyms(self):
+        """Test that acronyms stay together before a capitalized word"""
+        assert code_tokenize("HTTPServer") == ["httpserver", "http", "server"]
+
+
+class TestResultDeduplication:
+    """Unit tests for listing each document at most once in results"""
+
+    @pytest.fixture
+    def variant_storage(self):
+        """Documents reachable through several fuzzy variants of a query"""
+        storage = DocumentStorage()
+        storage.add_document("python pythons pyton", "doc1")
+        storage.add_document("pythons", "doc2")
+        storage.add_document("pyton", "doc3")
+        return storage
+
+    def test_no_duplicates_under_expansion(self, variant_storage):
+        """Test that no document appears twice under fuzzy expansion"""
+        result_lists = [
+            variant_storage.search("python pythons pyton", top_k=10),
+            variant_storage.search_with_options(
+                "pythn", SearchOptions(top_k=10, fuzzy=True, max_edit_distance=2)
+            )[0],
+            variant_storage.search_with_fallback("python pythonz", top_k=10),
+            variant_storage.smart_search("pyth* python", top_k=10),
+        ]
+
+        for results in result_lists:
+            doc_ids = [doc_id for doc_id, _, _ in results]
+            assert doc_ids
+            assert len(doc_ids) == len(set(doc_ids))
+
+    def test_keeps_highest_score(self, storage):
+        """Test that the best-scoring duplicate is kept in its position"""
+        results = [("doc1", 1.0, ""), ("doc2", 3.0, "b"), ("doc1", 2.0, "a")]
+
+        assert storage._deduplicate_results(results) == [
+            ("doc2", 3.0, "b"),
+            ("doc1", 2.0, "a"),
+        ]
+
+
+class TestQueryParser:
+    """Unit tests for parsing structured queries"""
+
+    def test_single_term(self):
+        """Test that a single word parses to a term"""
+        assert parse("python") == Term("python")
+
+    def test_implicit_and(self):
+        """Test that adjacent terms are combined with AND"""
+        assert parse("python java") == And((Term("python"), Term("java")))
+
+    def test_explicit_operators_and_precedence(self):
+        """Test that AND binds tighter than OR"""
+        assert parse("a AND b OR c") == Or((And((Term("a"), Term("b"))), Term("c")))
+
+    def test_lowercase_operators_are_words(self):
+        """Test that operators are only recognized in upper case"""
+        assert parse("cats and dogs") == And((Term("cats"), Term("and"), Term("dogs")))
+
+    def test_grouping(self):
+        """Test that parentheses override precedence"""
+        assert parse("a AND (b OR c)") == And((Term("a"), Or((Term("b"), Term("c")))))
+
+    def test_exclusions(self):
+        """Test that NOT and a leading dash both exclude"""
+        assert parse("a NOT b -c") == And((Term("a"), Not(Term("b")), Not(Term("c"))))
+
+    def test_phrase_prefix_and_boost(self):
+        """Test that phrases, prefixes and boosts are recognized"""
+        assert parse('"machine learning"^2 prog* python^3') == And(
+            (
+                Phrase(("machine", "learning"), 2.0),
+                Prefix("prog"),
+                Term("python", 3.0),
+            )
+        )
+
+    def test_escaped_operator(self):
+        """Test that a backslash makes an operator an ordinary word"""
+        assert parse(r"\OR") == Term("OR")
+
+    @pytest.mark.parametrize(
+        "query, reason, position",
+        [
+            ("", "Query is empty", 0),
+            ('python "machine learning', "Unterminated quote", 7),
+            ("python AND", "Dangling AND operator", 7),
+            ("python OR OR java", "Dangling OR operator", 7),
+            ("NOT", "Dangling NOT operator", 0),
+            ("OR python", "Expected a term before OR", 0),
+            ("(python java", "Unclosed parenthesis", 0),
+            ("python)", "Unmatched closing parenthesis", 6),
+            ("()", "Empty parentheses", 0),
+            ('""', "Empty phrase", 0),
+            ("python^high", "Invalid boost 'high'", 6),
+            ("python OR NOT java", "Exclusion cannot be an OR operand", 10),
+            ("(-java -rust) OR python", "Exclusion cannot be an OR operand", 0),
+        ],
+    )
+    def test_malformed_queries(self, query, reason, position):
+        """Test that malformed queries report the reason and position"""
+        with pytest.raises(QuerySyntaxError) as error:
+            parse(query)
+
+        assert error.value.reason == reason
+        assert error.value.position == position
+        assert str(error.value) == f"{reason} at position {position}"
+
+
+class TestSearchQuery:
+    """Unit tests for searching with parsed query syntax"""
+
+    @pytest.fixture
+    def query_storage(self):
+        storage = DocumentStorage()
+        storage.add_document("machine learning with python", "doc1")
+        storage.add_document("learning machine code in java", "doc2")
+        storage.add_document("python and java programming", "doc3")
+        return storage
+
+    def doc_ids(self, results):
+        return sorted(doc_id for doc_id, _, _ in results)
+
+    def test_and_requires_every_term(self, query_storage):
+        """Test that adjacent terms must all match"""
+        assert self.doc_ids(query_storage.search_query("python java")) == ["doc3"]
+
+    def test_or_matches_either(self, query_storage):
+        """Test that OR matches documents with either side"""
+        results = query_storage.search_query("machine OR programming")
+
+        assert self.doc_ids(results) == ["doc1", "doc2", "doc3"]
+
+    def test_not_excludes(self, query_storage):
+        """Test that NOT and dash exclusions drop documents"""
+        assert self.doc_ids(query_storage.search_query("python NOT java")) == ["doc1"]
+        assert self.doc_ids(query_storage.search_query("learning -java")) == ["doc1"]
+        assert query_storage.search_query("-python") == []
+
+    def test_phrase_requires_consecutive_words(self, query_storage):
+        """Test that a phrase only matches words in order"""
+        results = query_storage.search_query('"machine learning"')
+
+        assert self.doc_ids(results) == ["doc1"]
+
+    def test_phrase_uses_stored_positions(self):
+        """Test that phrases match with stored positions and no content"""
+        storage = DocumentStorage(store_positions=True, store_contents=False)
+        storage.add_document("machine learning with python", "doc1")
+        storage.add_document("learning machine code", "doc2")
+
+        assert self.doc_ids(storage.search_query('"machine learning"')) == ["doc1"]
+
+    def test_prefix_and_grouping(self, query_storage):
+        """Test that prefixes and groups combine with other terms"""
+        results = query_storage.search_query("(python OR java) prog*")
+
+        assert self.doc_ids(results) == ["doc3"]
+
+    def test_boost_changes_ranking(self, query_storage):
+        """Test that boosting a term raises documents containing it"""
+        results = query_storage.search_query("python^10 OR machine")
+
+        assert results[0][0] == "doc1"
+        assert results[1][0] == "doc3"
+
+    def test_unindexable_terms_ignored(self, query_storage):
+        """Test that terms without indexable words place no constraint"""
+        assert self.doc_ids(query_storage.search_query("a python")) == [
+            "doc1",
+            "doc3",
+        ]
+
+    def test_exclusion_in_or_raises(self, query_storage):
+        """Test that an exclusion on its own in an OR branch is reported"""
+        with pytest.raises(QuerySyntaxError, match="Exclusion cannot be an OR"):
+            query_storage.search_query("machine OR -java")
+
+        results = query_storage.search_query("(learning -java) OR programming")
+        assert self.doc_ids(results) == ["doc1", "doc3"]
+
+    def test_malformed_query_raises(self, query_storage):
+        """Test that syntax errors are reported rather than searched"""
+        with pytest.raises(QuerySyntaxError, match="Unterminated quote"):
+            query_storage.search_query('"machine learning')
+
+
+class TestSearchIds:
+    """Unit tests for searching without previews"""
+
+    def test_matches_search(self, populated_storage):
+        """Test that IDs and scores are the same as search returns"""
+        for query in ["python", "programming", "web development", "python^2 java"]:
+            expected = [
+                (doc_id, score)
+                for doc_id, score, _ in populated_storage.search(query, top_k=10)
+            ]
+            assert populated_storage.search_ids(query, top_k=10) == expected
+
+    def test_skips_previews(self, populated_storage, monkeypatch):
+        """Test that no preview is built"""
+
+        def fail(*args, **kwargs):
+            raise AssertionError("preview built")
+
+        monkeypatch.setattr(populated_storage, "_get_content_preview", fail)
+
+        assert populated_storage.search_ids("python")
+
+
+class TestHyphenMode:
+    """Unit tests for the handling of hyphenated words"""
+
+    def make_storage(self, hyphen_mode):
+        storage = DocumentStorage(hyphen_mode=hyphen_mode)
+        storage.add_document("A state-of-the-art model", "hyphenated")
+        storage.add_document("Teams cooperate on art", "joined")
+        return storage
+
+    def test_join_hyphenated(self):
+        """Test that hyphenated words are joined, optionally keeping parts"""
+        assert join_hyphenated("co-operate, re-do") == "cooperate, redo"
+        assert join_hyphenated("co-operate", keep_parts=True) == "cooperate co operate"
+        assert join_hyphenated("a - b x-") == "a - b x-"
+
+    def test_split_indexes_parts(self):
+        """Test that the default splits hyphenated words into their parts"""
+        storage = self.make_storage("split")
+
+        assert "art" in storage.get_document_info("hyphenated")["word_counts"]
+        assert storage.search("stateoftheart") == []
+
+    def test_join_indexes_whole_word(self):
+        """Test that joined words are searchable with or without hyphens"""
+        storage = self.make_storage("join")
+
+        assert storage.search("state-of-the-art")[0][0] == "hyphenated"
+        assert storage.search("stateoftheart")[0][0] == "hyphenated"
+        assert [doc_id for doc_id, _, _ in storage.search("art")] == ["joined"]
+        co_operate = storage.search("co-operate")
+        assert [doc_id for doc_id, _, _ in co_operate] == ["joined"]
+
+    def test_both_indexes_whole_word_and_parts(self):
+        """Test that both the joined word and its parts are searchable"""
+        storage = self.make_storage("both")
+
+        assert storage.search("stateoftheart")[0][0] == "hyphenated"
+        art = {doc_id for doc_id, _, _ in storage.search("art", top_k=10)}
+        assert art == {"hyphenated", "joined"}
+        assert storage.search("state-of-the-art")[0][0] == "hyphenated"
+
+    def test_mode_is_saved(self, tmp_path):
+        """Test that the hyphen mode survives saving and loading"""
+        storage = self.make_storage("join")
+        storage.save(tmp_path / "storage.json")
+
+        loaded = DocumentStorage.load(tmp_path / "storage.json")
+
+        assert loaded.hyphen_mode == "join"
+        assert loaded.search("co-operate")[0][0] == "joined"
+
+
+class TestDocumentVector:
+    """Test exporting a document's TF-IDF vector"""
+
+    def test_matches_tf_idf(self, populated_storage):
+        """Test that each word's weight is its TF-IDF in the document"""
+        vector = populated_storage.get_document_vector("doc1")
+
+        assert vector is not None
+        assert set(vector) == set(
+            populated_storage.get_document_info("doc1")["word_counts"]
+        )
+        for word, weight in vector.items():
+            assert weight == populated_storage._calculate_tf_idf("doc1", word)
+
+    def test_unknown_document(self, populated_storage):
+        """Test that an unknown document has no vector"""
+        assert populated_storage.get_document_vector("missing") is None
+
+
+class TestCompleteQuery:
+    """Test completing the last word of a multi-word query"""
+
+    @pytest.fixture
+    def storage(self):
+        """Create a DocumentStorage where completions depend on context"""
+        storage = DocumentStorage()
+        storage.add_document("machine learning models", "ml1")
+        storage.add_document("machine learning pipelines", "ml2")
+        storage.add_document("legal lectures", "law1")
+        storage.add_document("legal least squares", "law2")
+        storage.add_document("legal leases", "law3")
+        return storage
+
+    def test_single_word_ranked_by_document_frequency(self, storage):
+        """Test that a lone prefix is completed with the most common words"""
+        assert storage.complete_query("le", limit=2) == ["legal", "learning"]
+
+    def test_earlier_words_constrain_completions(self, storage):
+        """Test that completions come from documents matching earlier words"""
+        assert storage.complete_query("machine le") == ["machine learning"]
+        assert storage.complete_query("Legal lea") == [
+            "Legal leases",
+            "Legal least",
+        ]
+
+    def test_no_completions(self, storage):
+        """Test that unmatched context or a trailing space gives nothing"""
+        assert storage.complete_query("python le") == []
+        assert storage.complete_query("machine ") == []
+        assert storage.complete_query("") == []
+
+
+class TestLeadBoost:
+    """Test boosting words found at the start of documents"""
+
+    def make_storage(self, **kwargs):
+        storage = DocumentStorage(**kwargs)
+        storage.add_document("Notes\nsome text about python", "body")
+        storage.add_document("Python notes\nsome text about", "lead")
+        storage.add_document("unrelated java text here", "other")
+        return storage
+
+    def test_lead_match_ranks_higher(self):
+        """Test that of two equal TF matches the one in the lead ranks first"""
+        storage = self.make_storage(lead_boost=2.0)
+
+        results = storage.search("python")
+
+        assert [doc_id for doc_id, _, _ in results] == ["lead", "body"]
+        assert results[0][1] == pytest.approx(2 * results[1][1])
+
+    def test_disabled_by_default(self):
+        """Test that lead matches score the same without a boost"""
+        storage = self.make_storage()
+
+        results = storage.search("python")
+
+        assert results[0][1] == pytest.approx(results[1][1])
+
+    def test_lead_kept_without_contents(self, tmp_path):
+        """Test that lead matches score the same once content is gone"""
+        storage = self.make_storage(lead_boost=2.0)
+        before = storage.search("python")
+
+        storage.drop_contents()
+        assert storage.search("python") == [
+            (doc_id, score, "") for doc_id, score, _ in before
+        ]
+
+        storage.save(tmp_path / "storage.json")
+        loaded = DocumentStorage.load(tmp_path / "storage.json")
+        assert loaded.search("python") == storage.search("python")
+
+        without_contents = self.make_storage(lead_boost=2.0, store_contents=False)
+        assert [score for _, score, _ in without_contents.search("python")] == [
+            score for _, score, _ in before
+        ]
+
+    def test_lead_of_truncated_stream(self):
+        """Test that a stream's lead is recorded beyond the stored content"""
+        storage = self.make_storage(lead_boost=2.0)
+        storage.add_document_from_stream(
+            io.StringIO("Python notes\nsome text about"),
+            "stream",
+            max_stored_length=3,
+            chunk_size=4,
+        )
+
+        scores = {doc_id: score for doc_id, score, _ in storage.search("python")}
+        assert scores["stream"] == pytest.approx(scores["lead"])
+
+    def test_changing_boost_recomputes_norms(self):
+        """Test that cosine scores follow a lead_boost changed after searching"""
+        storage = self.make_storage()
+        storage.search_cosine("python")
+
+        storage.lead_boost = 50.0
+
+        expected = self.make_storage(lead_boost=50.0)
+        assert storage.search_cosine("python") == expected.search_cosine("python")
+        assert all(score <= 1 for _, score, _ in storage.search_cosine("python"))
+
+    def test_lead_length_limits_lead(self):
+        """Test that words past lead_length in the first line are not boosted"""
+        storage = self.make_storage(lead_boost=2.0, lead_length=3)
+
+        results = storage.search("python")
+
+        assert results[0][1] == pytest.approx(results[1][1])